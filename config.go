@@ -0,0 +1,1088 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy"
+	"gopkg.in/yaml.v2"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings of the adapter, as read from the environment and the RIFF_CONFIG_FILE. Zero values leave
+// the matching feature disabled.
+type Config struct {
+	// GRPCPort is the port the invoker listens on, HTTPPort the one the adapter listens on
+	GRPCPort string
+	HTTPPort string
+
+	ReplayWindow   time.Duration
+	IdempotencyTTL time.Duration
+
+	RateLimit      float64
+	RateBurst      int
+	ClientIPHeader string
+	TrustedProxies []*net.IPNet
+
+	Streaming       bool
+	HeaderReadAhead int
+	LineBuffering   bool
+	OutputWrite     int
+	EmptyFrames     proxy.EmptyFrames
+	TypeChanges     proxy.ContentTypeChanges
+	ValidateUTF8    bool
+	InvalidUTF8     proxy.InvalidUTF8
+	MaxOutputBytes  int64
+	ReorderFrames   int
+	ReorderWait     time.Duration
+
+	Async       bool
+	AsyncStatus int
+
+	RejectUpgrades bool
+	UpgradeStatus  int
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	ErrorCacheTTL    time.Duration
+
+	AcceptWildcards       map[string][]string
+	InputTypes            map[string]string
+	NegotiateCharset      bool
+	DefaultCharset        string
+	StrictAccept          bool
+	FallbackAccept        string
+	ProducedContentTypes  []string
+	AcceptedContentTypes  []string
+	MethodOverride        []string
+	RejectedContentTypes  []string
+	DuplicateContentTypes proxy.DuplicateContentTypes
+	ContentTypeParam      bool
+
+	RawHTTP             bool
+	CloudEvents         bool
+	EncodeInput         string
+	IgnoreBlankBodies   bool
+	DecompressRequests  bool
+	VerifyChecksums     bool
+	CompressResponses   bool
+	CompressMinBytes    int64
+	NDJSONInput         bool
+	MultipartInput      bool
+	NDJSONOutput        string
+	SSEOutput           bool
+	SSEHeartbeat        time.Duration
+	SSEUntilData        bool
+	SSEEventNames       proxy.SSEEventNames
+	InputChunkThreshold int64
+	CoalesceWait        time.Duration
+	CoalesceBytes       int
+	MaxInputBytes       int64
+	MaxInputFrames      int
+	LongPollMaxWait     time.Duration
+	InvocationTimeout   time.Duration
+	ConnectTimeout      time.Duration
+
+	MetricsPath     string
+	DurationHeaders bool
+	ServerTiming    bool
+	ErrorTemplate   *template.Template
+	RequestIDs      bool
+	ReceivedAt      bool
+	ForwardHost     proxy.HostForwarding
+	AccessLog       proxy.AccessLogFormat
+	ValidateJSON    bool
+	SniffJSON       bool
+
+	GRPCStreamWindow int
+	GRPCConnWindow   int
+	GRPCCompress     bool
+
+	Routes        []proxy.Route
+	TrailingSlash proxy.TrailingSlash
+	SessionHeader string
+	SessionCookie string
+
+	ReadinessPath string
+	AdminToken    string
+
+	Debug            bool
+	BodyPreviewBytes int
+	WarmupInterval   time.Duration
+	ReapIdleConns    time.Duration
+}
+
+// configErrors lists every problem found in a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// loadConfig reads the configuration from the environment, falling back to the RIFF_CONFIG_FILE if set, and
+// validates it, reporting every problem at once rather than stopping at the first one.
+func loadConfig(getenv func(string) string) (*Config, error) {
+	env := &envReader{getenv: getenv, read: make(map[string]bool)}
+	var file map[string]string
+	if path := getenv("RIFF_CONFIG_FILE"); path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, configErrors{fmt.Sprintf("RIFF_CONFIG_FILE: %v", err)}
+		}
+		// variables set in the environment take precedence over the file
+		env.getenv = func(name string) string {
+			if value := getenv(name); value != "" {
+				return value
+			}
+			return file[name]
+		}
+	}
+	c := &Config{
+		GRPCPort: env.stringOr("GRPC_PORT", "8081"),
+		HTTPPort: env.stringOr("PORT", "8080"),
+
+		ReplayWindow:   env.duration("RIFF_REPLAY_WINDOW"),
+		IdempotencyTTL: env.duration("RIFF_IDEMPOTENCY_TTL"),
+
+		RateLimit:      env.float("RIFF_RATE_LIMIT"),
+		RateBurst:      env.int("RIFF_RATE_BURST"),
+		ClientIPHeader: env.string("RIFF_CLIENT_IP_HEADER"),
+		TrustedProxies: env.cidrs("RIFF_TRUSTED_PROXIES"),
+
+		Streaming:       env.bool("RIFF_STREAMING"),
+		HeaderReadAhead: env.int("RIFF_HEADER_READ_AHEAD"),
+		LineBuffering:   env.bool("RIFF_LINE_BUFFERING"),
+		OutputWrite:     env.int("RIFF_OUTPUT_WRITE_BYTES"),
+		EmptyFrames:     proxy.EmptyFrames(strings.ToLower(env.string("RIFF_EMPTY_FRAMES"))),
+		TypeChanges:     proxy.ContentTypeChanges(strings.ToLower(env.string("RIFF_CONTENT_TYPE_CHANGES"))),
+		ValidateUTF8:    env.bool("RIFF_VALIDATE_UTF8"),
+		InvalidUTF8:     proxy.InvalidUTF8(strings.ToLower(env.string("RIFF_INVALID_UTF8"))),
+		MaxOutputBytes:  int64(env.int("RIFF_MAX_OUTPUT_BYTES")),
+		ReorderFrames:   env.int("RIFF_REORDER_FRAMES"),
+		ReorderWait:     env.durationOr("RIFF_REORDER_WAIT", 100*time.Millisecond),
+
+		Async:       env.bool("RIFF_ASYNC"),
+		AsyncStatus: env.intOr("RIFF_ASYNC_STATUS", http.StatusAccepted),
+
+		RejectUpgrades: env.bool("RIFF_REJECT_UPGRADES"),
+		UpgradeStatus:  env.intOr("RIFF_UPGRADE_STATUS", http.StatusNotImplemented),
+
+		BreakerThreshold: env.int("RIFF_BREAKER_THRESHOLD"),
+		BreakerCooldown:  env.durationOr("RIFF_BREAKER_COOLDOWN", 30*time.Second),
+		ErrorCacheTTL:    env.duration("RIFF_ERROR_CACHE_TTL"),
+
+		AcceptWildcards:       env.wildcards("RIFF_ACCEPT_WILDCARDS"),
+		InputTypes:            env.mapping("RIFF_INPUT_TYPES"),
+		NegotiateCharset:      env.bool("RIFF_NEGOTIATE_CHARSET"),
+		DefaultCharset:        env.stringOr("RIFF_DEFAULT_CHARSET", "utf-8"),
+		StrictAccept:          env.bool("RIFF_STRICT_ACCEPT"),
+		FallbackAccept:        env.string("RIFF_FALLBACK_ACCEPT"),
+		AcceptedContentTypes:  env.list("RIFF_ACCEPTED_CONTENT_TYPES"),
+		ProducedContentTypes:  env.list("RIFF_PRODUCED_CONTENT_TYPES"),
+		MethodOverride:        env.list("RIFF_METHOD_OVERRIDE"),
+		RejectedContentTypes:  env.list("RIFF_REJECTED_CONTENT_TYPES"),
+		DuplicateContentTypes: proxy.DuplicateContentTypes(strings.ToLower(env.string("RIFF_DUPLICATE_CONTENT_TYPES"))),
+		ContentTypeParam:      env.bool("RIFF_CONTENT_TYPE_PARAM"),
+
+		RawHTTP:             env.bool("RIFF_RAW_HTTP"),
+		CloudEvents:         env.bool("RIFF_CLOUDEVENTS"),
+		EncodeInput:         env.string("RIFF_ENCODE_INPUT"),
+		IgnoreBlankBodies:   env.bool("RIFF_IGNORE_BLANK_BODIES"),
+		DecompressRequests:  env.bool("RIFF_DECOMPRESS_REQUESTS"),
+		VerifyChecksums:     env.bool("RIFF_VERIFY_CHECKSUMS"),
+		CompressResponses:   env.bool("RIFF_COMPRESS_RESPONSES"),
+		CompressMinBytes:    int64(env.intOr("RIFF_COMPRESS_MIN_BYTES", 1024)),
+		NDJSONInput:         env.bool("RIFF_NDJSON_INPUT"),
+		MultipartInput:      env.bool("RIFF_MULTIPART_INPUT"),
+		NDJSONOutput:        strings.ToLower(env.string("RIFF_NDJSON_OUTPUT")),
+		SSEOutput:           env.bool("RIFF_SSE_OUTPUT"),
+		SSEHeartbeat:        env.duration("RIFF_SSE_HEARTBEAT"),
+		SSEUntilData:        env.bool("RIFF_SSE_HEARTBEAT_UNTIL_DATA"),
+		SSEEventNames:       proxy.SSEEventNames(strings.ToLower(env.string("RIFF_SSE_EVENT_NAMES"))),
+		InputChunkThreshold: int64(env.int("RIFF_INPUT_CHUNK_THRESHOLD")),
+		CoalesceWait:        env.duration("RIFF_COALESCE_INPUT_WAIT"),
+		CoalesceBytes:       env.int("RIFF_COALESCE_INPUT_BYTES"),
+		MaxInputBytes:       int64(env.int("RIFF_MAX_INPUT_BYTES")),
+		MaxInputFrames:      env.int("RIFF_MAX_INPUT_FRAMES"),
+		LongPollMaxWait:     env.duration("RIFF_LONG_POLL_MAX_WAIT"),
+		InvocationTimeout:   env.duration("RIFF_INVOCATION_TIMEOUT"),
+		ConnectTimeout:      env.duration("RIFF_CONNECT_TIMEOUT"),
+
+		MetricsPath:     env.string("RIFF_METRICS_PATH"),
+		DurationHeaders: env.bool("RIFF_DURATION_HEADERS"),
+		ServerTiming:    env.bool("RIFF_SERVER_TIMING"),
+		ErrorTemplate:   env.template("RIFF_ERROR_TEMPLATE"),
+		RequestIDs:      env.bool("RIFF_REQUEST_IDS"),
+		ReceivedAt:      env.bool("RIFF_RECEIVED_AT_HEADER"),
+		ForwardHost:     proxy.HostForwarding(strings.ToLower(env.string("RIFF_FORWARD_HOST"))),
+		AccessLog:       proxy.AccessLogFormat(strings.ToLower(env.string("RIFF_ACCESS_LOG"))),
+		ValidateJSON:    env.bool("RIFF_VALIDATE_JSON"),
+		SniffJSON:       env.bool("RIFF_SNIFF_JSON"),
+
+		GRPCStreamWindow: env.int("RIFF_GRPC_STREAM_WINDOW"),
+		GRPCConnWindow:   env.int("RIFF_GRPC_CONN_WINDOW"),
+		GRPCCompress:     env.bool("RIFF_GRPC_COMPRESS"),
+
+		Routes:        env.routes("RIFF_ROUTES"),
+		TrailingSlash: proxy.TrailingSlash(strings.ToLower(env.string("RIFF_TRAILING_SLASH"))),
+		SessionHeader: env.string("RIFF_SESSION_HEADER"),
+		SessionCookie: env.string("RIFF_SESSION_COOKIE"),
+
+		ReadinessPath: env.string("RIFF_READINESS_PATH"),
+		AdminToken:    env.string("RIFF_ADMIN_TOKEN"),
+
+		Debug:            env.bool("RIFF_DEBUG"),
+		BodyPreviewBytes: env.intOr("RIFF_BODY_PREVIEW_BYTES", 256),
+		WarmupInterval:   env.duration("RIFF_WARMUP_INTERVAL"),
+		ReapIdleConns:    env.duration("RIFF_REAP_IDLE_CONNECTIONS"),
+	}
+
+	problems := env.problems
+	var unknown []string
+	for name := range file {
+		if !env.read[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("RIFF_CONFIG_FILE: unknown setting %s", name))
+	}
+	if err := c.Validate(); err != nil {
+		problems = append(problems, err.(configErrors)...)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// Validate checks that the settings make sense together, returning a configErrors listing every problem found.
+func (c *Config) Validate() error {
+	var problems configErrors
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	for _, port := range []struct{ name, value string }{{"GRPC_PORT", c.GRPCPort}, {"PORT", c.HTTPPort}} {
+		n, err := strconv.Atoi(port.value)
+		check(err == nil && n > 0 && n <= math.MaxUint16, "%s: invalid port %q", port.name, port.value)
+	}
+	check(c.GRPCPort != c.HTTPPort, "PORT: %s is already used by GRPC_PORT", c.HTTPPort)
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"RIFF_REPLAY_WINDOW", c.ReplayWindow},
+		{"RIFF_IDEMPOTENCY_TTL", c.IdempotencyTTL},
+		{"RIFF_BREAKER_COOLDOWN", c.BreakerCooldown},
+		{"RIFF_ERROR_CACHE_TTL", c.ErrorCacheTTL},
+		{"RIFF_LONG_POLL_MAX_WAIT", c.LongPollMaxWait},
+		{"RIFF_INVOCATION_TIMEOUT", c.InvocationTimeout},
+		{"RIFF_CONNECT_TIMEOUT", c.ConnectTimeout},
+		{"RIFF_WARMUP_INTERVAL", c.WarmupInterval},
+		{"RIFF_REAP_IDLE_CONNECTIONS", c.ReapIdleConns},
+		{"RIFF_SSE_HEARTBEAT", c.SSEHeartbeat},
+		{"RIFF_REORDER_WAIT", c.ReorderWait},
+		{"RIFF_COALESCE_INPUT_WAIT", c.CoalesceWait},
+	} {
+		check(d.value >= 0, "%s: %v is negative", d.name, d.value)
+	}
+	for _, n := range []struct {
+		name  string
+		value int64
+	}{
+		{"RIFF_RATE_BURST", int64(c.RateBurst)},
+		{"RIFF_HEADER_READ_AHEAD", int64(c.HeaderReadAhead)},
+		{"RIFF_OUTPUT_WRITE_BYTES", int64(c.OutputWrite)},
+		{"RIFF_MAX_OUTPUT_BYTES", c.MaxOutputBytes},
+		{"RIFF_REORDER_FRAMES", int64(c.ReorderFrames)},
+		{"RIFF_BREAKER_THRESHOLD", int64(c.BreakerThreshold)},
+		{"RIFF_INPUT_CHUNK_THRESHOLD", c.InputChunkThreshold},
+		{"RIFF_COALESCE_INPUT_BYTES", int64(c.CoalesceBytes)},
+		{"RIFF_MAX_INPUT_BYTES", c.MaxInputBytes},
+		{"RIFF_MAX_INPUT_FRAMES", int64(c.MaxInputFrames)},
+		{"RIFF_BODY_PREVIEW_BYTES", int64(c.BodyPreviewBytes)},
+		{"RIFF_COMPRESS_MIN_BYTES", c.CompressMinBytes},
+	} {
+		check(n.value >= 0, "%s: %d is negative", n.name, n.value)
+	}
+	check(c.ErrorCacheTTL <= 500*time.Millisecond, "RIFF_ERROR_CACHE_TTL: %v is over 500ms", c.ErrorCacheTTL)
+	check(c.RateLimit >= 0, "RIFF_RATE_LIMIT: %v is negative", c.RateLimit)
+
+	if c.Async {
+		switch c.AsyncStatus {
+		case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		default:
+			check(false, "RIFF_ASYNC_STATUS: unsupported status %d, must be 200, 202 or 204", c.AsyncStatus)
+		}
+	}
+	if c.RejectUpgrades {
+		switch c.UpgradeStatus {
+		case http.StatusUpgradeRequired, http.StatusNotImplemented:
+		default:
+			check(false, "RIFF_UPGRADE_STATUS: unsupported status %d, must be 426 or 501", c.UpgradeStatus)
+		}
+	}
+	check(c.EncodeInput == "" || strings.EqualFold(c.EncodeInput, "base64"),
+		"RIFF_ENCODE_INPUT: unsupported encoding %q", c.EncodeInput)
+	switch c.NDJSONOutput {
+	case "", "false", "true", "validate":
+	default:
+		check(false, "RIFF_NDJSON_OUTPUT: invalid value %q, must be true, false or validate", c.NDJSONOutput)
+	}
+	switch c.TrailingSlash {
+	case "", proxy.TrailingSlashAccept, proxy.TrailingSlashRedirect, proxy.TrailingSlashReject:
+	default:
+		check(false, "RIFF_TRAILING_SLASH: invalid value %q, must be accept, redirect or reject", c.TrailingSlash)
+	}
+	switch c.SSEEventNames {
+	case "", proxy.SSEEventNamesHeader, proxy.SSEEventNamesContentType:
+	default:
+		check(false, "RIFF_SSE_EVENT_NAMES: invalid value %q, must be header or content-type", c.SSEEventNames)
+	}
+	switch c.InvalidUTF8 {
+	case "", proxy.InvalidUTF8Reject, proxy.InvalidUTF8Replace:
+	default:
+		check(false, "RIFF_INVALID_UTF8: invalid value %q, must be reject or replace", c.InvalidUTF8)
+	}
+	switch c.EmptyFrames {
+	case "", proxy.EmptyFramesWrite, proxy.EmptyFramesSkip:
+	default:
+		check(false, "RIFF_EMPTY_FRAMES: invalid value %q, must be write or skip", c.EmptyFrames)
+	}
+	switch c.ForwardHost {
+	case "", proxy.HostForwardingForwardedHost, proxy.HostForwardingRiffHost:
+	default:
+		check(false, "RIFF_FORWARD_HOST: invalid value %q, must be x-forwarded-host or x-riff-host", c.ForwardHost)
+	}
+	switch c.TypeChanges {
+	case "", proxy.ContentTypeChangesWarn, proxy.ContentTypeChangesReject:
+	default:
+		check(false, "RIFF_CONTENT_TYPE_CHANGES: invalid value %q, must be warn or reject", c.TypeChanges)
+	}
+	switch c.DuplicateContentTypes {
+	case "", proxy.DuplicateContentTypesFirst, proxy.DuplicateContentTypesReject:
+	default:
+		check(false, "RIFF_DUPLICATE_CONTENT_TYPES: invalid value %q, must be first or reject", c.DuplicateContentTypes)
+	}
+	switch c.AccessLog {
+	case "", proxy.AccessLogCommon, proxy.AccessLogCombined:
+	default:
+		check(false, "RIFF_ACCESS_LOG: invalid value %q, must be common or combined", c.AccessLog)
+	}
+	for _, window := range []struct {
+		name string
+		size int
+	}{{"RIFF_GRPC_STREAM_WINDOW", c.GRPCStreamWindow}, {"RIFF_GRPC_CONN_WINDOW", c.GRPCConnWindow}} {
+		check(window.size == 0 || (window.size >= 65535 && window.size <= math.MaxInt32),
+			"%s: %d is out of range, must be at least 65535 bytes", window.name, window.size)
+	}
+	for mediaType, name := range c.InputTypes {
+		check(name != "", "RIFF_INPUT_TYPES: %s is mapped to an empty input name", mediaType)
+	}
+	for _, contentType := range c.ProducedContentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		check(err == nil && strings.Contains(mediaType, "/"),
+			"RIFF_PRODUCED_CONTENT_TYPES: invalid media type %q", contentType)
+	}
+
+	// the function is served on /, the other endpoints must neither shadow it nor each other
+	paths := make(map[string]string)
+	if c.AdminToken != "" {
+		paths["/admin/drain"], paths["/admin/undrain"] = "the admin endpoints", "the admin endpoints"
+	}
+	for _, path := range []struct{ name, value string }{
+		{"RIFF_METRICS_PATH", c.MetricsPath},
+		{"RIFF_READINESS_PATH", c.ReadinessPath},
+	} {
+		if path.value == "" {
+			continue
+		}
+		check(strings.HasPrefix(path.value, "/") && path.value != "/",
+			"%s: %q must start with / and not be /", path.name, path.value)
+		if other, ok := paths[path.value]; ok {
+			check(false, "%s: %q is already used by %s", path.name, path.value, other)
+		}
+		paths[path.value] = path.name
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Options returns the proxy options enabling the configured features.
+func (c *Config) Options() []proxy.Option {
+	var options []proxy.Option
+
+	// Reject requests re-using an X-Riff-Nonce within the window, e.g. RIFF_REPLAY_WINDOW=5m
+	if c.ReplayWindow > 0 {
+		options = append(options, proxy.WithReplayProtection(c.ReplayWindow))
+	}
+
+	// Serve retries carrying the same Idempotency-Key from a cache, e.g. RIFF_IDEMPOTENCY_TTL=24h
+	if c.IdempotencyTTL > 0 {
+		options = append(options, proxy.WithIdempotency(c.IdempotencyTTL))
+	}
+
+	// Limit each client to RIFF_RATE_LIMIT requests per second, with bursts of up to RIFF_RATE_BURST requests
+	if c.RateLimit > 0 {
+		options = append(options, proxy.WithRateLimit(c.RateLimit, c.RateBurst))
+	}
+
+	// Identify clients by a header such as X-Forwarded-For, as long as the request comes from a trusted proxy
+	if c.ClientIPHeader != "" {
+		options = append(options, proxy.WithClientIPHeader(c.ClientIPHeader, c.TrustedProxies))
+	}
+
+	// Write output frames as they arrive, using chunked transfer encoding
+	if c.Streaming {
+		options = append(options, proxy.WithStreaming())
+	}
+
+	// Output frames read before committing the status and headers of streamed responses, e.g. RIFF_HEADER_READ_AHEAD=2
+	if c.HeaderReadAhead > 0 {
+		options = append(options, proxy.WithHeaderReadAhead(c.HeaderReadAhead))
+	}
+
+	// Write streamed text/plain responses by whole lines
+	if c.LineBuffering {
+		options = append(options, proxy.WithLineBuffering())
+	}
+
+	// Write large output frames in flushed pieces, e.g. RIFF_OUTPUT_WRITE_BYTES=65536
+	if c.OutputWrite > 0 {
+		options = append(options, proxy.WithOutputWriteSize(c.OutputWrite))
+	}
+
+	// Check text outputs are valid UTF-8, rejecting them unless RIFF_INVALID_UTF8=replace
+	if c.ValidateUTF8 {
+		policy := c.InvalidUTF8
+		if policy == "" {
+			policy = proxy.InvalidUTF8Reject
+		}
+		options = append(options, proxy.WithUTF8Validation(policy))
+	}
+
+	// Handle zero-length output frames of streamed responses, e.g. RIFF_EMPTY_FRAMES=skip
+	if c.EmptyFrames != "" {
+		options = append(options, proxy.WithEmptyFrames(c.EmptyFrames))
+	}
+
+	// Handle output frames changing the content type of streamed responses, e.g. RIFF_CONTENT_TYPE_CHANGES=reject
+	if c.TypeChanges != "" {
+		options = append(options, proxy.WithContentTypeChanges(c.TypeChanges))
+	}
+
+	// Limit the size of response bodies, e.g. RIFF_MAX_OUTPUT_BYTES=1048576
+	if c.MaxOutputBytes > 0 {
+		options = append(options, proxy.WithMaxOutputBytes(c.MaxOutputBytes))
+	}
+
+	// Write numbered output frames in order, holding up to RIFF_REORDER_FRAMES for up to RIFF_REORDER_WAIT
+	if c.ReorderFrames > 0 {
+		options = append(options, proxy.WithOutputReordering(c.ReorderFrames, c.ReorderWait))
+	}
+
+	// Respond as soon as the function is invoked, with RIFF_ASYNC_STATUS (200, 202 or 204, default 202)
+	if c.Async {
+		options = append(options, proxy.WithAsync(c.AsyncStatus))
+	}
+
+	// Reject requests asking to switch protocols with RIFF_UPGRADE_STATUS (426 or 501, default 501)
+	if c.RejectUpgrades {
+		options = append(options, proxy.WithUpgradeRejection(c.UpgradeStatus))
+	}
+
+	// Stop calling the backend for RIFF_BREAKER_COOLDOWN after RIFF_BREAKER_THRESHOLD consecutive failures
+	if c.BreakerThreshold > 0 {
+		options = append(options, proxy.WithCircuitBreaker(c.BreakerThreshold, c.BreakerCooldown))
+	}
+
+	// Answer identical requests with the transient error of the backend for a moment, e.g. RIFF_ERROR_CACHE_TTL=200ms
+	if c.ErrorCacheTTL > 0 {
+		options = append(options, proxy.WithErrorCaching(c.ErrorCacheTTL))
+	}
+
+	// Expand wildcard Accept media ranges, e.g. RIFF_ACCEPT_WILDCARDS="*/*=application/json,text/plain;text/*=text/plain"
+	if len(c.AcceptWildcards) > 0 {
+		options = append(options, proxy.WithAcceptWildcards(c.AcceptWildcards))
+	}
+
+	// Send request bodies to the input mapped to their media type,
+	// e.g. RIFF_INPUT_TYPES="application/json=json-in;application/xml=xml-in"
+	if len(c.InputTypes) > 0 {
+		options = append(options, proxy.WithInputTypes(c.InputTypes))
+	}
+
+	// Negotiate the charset of text outputs, defaulting to RIFF_DEFAULT_CHARSET (utf-8 if not set)
+	if c.NegotiateCharset {
+		options = append(options, proxy.WithCharsetNegotiation(c.DefaultCharset))
+	}
+
+	// Reject requests without an Accept header, rather than expecting application/octet-stream
+	if c.StrictAccept {
+		options = append(options, proxy.WithStrictAccept())
+	}
+
+	// Media type expected instead when the function cannot produce any accepted one,
+	// e.g. RIFF_FALLBACK_ACCEPT=application/json
+	if c.FallbackAccept != "" {
+		options = append(options, proxy.WithFallbackAccept(c.FallbackAccept))
+	}
+
+	// Content types advertised as accepted in answer to OPTIONS requests,
+	// e.g. RIFF_ACCEPTED_CONTENT_TYPES=application/json
+	if len(c.AcceptedContentTypes) > 0 {
+		options = append(options, proxy.WithAcceptedContentTypes(c.AcceptedContentTypes))
+	}
+
+	// Reject requests accepting none of the output content types upfront,
+	// e.g. RIFF_PRODUCED_CONTENT_TYPES=application/json
+	if len(c.ProducedContentTypes) > 0 {
+		options = append(options, proxy.WithProducedContentTypes(c.ProducedContentTypes))
+	}
+
+	// Methods clients may tunnel through POST with X-HTTP-Method-Override, e.g. RIFF_METHOD_OVERRIDE=PUT,PATCH,DELETE
+	if len(c.MethodOverride) > 0 {
+		options = append(options, proxy.WithMethodOverride(c.MethodOverride))
+	}
+
+	// Reject some request content types upfront, e.g. RIFF_REJECTED_CONTENT_TYPES=multipart/form-data,image/*
+	if len(c.RejectedContentTypes) > 0 {
+		options = append(options, proxy.WithRejectedContentTypes(c.RejectedContentTypes))
+	}
+
+	// Handle requests with several Content-Type headers, e.g. RIFF_DUPLICATE_CONTENT_TYPES=reject
+	if c.DuplicateContentTypes != "" {
+		options = append(options, proxy.WithDuplicateContentTypes(c.DuplicateContentTypes))
+	}
+
+	// Take the content type of requests not declaring any from a content-type query parameter
+	if c.ContentTypeParam {
+		options = append(options, proxy.WithContentTypeParam())
+	}
+
+	// Exchange whole http messages with the function
+	if c.RawHTTP {
+		options = append(options, proxy.WithRawHTTP())
+	}
+
+	// Check CloudEvents requests in binary content mode, making replies events too
+	if c.CloudEvents {
+		options = append(options, proxy.WithCloudEvents())
+	}
+
+	// Encode request bodies for backends that only handle text, e.g. RIFF_ENCODE_INPUT=base64
+	if c.EncodeInput != "" {
+		options = append(options, proxy.WithInputEncoding(c.EncodeInput))
+	}
+
+	// Send no data frame for request bodies made of whitespace only
+	if c.IgnoreBlankBodies {
+		options = append(options, proxy.WithBlankBodiesIgnored())
+	}
+
+	// Decode gzip, deflate or br compressed request bodies
+	if c.DecompressRequests {
+		options = append(options, proxy.WithRequestDecompression())
+	}
+
+	// Reject request bodies not matching their Content-MD5 or X-Riff-Checksum header
+	if c.VerifyChecksums {
+		options = append(options, proxy.WithChecksumVerification())
+	}
+
+	// Compress responses with br or gzip, as accepted by clients, e.g. RIFF_COMPRESS_MIN_BYTES=1024
+	if c.CompressResponses {
+		options = append(options, proxy.WithResponseCompression(c.CompressMinBytes))
+	}
+
+	// Send each line of application/x-ndjson request bodies as its own frame
+	if c.NDJSONInput {
+		options = append(options, proxy.WithNDJSONInput())
+	}
+
+	// Send each part of multipart/mixed request bodies as its own frame
+	if c.MultipartInput {
+		options = append(options, proxy.WithMultipartInput())
+	}
+
+	// Write output frames as newline delimited JSON to clients accepting application/x-ndjson, validating them when
+	// RIFF_NDJSON_OUTPUT=validate
+	if c.NDJSONOutput == "true" || c.NDJSONOutput == "validate" {
+		options = append(options, proxy.WithNDJSONOutput(c.NDJSONOutput == "validate"))
+	}
+
+	// Write output frames as server-sent events to clients accepting text/event-stream, with a keepalive comment
+	// when idle, e.g. RIFF_SSE_HEARTBEAT=15s
+	if c.SSEOutput {
+		options = append(options, proxy.WithSSEOutput())
+		if c.SSEHeartbeat > 0 {
+			options = append(options, proxy.WithSSEHeartbeat(c.SSEHeartbeat, c.SSEUntilData))
+		}
+		if c.SSEEventNames != "" {
+			options = append(options, proxy.WithSSEEventNames(c.SSEEventNames))
+		}
+	}
+
+	// Send request bodies above a size, or of unknown length, as several frames, e.g. RIFF_INPUT_CHUNK_THRESHOLD=65536
+	if c.InputChunkThreshold > 0 {
+		options = append(options, proxy.WithInputChunking(c.InputChunkThreshold))
+	}
+
+	// Send chunked request bodies as they arrive, coalescing small reads, e.g. RIFF_COALESCE_INPUT_WAIT=5ms
+	if c.CoalesceWait > 0 {
+		options = append(options, proxy.WithInputCoalescing(c.CoalesceBytes, c.CoalesceWait))
+	}
+
+	// Limit the size of request bodies, e.g. RIFF_MAX_INPUT_BYTES=1048576
+	if c.MaxInputBytes > 0 {
+		options = append(options, proxy.WithMaxInputBytes(c.MaxInputBytes))
+	}
+
+	// Limit the number of data frames requests are sent as, e.g. RIFF_MAX_INPUT_FRAMES=1000
+	if c.MaxInputFrames > 0 {
+		options = append(options, proxy.WithMaxInputFrames(c.MaxInputFrames))
+	}
+
+	// Accept GET requests waiting for the first output frame, e.g. RIFF_LONG_POLL_MAX_WAIT=30s
+	if c.LongPollMaxWait > 0 {
+		options = append(options, proxy.WithLongPolling(c.LongPollMaxWait))
+	}
+
+	// Give up on invocations lasting longer than that, telling the backend as well, e.g. RIFF_INVOCATION_TIMEOUT=30s
+	if c.InvocationTimeout > 0 {
+		options = append(options, proxy.WithInvocationTimeout(c.InvocationTimeout))
+	}
+
+	// Give up on invocations the backend doesn't accept in time, e.g. RIFF_CONNECT_TIMEOUT=2s
+	if c.ConnectTimeout > 0 {
+		options = append(options, proxy.WithConnectTimeout(c.ConnectTimeout))
+	}
+
+	// Expose prometheus metrics, e.g. RIFF_METRICS_PATH=/metrics
+	if c.MetricsPath != "" {
+		options = append(options, proxy.WithMetrics(c.MetricsPath))
+	}
+
+	// Tell how long responses took to start, in a X-Riff-Total-Duration header
+	if c.DurationHeaders {
+		options = append(options, proxy.WithDurationHeaders())
+	}
+
+	// Tell how long the phases of invocations took, in a Server-Timing header
+	if c.ServerTiming {
+		options = append(options, proxy.WithServerTiming())
+	}
+
+	// Render errors for browsers using an html template, e.g. RIFF_ERROR_TEMPLATE=/workspace/error.html
+	if c.ErrorTemplate != nil {
+		options = append(options, proxy.WithErrorTemplate(c.ErrorTemplate))
+	}
+
+	// Identify requests with the X-Request-Id header, reported in error responses and logs
+	if c.RequestIDs {
+		options = append(options, proxy.WithRequestIDs(log.New(os.Stderr, "", log.LstdFlags)))
+	}
+
+	// Tell the function when the adapter received each request, with the X-Riff-Received-At header
+	if c.ReceivedAt {
+		options = append(options, proxy.WithReceivedAtHeader())
+	}
+
+	// Forward the Host of requests to the function, e.g. RIFF_FORWARD_HOST=x-forwarded-host
+	if c.ForwardHost != "" {
+		options = append(options, proxy.WithHostForwarding(c.ForwardHost))
+	}
+
+	// Log a line per request on stdout, e.g. RIFF_ACCESS_LOG=combined
+	if c.AccessLog != "" {
+		options = append(options, proxy.WithAccessLog(log.New(os.Stdout, "", 0), c.AccessLog))
+	}
+
+	// Reject malformed JSON request bodies without invoking the function
+	if c.ValidateJSON {
+		options = append(options, proxy.WithJSONValidation())
+	}
+
+	// Default the content type of requests declaring none to application/json when their body looks like JSON
+	if c.SniffJSON {
+		options = append(options, proxy.WithJSONSniffing())
+	}
+
+	// Size the HTTP/2 flow control windows towards the backends, in bytes, e.g. RIFF_GRPC_STREAM_WINDOW=1048576
+	if c.GRPCStreamWindow > 0 || c.GRPCConnWindow > 0 {
+		options = append(options, proxy.WithFlowControlWindows(int32(c.GRPCStreamWindow), int32(c.GRPCConnWindow)))
+	}
+
+	// Compress the messages sent to backends with gzip
+	if c.GRPCCompress {
+		options = append(options, proxy.WithCompression())
+	}
+
+	// Proxy some paths to other backends, e.g. RIFF_ROUTES=/workspace/routes.yaml
+	if len(c.Routes) > 0 {
+		options = append(options, proxy.WithRoutes(c.Routes))
+	}
+
+	// Handle paths with a trailing slash, e.g. RIFF_TRAILING_SLASH=redirect
+	if c.TrailingSlash != "" {
+		options = append(options, proxy.WithTrailingSlash(c.TrailingSlash))
+	}
+
+	// Stick sessions identified by a header or a cookie to the same route backend
+	if c.SessionHeader != "" || c.SessionCookie != "" {
+		options = append(options, proxy.WithStickySessions(c.SessionHeader, c.SessionCookie))
+	}
+
+	// Expose a readiness probe, e.g. RIFF_READINESS_PATH=/ready
+	if c.ReadinessPath != "" {
+		options = append(options, proxy.WithReadiness(c.ReadinessPath))
+	}
+
+	// Enable the admin endpoints, protected by a bearer token
+	if c.AdminToken != "" {
+		options = append(options, proxy.WithAdmin(c.AdminToken))
+	}
+
+	// Log a preview of the first RIFF_BODY_PREVIEW_BYTES (default 256) of request bodies, list the headers forwarded
+	// to the function in responses and, along with the admin endpoints, replay saved requests on /debug/simulate
+	if c.Debug {
+		options = append(options, proxy.WithBodyPreview(log.New(os.Stderr, "", log.LstdFlags), c.BodyPreviewBytes))
+		options = append(options, proxy.WithForwardedHeadersEcho())
+		options = append(options, proxy.WithRequestSimulation())
+	}
+
+	// Keep the invoker warm between sparse requests, e.g. RIFF_WARMUP_INTERVAL=1m
+	if c.WarmupInterval > 0 {
+		options = append(options, proxy.WithWarmup(c.WarmupInterval))
+	}
+
+	// Close route backend connections idle or unhealthy for that long, e.g. RIFF_REAP_IDLE_CONNECTIONS=10m
+	if c.ReapIdleConns > 0 {
+		options = append(options, proxy.WithConnectionReaper(c.ReapIdleConns))
+	}
+
+	return options
+}
+
+// ReloadOptions returns the proxy options setting what may change while serving, see proxy.Reload. Unlike Options,
+// it includes the options of disabled features, so that reloading disables them.
+func (c *Config) ReloadOptions() []proxy.Option {
+	return []proxy.Option{
+		proxy.WithMaxInputBytes(c.MaxInputBytes),
+		proxy.WithMaxOutputBytes(c.MaxOutputBytes),
+		proxy.WithMaxInputFrames(c.MaxInputFrames),
+		proxy.WithLongPolling(c.LongPollMaxWait),
+		proxy.WithInvocationTimeout(c.InvocationTimeout),
+		proxy.WithMethodOverride(c.MethodOverride),
+		proxy.WithRejectedContentTypes(c.RejectedContentTypes),
+		proxy.WithAcceptedContentTypes(c.AcceptedContentTypes),
+		proxy.WithRoutes(c.Routes),
+	}
+}
+
+// reloadable are the Config fields set by ReloadOptions.
+var reloadable = map[string]bool{
+	"MaxInputBytes":        true,
+	"MaxOutputBytes":       true,
+	"MaxInputFrames":       true,
+	"LongPollMaxWait":      true,
+	"InvocationTimeout":    true,
+	"MethodOverride":       true,
+	"RejectedContentTypes": true,
+	"AcceptedContentTypes": true,
+	"Routes":               true,
+}
+
+// restartRequired lists the fields, other than the reloadable ones, that differ in the other Config.
+func (c *Config) restartRequired(other *Config) []string {
+	var fields []string
+	current, next := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if name == "ErrorTemplate" {
+			// parsed anew on each load, the template can't be compared
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// reloader is the part of the proxy serving requests that may be reloaded.
+type reloader interface {
+	Reload(options ...proxy.Option) error
+}
+
+// reloadOnHangup reloads the configuration each time the adapter receives a SIGHUP, applying the settings that may
+// change while serving to the target. Changes to other settings are only applied on restart, with a warning, while
+// an invalid configuration is ignored altogether. The returned function stops reloading.
+func reloadOnHangup(getenv func(string) string, config *Config, target reloader) (stop func()) {
+	hangup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hangup:
+			case <-done:
+				return
+			}
+			next, err := loadConfig(getenv)
+			if err != nil {
+				log.Printf("Configuration not reloaded, it is invalid:\n%v", err)
+				continue
+			}
+			if err := target.Reload(next.ReloadOptions()...); err != nil {
+				log.Printf("Configuration not reloaded: %v", err)
+				continue
+			}
+			for _, field := range config.restartRequired(next) {
+				log.Printf("Warning: %s changed, restart the adapter to apply it", field)
+			}
+			log.Printf("Configuration reloaded")
+		}
+	}()
+	return func() {
+		signal.Stop(hangup)
+		close(done)
+	}
+}
+
+// envReader parses environment variables, collecting the problems found instead of stopping at the first one.
+// Variables that are not set, set to zero, or that fail to parse, get the zero (or given default) value.
+type envReader struct {
+	getenv   func(string) string
+	problems configErrors
+	// read records the variables looked up, to tell unknown settings in config files
+	read map[string]bool
+}
+
+// readConfigFile reads settings from a YAML (or JSON) file mapping environment variable names to their value.
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]string
+	if err := yaml.UnmarshalStrict(content, &settings); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func (r *envReader) string(name string) string {
+	r.read[name] = true
+	return r.getenv(name)
+}
+
+func (r *envReader) fail(name string, err interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf("%s: %v", name, err))
+}
+
+func (r *envReader) stringOr(name string, fallback string) string {
+	if value := r.string(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (r *envReader) duration(name string) time.Duration {
+	return r.durationOr(name, 0)
+}
+
+func (r *envReader) durationOr(name string, fallback time.Duration) time.Duration {
+	value := r.string(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		r.fail(name, err)
+	} else if d == 0 {
+		return fallback
+	}
+	return d
+}
+
+func (r *envReader) bool(name string) bool {
+	value := r.string(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.fail(name, err)
+	}
+	return b
+}
+
+func (r *envReader) float(name string) float64 {
+	value := r.string(name)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		r.fail(name, err)
+	}
+	return f
+}
+
+func (r *envReader) int(name string) int {
+	return r.intOr(name, 0)
+}
+
+func (r *envReader) intOr(name string, fallback int) int {
+	value := r.string(name)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		r.fail(name, err)
+	} else if i == 0 {
+		return fallback
+	}
+	return i
+}
+
+// list parses a comma separated list, ignoring blank entries.
+func (r *envReader) list(name string) []string {
+	var list []string
+	for _, value := range strings.Split(r.string(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// cidrs parses a comma separated list of CIDR blocks, single addresses being accepted as well.
+func (r *envReader) cidrs(name string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range r.list(name) {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			r.fail(name, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// wildcards parses media ranges mapped to lists of types, e.g. "*/*=application/json,text/plain;text/*=text/plain".
+func (r *envReader) wildcards(name string) map[string][]string {
+	value := r.string(name)
+	if value == "" {
+		return nil
+	}
+	mapping := make(map[string][]string)
+	for _, entry := range strings.Split(value, ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			r.fail(name, fmt.Sprintf("invalid entry %q", entry))
+			continue
+		}
+		var types []string
+		for _, t := range strings.Split(parts[1], ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+		mapping[strings.ToLower(strings.TrimSpace(parts[0]))] = types
+	}
+	return mapping
+}
+
+// mapping parses media types mapped to names, e.g. "application/json=json-in;application/xml=xml-in".
+func (r *envReader) mapping(name string) map[string]string {
+	value := r.string(name)
+	if value == "" {
+		return nil
+	}
+	mapping := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			r.fail(name, fmt.Sprintf("invalid entry %q", entry))
+			continue
+		}
+		mapping[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return mapping
+}
+
+// template parses the html template at the path held by the variable.
+func (r *envReader) template(name string) *template.Template {
+	path := r.string(name)
+	if path == "" {
+		return nil
+	}
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		r.fail(name, err)
+	}
+	return t
+}
+
+// routes loads the routes file at the path held by the variable.
+func (r *envReader) routes(name string) []proxy.Route {
+	path := r.string(name)
+	if path == "" {
+		return nil
+	}
+	routes, err := proxy.LoadRoutes(path)
+	if err != nil {
+		r.fail(name, err)
+	}
+	return routes
+}
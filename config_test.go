@@ -0,0 +1,390 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// environment returns a getenv looking variables up in the given map.
+func environment(variables map[string]string) func(string) string {
+	return func(name string) string {
+		return variables[name]
+	}
+}
+
+func Test_loadConfig_defaults(t *testing.T) {
+	config, err := loadConfig(environment(nil))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "8081", config.GRPCPort)
+		assert.Equal(t, "8080", config.HTTPPort)
+		assert.Equal(t, 30*time.Second, config.BreakerCooldown)
+		assert.Equal(t, 256, config.BodyPreviewBytes)
+		assert.Equal(t, 100*time.Millisecond, config.ReorderWait)
+		assert.Empty(t, config.Options())
+	}
+}
+
+func Test_loadConfig_valid(t *testing.T) {
+	config, err := loadConfig(environment(map[string]string{
+		"RIFF_STREAMING":          "true",
+		"RIFF_ASYNC":              "true",
+		"RIFF_ASYNC_STATUS":       "204",
+		"RIFF_BREAKER_THRESHOLD":  "5",
+		"RIFF_METRICS_PATH":       "/metrics",
+		"RIFF_READINESS_PATH":     "/ready",
+		"RIFF_GRPC_STREAM_WINDOW": "1048576",
+		"RIFF_INPUT_TYPES":        "application/json=json-in",
+	}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, config.AsyncStatus)
+		assert.Equal(t, map[string]string{"application/json": "json-in"}, config.InputTypes)
+		assert.Len(t, config.Options(), 7)
+	}
+}
+
+func Test_loadConfig_parse_errors(t *testing.T) {
+	_, err := loadConfig(environment(map[string]string{
+		"RIFF_REPLAY_WINDOW":    "soon",
+		"RIFF_STREAMING":        "maybe",
+		"RIFF_RATE_LIMIT":       "fast",
+		"RIFF_TRUSTED_PROXIES":  "10.0.0.0/99",
+		"RIFF_ACCEPT_WILDCARDS": "*/*",
+		"RIFF_ROUTES":           "/does/not/exist.yaml",
+	}))
+
+	if assert.IsType(t, configErrors{}, err) {
+		problems := err.(configErrors)
+		assert.Len(t, problems, 6)
+		assert.Contains(t, problems[0], "RIFF_REPLAY_WINDOW: ")
+		assert.Contains(t, problems[1], "RIFF_RATE_LIMIT: ")
+		assert.Contains(t, problems[2], "RIFF_TRUSTED_PROXIES: ")
+		assert.Contains(t, problems[3], "RIFF_STREAMING: ")
+		assert.Equal(t, `RIFF_ACCEPT_WILDCARDS: invalid entry "*/*"`, problems[4])
+		assert.Contains(t, problems[5], "RIFF_ROUTES: ")
+	}
+}
+
+func Test_loadConfig_parse_and_validation_errors(t *testing.T) {
+	_, err := loadConfig(environment(map[string]string{
+		"PORT":                 "http",
+		"RIFF_MAX_INPUT_BYTES": "lots",
+		"RIFF_NDJSON_OUTPUT":   "always",
+	}))
+
+	assert.Equal(t, configErrors{
+		`RIFF_MAX_INPUT_BYTES: strconv.Atoi: parsing "lots": invalid syntax`,
+		`PORT: invalid port "http"`,
+		`RIFF_NDJSON_OUTPUT: invalid value "always", must be true, false or validate`,
+	}, err)
+}
+
+func Test_Validate_aggregates_problems(t *testing.T) {
+	config := &Config{
+		GRPCPort:             "8080",
+		HTTPPort:             "8080",
+		ReplayWindow:         -time.Minute,
+		MaxOutputBytes:       -1,
+		ErrorCacheTTL:        time.Second,
+		Async:                true,
+		AsyncStatus:          201,
+		RejectUpgrades:       true,
+		UpgradeStatus:        400,
+		EncodeInput:          "hex",
+		GRPCConnWindow:       1024,
+		InputTypes:           map[string]string{"application/json": ""},
+		ProducedContentTypes: []string{"application/json", "json"},
+		MetricsPath:          "/status",
+		ReadinessPath:        "/status",
+		BodyPreviewBytes:     256,
+	}
+
+	assert.Equal(t, configErrors{
+		`PORT: 8080 is already used by GRPC_PORT`,
+		`RIFF_REPLAY_WINDOW: -1m0s is negative`,
+		`RIFF_MAX_OUTPUT_BYTES: -1 is negative`,
+		`RIFF_ERROR_CACHE_TTL: 1s is over 500ms`,
+		`RIFF_ASYNC_STATUS: unsupported status 201, must be 200, 202 or 204`,
+		`RIFF_UPGRADE_STATUS: unsupported status 400, must be 426 or 501`,
+		`RIFF_ENCODE_INPUT: unsupported encoding "hex"`,
+		`RIFF_GRPC_CONN_WINDOW: 1024 is out of range, must be at least 65535 bytes`,
+		`RIFF_INPUT_TYPES: application/json is mapped to an empty input name`,
+		`RIFF_PRODUCED_CONTENT_TYPES: invalid media type "json"`,
+		`RIFF_READINESS_PATH: "/status" is already used by RIFF_METRICS_PATH`,
+	}, config.Validate())
+}
+
+func Test_Validate_paths(t *testing.T) {
+	config := &Config{
+		GRPCPort:      "8081",
+		HTTPPort:      "8080",
+		MetricsPath:   "metrics",
+		ReadinessPath: "/admin/drain",
+		AdminToken:    "secret",
+	}
+
+	assert.Equal(t, configErrors{
+		`RIFF_METRICS_PATH: "metrics" must start with / and not be /`,
+		`RIFF_READINESS_PATH: "/admin/drain" is already used by the admin endpoints`,
+	}, config.Validate())
+}
+
+func Test_Validate_ports(t *testing.T) {
+	config := &Config{GRPCPort: "0", HTTPPort: "65536"}
+
+	assert.Equal(t, configErrors{
+		`GRPC_PORT: invalid port "0"`,
+		`PORT: invalid port "65536"`,
+	}, config.Validate())
+}
+
+func Test_configErrors_Error(t *testing.T) {
+	err := configErrors{"PORT: invalid port \"http\"", "RIFF_RATE_LIMIT: -1 is negative"}
+
+	assert.Equal(t, "PORT: invalid port \"http\"\nRIFF_RATE_LIMIT: -1 is negative", err.Error())
+}
+
+// configFile writes the given content to a temporary config file, returning its path.
+func configFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func Test_loadConfig_file_only(t *testing.T) {
+	path := configFile(t, `
+PORT: 9090
+RIFF_STREAMING: true
+RIFF_METRICS_PATH: /metrics
+RIFF_BREAKER_COOLDOWN: 1m
+`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(environment(map[string]string{"RIFF_CONFIG_FILE": path}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "9090", config.HTTPPort)
+		assert.Equal(t, "8081", config.GRPCPort)
+		assert.True(t, config.Streaming)
+		assert.Equal(t, "/metrics", config.MetricsPath)
+		assert.Equal(t, time.Minute, config.BreakerCooldown)
+	}
+}
+
+func Test_loadConfig_json_file(t *testing.T) {
+	path := configFile(t, `{"RIFF_RATE_LIMIT": "2.5", "RIFF_RATE_BURST": 10}`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(environment(map[string]string{"RIFF_CONFIG_FILE": path}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2.5, config.RateLimit)
+		assert.Equal(t, 10, config.RateBurst)
+	}
+}
+
+func Test_loadConfig_env_only(t *testing.T) {
+	config, err := loadConfig(environment(map[string]string{"PORT": "9090", "RIFF_STREAMING": "true"}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "9090", config.HTTPPort)
+		assert.True(t, config.Streaming)
+	}
+}
+
+func Test_loadConfig_env_overrides_file(t *testing.T) {
+	path := configFile(t, `
+PORT: 9090
+RIFF_METRICS_PATH: /metrics
+RIFF_MAX_INPUT_BYTES: 1024
+`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(environment(map[string]string{
+		"RIFF_CONFIG_FILE":     path,
+		"RIFF_METRICS_PATH":    "/prometheus",
+		"RIFF_MAX_INPUT_BYTES": "2048",
+	}))
+
+	if assert.NoError(t, err) {
+		assert.Equal(t, "9090", config.HTTPPort)
+		assert.Equal(t, "/prometheus", config.MetricsPath)
+		assert.Equal(t, int64(2048), config.MaxInputBytes)
+	}
+}
+
+func Test_loadConfig_file_problems(t *testing.T) {
+	path := configFile(t, `
+RIFF_STREAMIN: true
+RIFF_MAX_INPUT_BYTES: lots
+PORT: 8081
+`)
+	defer os.Remove(path)
+
+	_, err := loadConfig(environment(map[string]string{"RIFF_CONFIG_FILE": path}))
+
+	assert.Equal(t, configErrors{
+		`RIFF_MAX_INPUT_BYTES: strconv.Atoi: parsing "lots": invalid syntax`,
+		`RIFF_CONFIG_FILE: unknown setting RIFF_STREAMIN`,
+		`PORT: 8081 is already used by GRPC_PORT`,
+	}, err)
+}
+
+func Test_loadConfig_invalid_file(t *testing.T) {
+	path := configFile(t, `RIFF_METHOD_OVERRIDE: [PUT, PATCH]`)
+	defer os.Remove(path)
+
+	_, err := loadConfig(environment(map[string]string{"RIFF_CONFIG_FILE": path}))
+	assert.Error(t, err)
+
+	_, err = loadConfig(environment(map[string]string{"RIFF_CONFIG_FILE": path + ".missing"}))
+	assert.Error(t, err)
+}
+
+func Test_ReloadOptions_disable_features(t *testing.T) {
+	assert.Len(t, (&Config{}).ReloadOptions(), 9)
+}
+
+func Test_restartRequired(t *testing.T) {
+	config := &Config{HTTPPort: "8080", Streaming: true, MaxInputBytes: 1024}
+
+	assert.Empty(t, config.restartRequired(&Config{HTTPPort: "8080", Streaming: true, MaxInputBytes: 2048}))
+	assert.Equal(t, []string{"HTTPPort", "Streaming"}, config.restartRequired(&Config{HTTPPort: "9090"}))
+}
+
+func Test_restartRequired_connect_timeout(t *testing.T) {
+	config := &Config{ConnectTimeout: time.Second}
+
+	assert.Equal(t, []string{"ConnectTimeout"}, config.restartRequired(&Config{ConnectTimeout: 2 * time.Second}))
+}
+
+// echoServer answers invocations with the payload of their first data frame.
+type echoServer struct{}
+
+func (echoServer) Invoke(stream rpc.Riff_InvokeServer) error {
+	var payload []byte
+	for {
+		signal, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if data := signal.GetData(); data != nil && payload == nil {
+			payload = data.Payload
+		}
+	}
+	return stream.Send(&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: &rpc.OutputFrame{
+		Payload:     payload,
+		ContentType: "text/plain",
+	}}})
+}
+
+// freePort returns a port nothing listens on, at the time of the call.
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func Test_reload_on_hangup(t *testing.T) {
+	grpcListener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterRiffServer(grpcServer, echoServer{})
+	go grpcServer.Serve(grpcListener)
+	defer grpcServer.Stop()
+
+	path := configFile(t, "RIFF_MAX_INPUT_BYTES: 4\n")
+	defer os.Remove(path)
+	getenv := environment(map[string]string{
+		"RIFF_CONFIG_FILE": path,
+		"GRPC_PORT":        strconv.Itoa(grpcListener.Addr().(*net.TCPAddr).Port),
+		"PORT":             freePort(t),
+	})
+	config, err := loadConfig(getenv)
+	if !assert.NoError(t, err) {
+		return
+	}
+	adapter, err := proxy.NewProxy(":"+config.GRPCPort, "localhost:"+config.HTTPPort, config.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go adapter.Run()
+	defer adapter.Shutdown(context.Background())
+	stop := reloadOnHangup(getenv, config, adapter)
+	defer stop()
+
+	post := func() (int, string) {
+		response, err := http.Post("http://localhost:"+config.HTTPPort, "text/plain", strings.NewReader("some body"))
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+	eventually := func(status int) (int, string) {
+		code, body := post()
+		for deadline := time.Now().Add(5 * time.Second); code != status && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			code, body = post()
+		}
+		return code, body
+	}
+
+	code, _ := eventually(http.StatusRequestEntityTooLarge)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	if err := ioutil.WriteFile(path, []byte("RIFF_MAX_INPUT_BYTES: 1024\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := eventually(http.StatusOK)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "some body", body)
+}
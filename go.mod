@@ -3,7 +3,10 @@ module github.com/projectriff/streaming-http-adapter
 go 1.12
 
 require (
+	github.com/andybalholm/brotli v1.0.0
 	github.com/golang/protobuf v1.3.4
+	github.com/prometheus/client_golang v1.5.1
 	github.com/stretchr/testify v1.5.1
 	google.golang.org/grpc v1.27.1
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -29,23 +29,21 @@ import (
 )
 
 func main() {
-	// Lookup the gRPC address where our child process expects to run.
-	grpcPort := os.Getenv("GRPC_PORT")
-	if grpcPort == "" {
-		grpcPort = "8081"
-	}
-
-	// Per the http-invoker contract, listen for http traffic on a port defined by PORT
-	httpPort := os.Getenv("PORT")
-	if httpPort == "" {
-		httpPort = "8080"
-	}
 	if len(os.Args) < 2 {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s invoker-command [invoker-args]...\n", os.Args[0])
 		os.Exit(1)
 	}
 
-	proxy, err := proxy.NewProxy(fmt.Sprintf(":%s", grpcPort), fmt.Sprintf(":%s", httpPort))
+	// Per the http-invoker contract, listen for http traffic on a port defined by PORT, and expect our child
+	// process to listen for gRPC on GRPC_PORT
+	config, err := loadConfig(os.Getenv)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	grpcAddress, httpAddress := fmt.Sprintf(":%s", config.GRPCPort), fmt.Sprintf(":%s", config.HTTPPort)
+	proxy, err := proxy.NewProxy(grpcAddress, httpAddress, config.Options()...)
 	if err != nil {
 		panic(err)
 	}
@@ -54,14 +52,15 @@ func main() {
 			log.Fatalf("error running proxy %v", err)
 		}
 	}()
+	stopReloading := reloadOnHangup(os.Getenv, config, proxy)
 
 	command := exec.Command(os.Args[1], os.Args[2:]...)
 	command.Stdout = os.Stdout
 	command.Stdin = os.Stdin
 	command.Stderr = os.Stderr
-	// The following makes sure that our child process sees the GRPC_PORT variable too.
-	// It should not care about the PORT variable
-	command.Env = os.Environ()
+	// The following makes sure that our child process sees the GRPC_PORT variable too, even when set in the
+	// config file. It should not care about the PORT variable
+	command.Env = append(os.Environ(), fmt.Sprintf("GRPC_PORT=%s", config.GRPCPort))
 
 	done := make(chan error, 2)
 
@@ -73,6 +72,7 @@ func main() {
 			fmt.Printf("Child process exited with %v\n", err)
 		}
 		done <- err
+		stopReloading()
 		if err = proxy.Shutdown(context.Background()); err != nil {
 			log.Fatalf("error shuting down proxy server %v", err)
 		}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithStrictAccept rejects requests without an Accept header with a 400, rather than expecting
+// application/octet-stream from the function, for APIs requiring clients to negotiate explicitly.
+func WithStrictAccept() Option {
+	return func(p *proxy) {
+		p.strictAccept = true
+	}
+}
+
+// acceptOverrideHeader lets clients not in control of their Accept header, such as browsers, tell the media types they
+// want instead.
+const acceptOverrideHeader = "X-Riff-Accept"
+
+// requestedAccept returns the media ranges the client wants, as told by its X-Riff-Accept header when set, by its
+// Accept header otherwise.
+func requestedAccept(request *http.Request) string {
+	if accept := request.Header.Get(acceptOverrideHeader); strings.TrimSpace(accept) != "" {
+		return accept
+	}
+	return request.Header.Get("accept")
+}
+
+func (p *proxy) requireAccept(next http.Handler) http.Handler {
+	if !p.strictAccept {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodOptions && strings.TrimSpace(requestedAccept(request)) == "" {
+			p.writeError(writer, request, httpErrorf(http.StatusBadRequest, "missing Accept header"))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// WithProducedContentTypes declares the media types the function may output, so that requests whose Accept header
+// matches none of them are rejected with a 406, without invoking the function. Requests without an Accept header
+// are forwarded, as are all requests when a fallback Accept is set, the function producing that type anyway.
+func WithProducedContentTypes(mediaTypes []string) Option {
+	return func(p *proxy) {
+		p.producedContentTypes = nil
+		for _, t := range mediaTypes {
+			if mediaType, _, err := mime.ParseMediaType(t); err == nil {
+				p.producedContentTypes = append(p.producedContentTypes, mediaType)
+			}
+		}
+	}
+}
+
+func (p *proxy) rejectUnacceptable(next http.Handler) http.Handler {
+	if len(p.producedContentTypes) == 0 || p.fallbackAccept != "" {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		accept := requestedAccept(request)
+		if request.Method != http.MethodOptions && strings.TrimSpace(accept) != "" &&
+			!acceptsAny(accept, p.producedContentTypes) {
+			p.writeError(writer, request, httpErrorf(http.StatusNotAcceptable, "none of %s is acceptable",
+				strings.Join(p.producedContentTypes, ", ")))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// acceptsAny tells whether a media range of an Accept header, with a non zero quality value, matches one of the
+// given media types.
+func acceptsAny(accept string, mediaTypes []string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		acceptedType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		for _, mediaType := range mediaTypes {
+			if acceptedType == "*/*" || matchesMediaType(mediaType, acceptedType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithAcceptWildcards replaces wildcard media ranges found in the Accept header (such as */* or text/*) by the given
+// list of concrete types, for invokers that can't negotiate wildcards.
+func WithAcceptWildcards(mapping map[string][]string) Option {
+	return func(p *proxy) {
+		p.acceptWildcards = mapping
+	}
+}
+
+// expandAcceptWildcards rewrites an Accept header, substituting the mapped media ranges while keeping their
+// parameters (such as quality values).
+func expandAcceptWildcards(accept string, mapping map[string][]string) string {
+	if len(mapping) == 0 {
+		return accept
+	}
+	var expanded []string
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaRange = strings.TrimSpace(mediaRange)
+		mediaType, params := mediaRange, ""
+		if i := strings.Index(mediaRange, ";"); i >= 0 {
+			mediaType, params = strings.TrimSpace(mediaRange[:i]), mediaRange[i:]
+		}
+		if types, ok := mapping[strings.ToLower(mediaType)]; ok {
+			for _, t := range types {
+				expanded = append(expanded, t+params)
+			}
+		} else {
+			expanded = append(expanded, mediaRange)
+		}
+	}
+	return strings.Join(expanded, ", ")
+}
+
+// WithCharsetNegotiation adds the charset preferred by the client, according to its Accept-Charset header, as a
+// parameter of the text media ranges expected from the function. The given default charset applies to clients not
+// telling their preference.
+func WithCharsetNegotiation(defaultCharset string) Option {
+	return func(p *proxy) {
+		p.defaultCharset = strings.ToLower(defaultCharset)
+	}
+}
+
+// preferredCharset picks the charset with the highest quality value in an Accept-Charset header, the first one
+// winning ties. The default charset stands for the * wildcard, and is used when no charset is acceptable.
+func preferredCharset(acceptCharset string, defaultCharset string) string {
+	preferred, best := defaultCharset, 0.0
+	for _, entry := range strings.Split(acceptCharset, ",") {
+		parts := strings.Split(entry, ";")
+		charset, q := strings.ToLower(strings.TrimSpace(parts[0])), quality(parts[1:])
+		if charset == "" {
+			continue
+		} else if charset == "*" {
+			charset = defaultCharset
+		}
+		if q > best {
+			preferred, best = charset, q
+		}
+	}
+	return preferred
+}
+
+// quality returns the q parameter among the parameters of an Accept-* header entry, 1 by default.
+func quality(params []string) float64 {
+	q := 1.0
+	for _, param := range params {
+		if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+			if value, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				q = value
+			}
+		}
+	}
+	return q
+}
+
+// addCharset sets the charset parameter of the text media ranges of an Accept header not having one already.
+func addCharset(accept string, charset string) string {
+	mediaRanges := strings.Split(accept, ",")
+	for i, mediaRange := range mediaRanges {
+		mediaRange = strings.TrimSpace(mediaRange)
+		mediaType, params := mediaRange, ""
+		if j := strings.Index(mediaRange, ";"); j >= 0 {
+			mediaType, params = strings.TrimSpace(mediaRange[:j]), mediaRange[j:]
+		}
+		if strings.HasPrefix(strings.ToLower(mediaType), "text/") && !strings.Contains(strings.ToLower(params), "charset=") {
+			mediaRange = mediaType + "; charset=" + charset + params
+		}
+		mediaRanges[i] = mediaRange
+	}
+	return strings.Join(mediaRanges, ", ")
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var wildcards = map[string][]string{
+	"*/*":    {"application/json", "text/plain"},
+	"text/*": {"text/plain"},
+}
+
+func Test_expandAcceptWildcards(t *testing.T) {
+	assert.Equal(t, "application/json, text/plain", expandAcceptWildcards("*/*", wildcards))
+	assert.Equal(t, "text/csv, text/plain;q=0.5", expandAcceptWildcards("text/csv, text/*;q=0.5", wildcards))
+	assert.Equal(t, "application/xml", expandAcceptWildcards("application/xml", wildcards))
+	assert.Equal(t, "*/*", expandAcceptWildcards("*/*", nil))
+}
+
+func Test_invokeGrpc_accept_wildcard(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithAcceptWildcards(wildcards)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "*/*")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/json, text/plain"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_invokeGrpc_accept_concrete(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithAcceptWildcards(wildcards)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "application/xml")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/xml"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_preferredCharset(t *testing.T) {
+	assert.Equal(t, "utf-8", preferredCharset("", "utf-8"))
+	assert.Equal(t, "iso-8859-1", preferredCharset("ISO-8859-1", "utf-8"))
+	assert.Equal(t, "utf-16", preferredCharset("iso-8859-1;q=0.5, utf-16", "utf-8"))
+	assert.Equal(t, "iso-8859-1", preferredCharset("iso-8859-1, utf-16", "utf-8"))
+	assert.Equal(t, "utf-8", preferredCharset("*, iso-8859-1;q=0.5", "utf-8"))
+	assert.Equal(t, "utf-8", preferredCharset("iso-8859-1;q=0", "utf-8"))
+}
+
+func Test_addCharset(t *testing.T) {
+	assert.Equal(t, "text/plain; charset=utf-8", addCharset("text/plain", "utf-8"))
+	assert.Equal(t, "text/csv; charset=utf-8;q=0.5, application/json",
+		addCharset("text/csv;q=0.5, application/json", "utf-8"))
+	assert.Equal(t, "text/plain;charset=iso-8859-1", addCharset("text/plain;charset=iso-8859-1", "utf-8"))
+}
+
+func Test_invokeGrpc_accept_charset(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithCharsetNegotiation("utf-8")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "text/plain")
+	request.Header.Add("accept-charset", "utf-8;q=0.7, iso-8859-1")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"text/plain; charset=iso-8859-1"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_invokeGrpc_accept_charset_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithCharsetNegotiation("utf-8")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "text/plain")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"text/plain; charset=utf-8"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_invokeGrpc_accept_charset_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "text/plain")
+	request.Header.Add("accept-charset", "iso-8859-1")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"text/plain"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_strict_accept_rejects_missing_header(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithStrictAccept()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, "missing Accept header\n", responseRecorder.Body.String())
+	riffClient.AssertNotCalled(t, "Invoke")
+}
+
+func Test_strict_accept_explicit_header(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithStrictAccept()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "text/plain")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, []string{"text/plain"}, inputSignals(invokeClient.Calls)[0].GetStart().ExpectedContentTypes)
+}
+
+func Test_strict_accept_options(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithStrictAccept()(p)
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+}
+
+func Test_lenient_accept_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("some response", "application/octet-stream")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/octet-stream"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_produced_content_types_matchable(t *testing.T) {
+	accepts := []string{"application/json", "text/html, application/*;q=0.5", "*/*", "application/json; charset=utf-8"}
+	for _, accept := range accepts {
+		riffClient, _ := mockRiffClientWithResponse("{}", "application/json")
+		p := &proxy{riffClient: riffClient}
+		WithProducedContentTypes([]string{"application/json", "text/csv"})(p)
+
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		request.Header.Set("Accept", accept)
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusOK, responseRecorder.Code, accept)
+	}
+}
+
+func Test_produced_content_types_unmatchable(t *testing.T) {
+	for _, accept := range []string{"text/html", "image/*", "application/json;q=0, text/html"} {
+		riffClient, _ := mockRiffClient()
+		p := &proxy{riffClient: riffClient}
+		WithProducedContentTypes([]string{"Application/JSON", "text/csv"})(p)
+
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		request.Header.Set("Accept", accept)
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusNotAcceptable, responseRecorder.Code, accept)
+		assert.Contains(t, responseRecorder.Body.String(), "none of application/json, text/csv is acceptable", accept)
+		riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+	}
+}
+
+func Test_produced_content_types_no_accept(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("{}", "application/json")
+	p := &proxy{riffClient: riffClient}
+	WithProducedContentTypes([]string{"application/json"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
+
+func Test_produced_content_types_with_fallback(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("{}", "application/json")
+	p := &proxy{riffClient: riffClient}
+	WithProducedContentTypes([]string{"application/json"})(p)
+	WithFallbackAccept("application/json")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "text/html")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
+
+func Test_invokeGrpc_accept_override(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	request.Header.Add(acceptOverrideHeader, "text/csv")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"text/csv"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_produced_content_types_accept_override(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("a,b", "text/csv")
+	p := &proxy{riffClient: riffClient}
+	WithProducedContentTypes([]string{"text/csv"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "text/html")
+	request.Header.Set(acceptOverrideHeader, "text/csv")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
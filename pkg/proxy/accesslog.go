@@ -0,0 +1,113 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines logged for each request.
+type AccessLogFormat string
+
+const (
+	// AccessLogCommon is the Common Log Format of web servers, telling who requested what, when, and the status and
+	// size of the response
+	AccessLogCommon AccessLogFormat = "common"
+	// AccessLogCombined is the Common Log Format followed by the Referer and User-Agent request headers
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// accessLogTime is the layout of the time a request was received at, in access logs.
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// WithAccessLog logs a line for each request to the function once served, in the given format, for ingestion by
+// tools expecting the logs of a web server. The client address honors the configured client IP header.
+func WithAccessLog(logger *log.Logger, format AccessLogFormat) Option {
+	return func(p *proxy) {
+		p.accessLogger = logger
+		p.accessLogFormat = format
+	}
+}
+
+func (p *proxy) logAccess(next http.Handler) http.Handler {
+	if p.accessLogger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received := time.Now()
+		response := &responseRecorder{ResponseWriter: writer}
+		next.ServeHTTP(response, request)
+		p.accessLogger.Print(p.accessLogLine(request, received, response.status, response.written))
+	})
+}
+
+// accessLogLine formats the access log line of a request.
+func (p *proxy) accessLogLine(request *http.Request, received time.Time, status int, written int64) string {
+	user, _, _ := request.BasicAuth()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	size := "-"
+	if written > 0 {
+		size = strconv.FormatInt(written, 10)
+	}
+	target := request.RequestURI
+	if target == "" {
+		target = request.URL.RequestURI()
+	}
+	line := fmt.Sprintf(`%s - %s [%s] %s %d %s`, p.clientIP(request), accessLogField(user),
+		received.Format(accessLogTime), quoteAccessLogField(request.Method+" "+target+" "+request.Proto), status, size)
+	if p.accessLogFormat == AccessLogCombined {
+		line += " " + quoteAccessLogField(request.Referer()) + " " + quoteAccessLogField(request.UserAgent())
+	}
+	return line
+}
+
+// accessLogField returns a value as logged unquoted, - standing for empty values.
+func accessLogField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.NewReplacer(" ", "_", "\n", "_").Replace(value)
+}
+
+// quoteAccessLogField returns a value as logged between double quotes, escaped the way web servers do.
+func quoteAccessLogField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&quoted, `\x%02x`, c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
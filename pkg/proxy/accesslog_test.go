@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_access_log_combined(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	var logs bytes.Buffer
+	WithAccessLog(log.New(&logs, "", 0), AccessLogCombined)(p)
+
+	request := httptest.NewRequest("POST", "/?name=riff", strings.NewReader("some body"))
+	request.RemoteAddr = "192.0.2.1:51234"
+	request.SetBasicAuth("frank", "secret")
+	request.Header.Set("Referer", "http://example.com/form")
+	request.Header.Set("User-Agent", `curl/7.64.1 "quoted"`)
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Regexp(t, regexp.MustCompile(
+		`^192\.0\.2\.1 - frank \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] `+
+			`"POST /\?name=riff HTTP/1\.1" 200 13 "http://example\.com/form" "curl/7\.64\.1 \\"quoted\\""\n$`,
+	), logs.String())
+}
+
+func Test_access_log_common(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	var logs bytes.Buffer
+	WithAccessLog(log.New(&logs, "", 0), AccessLogCommon)(p)
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "192.0.2.1:51234"
+	request.Header.Set("User-Agent", "curl/7.64.1")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.1 - - \[[^]]+\] "GET / HTTP/1\.1" 501 -\n$`), logs.String())
+}
+
+func Test_accessLogLine_time(t *testing.T) {
+	p := &proxy{accessLogFormat: AccessLogCommon}
+	request := httptest.NewRequest("POST", "/", nil)
+	received := time.Date(2019, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+
+	assert.Equal(t, `192.0.2.1 - - [10/Oct/2019:13:55:36 -0700] "POST / HTTP/1.1" 204 -`,
+		p.accessLogLine(request, received, http.StatusNoContent, 0))
+}
+
+func Test_quoteAccessLogField(t *testing.T) {
+	assert.Equal(t, `"-"`, quoteAccessLogField(""))
+	assert.Equal(t, `"Mozilla/5.0"`, quoteAccessLogField("Mozilla/5.0"))
+	assert.Equal(t, `"say \"hi\" \\ \x0a\xc3\xa9"`, quoteAccessLogField("say \"hi\" \\ \né"))
+}
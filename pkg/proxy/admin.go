@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	drainPath   = "/admin/drain"
+	undrainPath = "/admin/undrain"
+)
+
+// WithReadiness exposes a readiness probe on the given path, answering 200 once the backend is connected, unless
+// the proxy is draining, and 503 otherwise.
+func WithReadiness(path string) Option {
+	return func(p *proxy) {
+		p.readinessPath = path
+	}
+}
+
+// WithAdmin enables the admin endpoints, which require the given bearer token:
+// POST /admin/drain makes the proxy report as not ready, so that load balancers stop sending traffic its way, while
+// requests keep being served; POST /admin/undrain makes it report as ready again.
+func WithAdmin(token string) Option {
+	return func(p *proxy) {
+		p.adminToken = token
+	}
+}
+
+func (p *proxy) ready(writer http.ResponseWriter, request *http.Request) {
+	if atomic.LoadInt32(&p.draining) == 1 {
+		http.Error(writer, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if p.riffClient == nil {
+		http.Error(writer, "backend not connected", http.StatusServiceUnavailable)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// drain returns an admin handler setting the draining flag to the given value.
+func (p *proxy) drain(draining bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !p.isAdmin(request) {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value := int32(0)
+		if draining {
+			value = 1
+		}
+		atomic.StoreInt32(&p.draining, value)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (p *proxy) isAdmin(request *http.Request) bool {
+	expected := "Bearer " + p.adminToken
+	actual := request.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
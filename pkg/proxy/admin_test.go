@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_admin_drain_toggles_readiness(t *testing.T) {
+	p := &proxy{riffClient: mockRiffClientWithRepeatedResponse(1, "ok", "text/plain")}
+	WithReadiness("/ready")(p)
+	WithAdmin("s3cr3t")(p)
+	mux := p.mux()
+
+	assert.Equal(t, http.StatusOK, serve(mux, "GET", "/ready", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, serve(mux, "POST", "/admin/drain", "s3cr3t").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(mux, "GET", "/ready", "").Code)
+	invocation := serve(mux, "POST", "/", "")
+	assert.Equal(t, http.StatusOK, invocation.Code, "requests should still be served while draining")
+	assert.Equal(t, "ok", invocation.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, serve(mux, "POST", "/admin/undrain", "s3cr3t").Code)
+	assert.Equal(t, http.StatusOK, serve(mux, "GET", "/ready", "").Code)
+}
+
+func Test_admin_requires_token(t *testing.T) {
+	p := &proxy{}
+	WithAdmin("s3cr3t")(p)
+	mux := p.mux()
+
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, "POST", "/admin/drain", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(mux, "POST", "/admin/drain", "wrong").Code)
+	assert.Equal(t, int32(0), p.draining)
+}
+
+func Test_admin_disabled_by_default(t *testing.T) {
+	p := &proxy{}
+
+	assert.Equal(t, http.StatusNotImplemented, serve(p.mux(), "POST", "/admin/drain", "").Code)
+}
+
+func Test_readiness_backend_not_connected(t *testing.T) {
+	p := &proxy{}
+	WithReadiness("/ready")(p)
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve(p.mux(), "GET", "/ready", "").Code)
+}
+
+func serve(handler http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, strings.NewReader(""))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	return responseRecorder
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultAsyncTimeout bounds background invocations when no invocation timeout is set, as no client is there to give
+// up on them.
+const defaultAsyncTimeout = 10 * time.Minute
+
+// WithAsync makes invocations fire-and-forget: once the backend accepted the invocation, the client gets the given
+// success status (such as 202, 200 or 204) without a body, while the input is sent and the output discarded in the
+// background.
+func WithAsync(status int) Option {
+	return func(p *proxy) {
+		p.asyncStatus = status
+	}
+}
+
+// invokeAsync starts the invocation, responds with the configured status and then completes the invocation in the
+// background, independently of the client, within the invocation timeout or defaultAsyncTimeout. Its outcome is
+// recorded by the breaker of the backend once completed.
+func (p *proxy) invokeAsync(writer http.ResponseWriter, request *http.Request, route *route, backend *backend) error {
+	// the request body can't be read once the handler returned
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	argIndex, err := route.inputIndex(inputContentType(request))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := p.invocationContext(context.Background(), route)
+	if _, ok := ctx.Deadline(); !ok {
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), defaultAsyncTimeout)
+	}
+	request = request.Clone(ctx)
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	client, err := p.open(ctx, request, route, backend)
+	if err != nil {
+		cancel()
+		return err
+	}
+	writer.WriteHeader(p.asyncStatus)
+	if flusher, ok := writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	done := p.metrics.streamStarted()
+	go func() {
+		defer done()
+		defer cancel()
+		err := p.complete(client, request, argIndex)
+		p.breakers.forBackend(backend).record(err)
+		p.metrics.invocationEnded(ctx, err)
+		if err != nil {
+			log.Printf("async invocation failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// complete sends the input and discards the output until the function completes.
+func (p *proxy) complete(client rpc.Riff_InvokeClient, request *http.Request, argIndex int32) error {
+	if err := p.sendInput(client, request, argIndex); err != nil && err != io.EOF {
+		return err
+	}
+	for {
+		if _, err := client.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
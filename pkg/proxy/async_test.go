@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_async_status(t *testing.T) {
+	for _, code := range []int{http.StatusAccepted, http.StatusOK, http.StatusNoContent} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			riffClient, invokeClient, release, completed := mockRiffClientReleased()
+			p := &proxy{riffClient: riffClient}
+			WithAsync(code)(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			// the response is complete while the function is still running
+			assert.Equal(t, code, responseRecorder.Code)
+			assert.Empty(t, responseRecorder.Body.String())
+			close(release)
+			select {
+			case <-completed:
+			case <-time.After(time.Second):
+				t.Fatal("the invocation did not complete in the background")
+			}
+			assert.Equal(t, "hello", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+		})
+	}
+}
+
+func Test_async_backend_unavailable(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything).Return(nil, status.Error(codes.Unavailable, "connection refused"))
+	p := &proxy{riffClient: riffClient}
+	WithAsync(http.StatusAccepted)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+}
+
+func Test_async_default_timeout(t *testing.T) {
+	riffClient, _, release, completed := mockRiffClientReleased()
+	p := &proxy{riffClient: riffClient}
+	WithAsync(http.StatusAccepted)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+	close(release)
+	<-completed
+
+	deadline, ok := riffClient.Calls[0].Arguments.Get(0).(context.Context).Deadline()
+	assert.True(t, ok, "background invocations should have a deadline")
+	assert.WithinDuration(t, time.Now().Add(defaultAsyncTimeout), deadline, time.Minute)
+}
+
+func Test_async_breaker_records_background_outcome(t *testing.T) {
+	release := make(chan struct{})
+	completed := make(chan struct{})
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) {
+		<-release
+		defer close(completed)
+	}).Return(nil, status.Error(codes.Unavailable, "connection lost")).Once()
+	p := &proxy{riffClient: riffClient}
+	WithAsync(http.StatusAccepted)(p)
+	WithCircuitBreaker(1, time.Minute)(p)
+
+	first, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	firstResponse := httptest.NewRecorder()
+	p.invokeGrpc(firstResponse, first)
+	close(release)
+	<-completed
+	// the failure is recorded once the goroutine is done with it
+	assert.Eventually(t, func() bool {
+		return !p.breakers.forBackend(p.resolve("/").backends[0]).allow()
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, http.StatusAccepted, firstResponse.Code)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+// mockRiffClientReleased returns a client whose invocation only outputs once release is closed, completed being
+// closed when the output has been fully received.
+func mockRiffClientReleased() (*mocks.RiffClient, *mocks.Riff_InvokeClient, chan struct{}, chan struct{}) {
+	release := make(chan struct{})
+	completed := make(chan struct{})
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) { <-release }).
+		Return(outputSignal("ignored", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Run(func(mock.Arguments) { close(completed) }).Return(nil, io.EOF).Once()
+	return riffClient, invokeClient, release, completed
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"google.golang.org/grpc"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func BenchmarkInvokeGrpc_small_body(b *testing.B) {
+	benchmarkInvokeGrpc(b, &proxy{}, 64, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_large_body(b *testing.B) {
+	benchmarkInvokeGrpc(b, &proxy{}, 1024*1024, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_chunked_body(b *testing.B) {
+	p := &proxy{}
+	WithInputChunking(inputChunkSize)(p)
+	benchmarkInvokeGrpc(b, p, 1024*1024, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_chunked_small_body(b *testing.B) {
+	p := &proxy{}
+	WithInputChunking(512)(p)
+	benchmarkInvokeGrpc(b, p, 1024, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_chunked_tiny_reads(b *testing.B) {
+	p := &proxy{}
+	WithInputChunking(inputChunkSize)(p)
+	benchmarkInvokeGrpcReads(b, p, 256*1024, 16, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_coalesced_tiny_reads(b *testing.B) {
+	p := &proxy{}
+	WithInputChunking(inputChunkSize)(p)
+	WithInputCoalescing(inputChunkSize, 10*time.Millisecond)(p)
+	benchmarkInvokeGrpcReads(b, p, 256*1024, 16, outputSignal("ok", "text/plain"))
+}
+
+func BenchmarkInvokeGrpc_large_output(b *testing.B) {
+	benchmarkInvokeGrpc(b, &proxy{}, 64, outputSignal(string(make([]byte, 1024*1024)), "application/octet-stream"))
+}
+
+func BenchmarkInvokeGrpc_streamed_output(b *testing.B) {
+	frames := make([]*rpc.OutputSignal, 100)
+	for i := range frames {
+		frames[i] = outputSignal(string(make([]byte, 4*1024)), "application/octet-stream")
+	}
+	benchmarkInvokeGrpc(b, &proxy{streaming: true}, 64, frames...)
+}
+
+// headersSink keeps the headers built by benchmarks from being allocated on the stack.
+var headersSink map[string]string
+
+func BenchmarkFrameHeaders(b *testing.B) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	for _, h := range []string{"Accept", "Accept-Encoding", "Authorization", "Content-Type", "User-Agent",
+		"X-Forwarded-For", "X-Forwarded-Proto", "X-Request-Id"} {
+		request.Header.Set(h, "some value")
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		headersSink = frameHeaders(request)
+	}
+}
+
+// benchmarkInvokeGrpc invokes a function replying with the given output frames, with request bodies of the given
+// size.
+func benchmarkInvokeGrpc(b *testing.B, p *proxy, bodySize int, outputSignals ...*rpc.OutputSignal) {
+	benchmarkInvokeGrpcReads(b, p, bodySize, 0, outputSignals...)
+}
+
+// benchmarkInvokeGrpcReads is like benchmarkInvokeGrpc, request bodies being read readSize bytes at a time when
+// positive, as when sent by unbuffered clients.
+func benchmarkInvokeGrpcReads(b *testing.B, p *proxy, bodySize int, readSize int, outputSignals ...*rpc.OutputSignal) {
+	p.riffClient = &benchRiffClient{outputSignals: outputSignals}
+	body := make([]byte, bodySize)
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	writer := &discardWriter{header: make(http.Header)}
+
+	b.SetBytes(int64(bodySize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request.Body = readCloser{Reader: bytes.NewReader(body), Closer: http.NoBody}
+		if readSize > 0 {
+			request.Body = readCloser{Reader: &smallReader{Reader: request.Body, size: readSize}, Closer: http.NoBody}
+		}
+		request.ContentLength = int64(bodySize)
+		p.invokeGrpc(writer, request)
+		for h := range writer.header {
+			delete(writer.header, h)
+		}
+	}
+}
+
+// benchRiffClient is a lightweight stand-in for the invoker, as mocks record every call they get and would weigh on
+// the measures. Its invocations discard their input and reply with the given output signals.
+type benchRiffClient struct {
+	outputSignals []*rpc.OutputSignal
+}
+
+func (c *benchRiffClient) Invoke(ctx context.Context, opts ...grpc.CallOption) (rpc.Riff_InvokeClient, error) {
+	return &benchInvokeClient{outputSignals: c.outputSignals}, nil
+}
+
+type benchInvokeClient struct {
+	grpc.ClientStream
+	outputSignals []*rpc.OutputSignal
+}
+
+func (c *benchInvokeClient) Send(*rpc.InputSignal) error {
+	return nil
+}
+
+func (c *benchInvokeClient) Recv() (*rpc.OutputSignal, error) {
+	if len(c.outputSignals) == 0 {
+		return nil, io.EOF
+	}
+	signal := c.outputSignals[0]
+	c.outputSignals = c.outputSignals[1:]
+	return signal, nil
+}
+
+func (c *benchInvokeClient) CloseSend() error {
+	return nil
+}
+
+// smallReader reads at most size bytes at a time.
+type smallReader struct {
+	io.Reader
+	size int
+}
+
+func (r *smallReader) Read(p []byte) (int, error) {
+	if len(p) > r.size {
+		p = p[:r.size]
+	}
+	return r.Reader.Read(p)
+}
+
+// discardWriter is a response writer discarding the response body.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+)
+
+// WithBlankBodiesIgnored treats request bodies made of whitespace only, such as the lone newline some clients send,
+// as empty: no data frame is sent to the function, which only gets the start of the invocation.
+func WithBlankBodiesIgnored() Option {
+	return func(p *proxy) {
+		p.ignoreBlankBodies = true
+	}
+}
+
+// ignoredInput tells whether an input frame is not to be sent, being blank.
+func (p *proxy) ignoredInput(inputFrame *rpc.InputFrame) bool {
+	return p.ignoreBlankBodies && len(bytes.TrimSpace(inputFrame.Payload)) == 0
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_blank_body_ignored(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithBlankBodiesIgnored()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(" \r\n\t\n"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 1)
+	assert.NotNil(t, signals[0].GetStart())
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_blank_body_not_blank(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithBlankBodiesIgnored()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(" riff\n"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, " riff\n", string(signals[1].GetData().Payload))
+}
+
+func Test_blank_body_sent_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("\n"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, "\n", string(signals[1].GetData().Payload))
+}
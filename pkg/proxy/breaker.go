@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithCircuitBreaker stops invoking a backend after threshold consecutive failures, rejecting requests with a 503
+// until cooldown has elapsed. A single probe request is then let through, closing the breaker again as soon as it
+// receives output. Each backend has a breaker of its own, so that a failing backend doesn't cut off the others.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(p *proxy) {
+		if threshold > 0 {
+			p.breakers = newCircuitBreakers(threshold, cooldown, time.Now)
+		}
+	}
+}
+
+// circuitBreakers holds the breakers of the backends, by target, created as backends are first invoked.
+type circuitBreakers struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	byTarget map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration, now func() time.Time) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+		byTarget:  map[string]*circuitBreaker{},
+	}
+}
+
+// forBackend returns the breaker of a backend. Nil breakers are returned when disabled, which allow everything.
+func (b *circuitBreakers) forBackend(backend *backend) *circuitBreaker {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breaker, ok := b.byTarget[backend.Target]
+	if !ok {
+		breaker = newCircuitBreaker(b.threshold, b.cooldown, b.now)
+		b.byTarget[backend.Target] = breaker
+	}
+	return breaker
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mutex sync.Mutex
+	state breakerState
+	// probing tells whether the single request let through while half-open is still in flight
+	probing  bool
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, now func() time.Time) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+	}
+}
+
+// allow reports whether a request may be sent to the backend. A nil breaker allows everything.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			// a probe is already in flight
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record accounts for the outcome of an allowed request. Errors that are not the backend's fault tell nothing about
+// its health: they leave the breaker as is, only letting another probe through when the request was one.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	switch {
+	case err == nil:
+		b.state = breakerClosed
+		b.failures = 0
+	case isBackendFailure(err):
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = b.now()
+		}
+	}
+}
+
+// observe records the first output frame received from the backend as a success, rather than waiting for the end
+// of the invocation, for long running streams not to keep the breaker half-open in the meantime.
+func (b *circuitBreaker) observe(client rpc.Riff_InvokeClient) rpc.Riff_InvokeClient {
+	if b == nil {
+		return client
+	}
+	return &observedClient{Riff_InvokeClient: client, breaker: b}
+}
+
+type observedClient struct {
+	rpc.Riff_InvokeClient
+	breaker  *circuitBreaker
+	received sync.Once
+}
+
+func (c *observedClient) Recv() (*rpc.OutputSignal, error) {
+	signal, err := c.Riff_InvokeClient.Recv()
+	if err == nil {
+		c.received.Do(func() {
+			c.breaker.record(nil)
+		})
+	}
+	return signal, err
+}
+
+// isBackendFailure tells whether an invocation error is the backend's fault. Errors blamed on the client, as well as
+// errors that are not gRPC statuses (such as failing to read the request body) do not count.
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	grpcError, ok := status.FromError(err)
+	if !ok || grpcError.Code() == codes.Canceled {
+		return false
+	}
+	return httpStatusFromGrpcError(grpcError) >= http.StatusInternalServerError
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_breaker_opens_and_rejects_fast(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "down")
+	p := &proxy{riffClient: riffClient}
+	WithCircuitBreaker(2, time.Minute)(p)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		responseRecorder := httptest.NewRecorder()
+		p.invokeGrpc(responseRecorder, request)
+		codes = append(codes, responseRecorder.Code)
+	}
+
+	unavailable := http.StatusServiceUnavailable
+	assert.Equal(t, []int{unavailable, unavailable, unavailable}, codes)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_breaker_recovers(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, time.Minute, func() time.Time { return now })
+	failure := status.Error(codes.Unavailable, "down")
+
+	assert.True(t, breaker.allow())
+	breaker.record(failure)
+	assert.False(t, breaker.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow(), "a probe should be let through after the cooldown")
+	assert.False(t, breaker.allow(), "only one probe at a time")
+	breaker.record(nil)
+
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.allow())
+}
+
+func Test_breaker_reopens_on_failed_probe(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(3, time.Minute, func() time.Time { return now })
+	failure := status.Error(codes.Internal, "boom")
+	for i := 0; i < 3; i++ {
+		breaker.record(failure)
+	}
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	breaker.record(failure)
+
+	assert.False(t, breaker.allow())
+}
+
+func Test_breaker_ignores_client_errors(t *testing.T) {
+	breaker := newCircuitBreaker(1, time.Minute, time.Now)
+
+	breaker.record(status.Error(codes.InvalidArgument, "Invoker: Not Acceptable: text/zglorbf"))
+	breaker.record(status.Error(codes.Canceled, "client went away"))
+	breaker.record(errors.New("unexpected EOF reading body"))
+
+	assert.True(t, breaker.allow())
+}
+
+func Test_breaker_client_errors_keep_failures(t *testing.T) {
+	breaker := newCircuitBreaker(2, time.Minute, time.Now)
+	failure := status.Error(codes.Unavailable, "down")
+
+	breaker.record(failure)
+	breaker.record(httpErrorf(http.StatusBadRequest, "invalid %s header", outputHeader))
+	breaker.record(failure)
+
+	assert.False(t, breaker.allow())
+}
+
+func Test_breaker_client_error_releases_probe(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, time.Minute, func() time.Time { return now })
+	breaker.record(status.Error(codes.Unavailable, "down"))
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	breaker.record(httpErrorf(http.StatusRequestEntityTooLarge, "request body exceeds 10 bytes"))
+	assert.True(t, breaker.allow(), "another probe should be let through")
+	assert.False(t, breaker.allow(), "only one probe at a time")
+	breaker.record(status.Error(codes.Unavailable, "still down"))
+
+	assert.False(t, breaker.allow())
+}
+
+func Test_breaker_first_output_frame_closes(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, time.Minute, func() time.Time { return now })
+	breaker.record(status.Error(codes.Unavailable, "down"))
+	invokeClient := &mocks.Riff_InvokeClient{}
+	invokeClient.On("Recv").Return(outputSignal("data: one", "text/plain"), nil)
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	client := breaker.observe(invokeClient)
+	_, _ = client.Recv()
+
+	// the stream goes on, while other requests are let through
+	assert.True(t, breaker.allow())
+	assert.True(t, breaker.allow())
+}
+
+func Test_breaker_per_backend(t *testing.T) {
+	failingClient, _ := mockRiffClientWithError(codes.Unavailable, "down")
+	otherClient := mockRiffClientWithRepeatedResponse(2, "ok", "text/plain")
+	p := &proxy{}
+	WithCircuitBreaker(1, time.Minute)(p)
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081"},
+		{Prefix: "/fn/b", Target: "b:8081"},
+	})(p)
+	p.routes[0].backends[0].client = failingClient
+	p.routes[1].backends[0].client = otherClient
+
+	var codes []int
+	for _, path := range []string{"/fn/a", "/fn/b", "/fn/a", "/fn/b"} {
+		request, _ := http.NewRequest("POST", path, strings.NewReader("some body"))
+		responseRecorder := httptest.NewRecorder()
+		p.invokeGrpc(responseRecorder, request)
+		codes = append(codes, responseRecorder.Code)
+	}
+
+	unavailable := http.StatusServiceUnavailable
+	assert.Equal(t, []int{unavailable, http.StatusOK, unavailable, http.StatusOK}, codes)
+	failingClient.AssertNumberOfCalls(t, "Invoke", 1)
+	otherClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
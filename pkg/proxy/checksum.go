@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// checksumHeader carries the checksum of a request body, as an algorithm and hex digest, e.g. sha256=2cf24d...
+const checksumHeader = "X-Riff-Checksum"
+
+// WithChecksumVerification verifies request bodies against the checksum of their Content-MD5 (a base64 MD5 digest)
+// or X-Riff-Checksum (md5, sha1 or sha256, followed by = and a hex digest) header, rejecting mismatching bodies with a
+// 400. The checksum is computed as the body is read, the mismatch failing the read of its end, so that the function
+// doesn't get the last frame of a corrupted body. Compressed bodies are checked as received, before being decoded.
+// Requests with a malformed or unsupported checksum are rejected with a 400 too.
+func WithChecksumVerification() Option {
+	return func(p *proxy) {
+		p.verifyChecksums = true
+	}
+}
+
+func (p *proxy) checkBodies(next http.Handler) http.Handler {
+	if !p.verifyChecksums {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		checksums, err := requestChecksums(request)
+		if err != nil {
+			p.writeError(writer, request, err)
+			return
+		}
+		if len(checksums) > 0 {
+			request.Body = &checksummedBody{ReadCloser: request.Body, checksums: checksums}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// checksum is an expected digest of a request body, computed by hash as the body is read.
+type checksum struct {
+	header   string
+	hash     hash.Hash
+	expected []byte
+}
+
+// requestChecksums returns the checksums the request body is expected to match.
+func requestChecksums(request *http.Request) ([]*checksum, error) {
+	var checksums []*checksum
+	if value := request.Header.Get("Content-MD5"); value != "" {
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(expected) != md5.Size {
+			return nil, httpErrorf(http.StatusBadRequest, "malformed Content-MD5 header %q", value)
+		}
+		checksums = append(checksums, &checksum{header: "Content-MD5", hash: md5.New(), expected: expected})
+	}
+	if value := request.Header.Get(checksumHeader); value != "" {
+		i := strings.IndexByte(value, '=')
+		if i < 0 {
+			return nil, httpErrorf(http.StatusBadRequest, "malformed %s header %q, must be <algorithm>=<hex digest>",
+				checksumHeader, value)
+		}
+		var h hash.Hash
+		switch algorithm := strings.ToLower(strings.TrimSpace(value[:i])); algorithm {
+		case "md5":
+			h = md5.New()
+		case "sha1":
+			h = sha1.New()
+		case "sha256":
+			h = sha256.New()
+		default:
+			return nil, httpErrorf(http.StatusBadRequest, "unsupported %s algorithm %q, must be md5, sha1 or sha256",
+				checksumHeader, algorithm)
+		}
+		expected, err := hex.DecodeString(strings.TrimSpace(value[i+1:]))
+		if err != nil || len(expected) != h.Size() {
+			return nil, httpErrorf(http.StatusBadRequest, "malformed %s header %q, must be <algorithm>=<hex digest>",
+				checksumHeader, value)
+		}
+		checksums = append(checksums, &checksum{header: checksumHeader, hash: h, expected: expected})
+	}
+	return checksums, nil
+}
+
+// checksummedBody fails the read reaching the end of a body that doesn't match its checksums.
+type checksummedBody struct {
+	io.ReadCloser
+	checksums []*checksum
+}
+
+func (b *checksummedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for _, c := range b.checksums {
+		c.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		for _, c := range b.checksums {
+			if !bytes.Equal(c.hash.Sum(nil), c.expected) {
+				return n, httpErrorf(http.StatusBadRequest, "request body doesn't match its %s header", c.header)
+			}
+		}
+	}
+	return n, err
+}
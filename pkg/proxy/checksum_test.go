@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_checksum_matching(t *testing.T) {
+	sha256Sum := sha256.Sum256([]byte("hello"))
+	md5Sum := md5.Sum([]byte("hello"))
+	for name, header := range map[string][2]string{
+		"sha256":      {"X-Riff-Checksum", "sha256=" + hex.EncodeToString(sha256Sum[:])},
+		"md5":         {"X-Riff-Checksum", "MD5=" + strings.ToUpper(hex.EncodeToString(md5Sum[:]))},
+		"content-md5": {"Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:])},
+	} {
+		t.Run(name, func(t *testing.T) {
+			riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+			p := &proxy{riffClient: riffClient}
+			WithChecksumVerification()(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+			request.Header.Set(header[0], header[1])
+			responseRecorder := httptest.NewRecorder()
+			p.handler().ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, "hello", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+		})
+	}
+}
+
+func Test_checksum_mismatching(t *testing.T) {
+	md5Sum := md5.Sum([]byte("hello"))
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithChecksumVerification()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hallo"))
+	request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, "request body doesn't match its Content-MD5 header\n", responseRecorder.Body.String())
+	for _, signal := range inputSignals(invokeClient.Calls) {
+		assert.Nil(t, signal.GetData(), "the corrupted body should not reach the function")
+	}
+}
+
+func Test_checksum_mismatching_chunked(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 2*inputChunkSize+10)
+	sum := sha256.Sum256(body)
+	body[len(body)-1] = 'y'
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithChecksumVerification()(p)
+	WithInputChunking(1024)(p)
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("X-Riff-Checksum", "sha256="+hex.EncodeToString(sum[:]))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Len(t, inputSignals(invokeClient.Calls), 3, "the last frame should not be sent")
+	invokeClient.AssertNotCalled(t, "CloseSend")
+}
+
+func Test_checksum_compressed_body(t *testing.T) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, _ = gzipWriter.Write([]byte("hello"))
+	_ = gzipWriter.Close()
+	sum := md5.Sum(compressed.Bytes())
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithChecksumVerification()(p)
+	WithRequestDecompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(compressed.Bytes()))
+	request.Header.Set("Content-Encoding", "gzip")
+	request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "hello", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_checksum_invalid_header(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		value  string
+	}{
+		{"X-Riff-Checksum", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"X-Riff-Checksum", "crc32=3610a686"},
+		{"X-Riff-Checksum", "sha256=not hex"},
+		{"X-Riff-Checksum", "sha256=3610a686"},
+		{"Content-MD5", "not base64"},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			riffClient, _ := mockRiffClient()
+			p := &proxy{riffClient: riffClient}
+			WithChecksumVerification()(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+			request.Header.Set(c.header, c.value)
+			responseRecorder := httptest.NewRecorder()
+			p.handler().ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+			riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+		})
+	}
+}
+
+func Test_checksum_ignored_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	request.Header.Set("X-Riff-Checksum", "md5=00000000000000000000000000000000")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// inputChunkSize is the maximum payload size of the input frames of a chunked request body.
+const inputChunkSize = 32 * 1024
+
+// chunkBuffers holds the buffers request bodies are read into, reused across requests as payloads are copied out of
+// them. Pointers are pooled so that putting a buffer back doesn't allocate.
+var chunkBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, inputChunkSize)
+		return &buffer
+	},
+}
+
+// WithInputChunking sends request bodies larger than threshold bytes, or of unknown length, as a sequence of data
+// frames of up to 32KiB each, as they are read. Smaller bodies are still sent as a single frame. Only the first
+// frame carries the request headers.
+func WithInputChunking(threshold int64) Option {
+	return func(p *proxy) {
+		p.chunkThreshold = threshold
+	}
+}
+
+// chunkedInput tells whether the request body should be sent as several frames.
+func (p *proxy) chunkedInput(request *http.Request) bool {
+	if p.chunkThreshold <= 0 || p.rawHTTP {
+		return false
+	}
+	return request.ContentLength < 0 || request.ContentLength > p.chunkThreshold
+}
+
+// sendChunks sends the request body as data frames of up to inputChunkSize bytes, read into a pooled buffer that is
+// given back whichever way the request ends. An empty body still results in one (empty) frame.
+func (p *proxy) sendChunks(client rpc.Riff_InvokeClient, request *http.Request, contentType string,
+	argIndex int32) error {
+	pooled := chunkBuffers.Get().(*[]byte)
+	defer chunkBuffers.Put(pooled)
+	buffer := *pooled
+	for first := true; ; first = false {
+		n, err := io.ReadFull(request.Body, buffer)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if n > 0 || first {
+			inputFrame := &rpc.InputFrame{
+				ContentType: contentType,
+				ArgIndex:    argIndex,
+				Payload:     append([]byte(nil), buffer[:n]...),
+			}
+			if first {
+				inputFrame.Headers = frameHeaders(request)
+			}
+			if err := p.sendData(client, inputFrame); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
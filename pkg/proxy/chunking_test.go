@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_small_body_single_frame(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	request.Header.Set("Content-Type", "text/plain")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, "hello", string(signals[1].GetData().Payload))
+	assert.Equal(t, "text/plain", signals[1].GetData().Headers["Content-Type"])
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_large_body_chunked(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	body := bytes.Repeat([]byte("x"), 2*inputChunkSize+10)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "text/plain")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 4)
+	var payload []byte
+	for i, signal := range signals[1:] {
+		assert.Equal(t, "text/plain", signal.GetData().ContentType)
+		if i == 0 {
+			assert.Equal(t, "text/plain", signal.GetData().Headers["Content-Type"])
+		} else {
+			assert.Empty(t, signal.GetData().Headers)
+		}
+		payload = append(payload, signal.GetData().Payload...)
+	}
+	assert.Len(t, signals[3].GetData().Payload, 10)
+	assert.Equal(t, body, payload)
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_unknown_length_body_chunked(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	request, _ := http.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("")))
+	request.ContentLength = -1
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Empty(t, signals[1].GetData().Payload)
+}
+
+func Test_large_body_single_frame_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	body := bytes.Repeat([]byte("x"), 2*inputChunkSize+10)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, body, signals[1].GetData().Payload)
+}
+
+func Test_chunk_buffers_reused_without_corruption(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	var bodies [][]byte
+	for _, b := range []byte("abc") {
+		body := bytes.Repeat([]byte{b}, inputChunkSize+10)
+		bodies = append(bodies, body)
+		request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+		p.invokeGrpc(httptest.NewRecorder(), request)
+	}
+
+	var payloads [][]byte
+	var payload []byte
+	for _, signal := range inputSignals(invokeClient.Calls) {
+		if signal.GetStart() != nil && payload != nil {
+			payloads = append(payloads, payload)
+			payload = nil
+		} else if data := signal.GetData(); data != nil {
+			payload = append(payload, data.Payload...)
+		}
+	}
+	payloads = append(payloads, payload)
+	assert.Equal(t, bodies, payloads)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// The CloudEvents attributes required in binary content mode, as http headers.
+const (
+	ceSpecVersionHeader = "Ce-Specversion"
+	ceIDHeader          = "Ce-Id"
+	ceSourceHeader      = "Ce-Source"
+	ceTypeHeader        = "Ce-Type"
+)
+
+// cloudEventsSpecVersion is the version of the CloudEvents specification supported.
+const cloudEventsSpecVersion = "1.0"
+
+// structuredCloudEventType is the content type of a CloudEvent in structured content mode.
+const structuredCloudEventType = "application/cloudevents+json"
+
+// WithCloudEvents supports CloudEvents in binary content mode. Requests carrying a Ce-Specversion header must have
+// the other required attributes, passed to the function as the ce-* headers of the input frame along with the body as
+// the event data. Successful responses to such requests are events too: the ce-* headers of the output frames are
+// completed with a new id, the request path as source and the type of the request event, unless set by the function.
+// Events in structured content mode are turned into binary mode ones, so that functions only deal with the latter.
+func WithCloudEvents() Option {
+	return func(p *proxy) {
+		p.cloudEvents = true
+	}
+}
+
+// cloudEvent holds the attributes of a request event used as defaults for the reply.
+type cloudEvent struct {
+	source string
+	typ    string
+}
+
+// readCloudEvent checks the attributes of a request in binary content mode, after turning structured mode requests
+// into binary mode ones, returning nil for requests that are not CloudEvents.
+func readCloudEvent(request *http.Request) (*cloudEvent, error) {
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("content-type")); mediaType == structuredCloudEventType {
+		if err := unstructureCloudEvent(request); err != nil {
+			return nil, err
+		}
+	}
+	version := request.Header.Get(ceSpecVersionHeader)
+	if version == "" {
+		return nil, nil
+	}
+	if version != cloudEventsSpecVersion {
+		return nil, httpErrorf(http.StatusBadRequest, "unsupported CloudEvents spec version %q", version)
+	}
+	for _, h := range []string{ceIDHeader, ceSourceHeader, ceTypeHeader} {
+		if request.Header.Get(h) == "" {
+			return nil, httpErrorf(http.StatusBadRequest, "missing CloudEvents attribute %s", h)
+		}
+	}
+	return &cloudEvent{source: request.URL.Path, typ: request.Header.Get(ceTypeHeader)}, nil
+}
+
+// reply completes the response headers set by the function into the required attributes of a reply event.
+func (e *cloudEvent) reply(header http.Header) {
+	if header.Get(ceSpecVersionHeader) == "" {
+		header.Set(ceSpecVersionHeader, cloudEventsSpecVersion)
+	}
+	if header.Get(ceIDHeader) == "" {
+		header.Set(ceIDHeader, newRequestID())
+	}
+	if header.Get(ceSourceHeader) == "" {
+		header.Set(ceSourceHeader, e.source)
+	}
+	if header.Get(ceTypeHeader) == "" {
+		header.Set(ceTypeHeader, e.typ)
+	}
+}
+
+// unstructureCloudEvent rewrites a request holding a whole event in its body, in structured content mode, into the
+// equivalent binary mode request: attributes become ce-* headers, the data (decoded if base64) becomes the body and
+// the datacontenttype, application/json by default, its content type.
+func unstructureCloudEvent(request *http.Request) error {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(body, &event); err != nil {
+		return httpErrorf(http.StatusBadRequest, "malformed structured CloudEvent: %v", err)
+	}
+	if _, ok := event["specversion"]; !ok {
+		return httpErrorf(http.StatusBadRequest, "missing CloudEvents attribute specversion")
+	}
+	contentType := "application/json"
+	var data []byte
+	for name, value := range event {
+		switch name {
+		case "data", "data_base64":
+		case "datacontenttype":
+			if err := json.Unmarshal(value, &contentType); err != nil {
+				return httpErrorf(http.StatusBadRequest, "invalid CloudEvents attribute datacontenttype: %s", value)
+			}
+		default:
+			request.Header.Set("Ce-"+name, attributeValue(value))
+		}
+	}
+	if value, ok := event["data_base64"]; ok {
+		var encoded string
+		if err := json.Unmarshal(value, &encoded); err != nil {
+			return httpErrorf(http.StatusBadRequest, "invalid CloudEvent data_base64: %s", value)
+		}
+		if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return httpErrorf(http.StatusBadRequest, "invalid CloudEvent data_base64: %v", err)
+		}
+	} else if value, ok := event["data"]; ok {
+		// data of other types than json is held in a json string
+		var text string
+		if isJSON(contentType) || json.Unmarshal(value, &text) != nil {
+			data = value
+		} else {
+			data = []byte(text)
+		}
+	}
+	if data == nil {
+		request.Header.Del("content-type")
+	} else {
+		request.Header.Set("content-type", contentType)
+	}
+	if request.Header.Get("content-length") != "" {
+		request.Header.Set("content-length", strconv.Itoa(len(data)))
+	}
+	request.ContentLength = int64(len(data))
+	request.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// attributeValue formats the json value of an attribute as a header value, strings being unquoted.
+func attributeValue(value json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text
+	}
+	return string(value)
+}
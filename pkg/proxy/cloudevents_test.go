@@ -0,0 +1,257 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func cloudEventRequest(body string) *http.Request {
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("ce-specversion", "1.0")
+	request.Header.Set("ce-id", "order-1")
+	request.Header.Set("ce-source", "/shop")
+	request.Header.Set("ce-type", "com.example.order.created")
+	request.Header.Set("ce-subject", "order")
+	return request
+}
+
+func Test_cloud_events_round_trip(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(&rpc.OutputSignal{
+		Frame: &rpc.OutputSignal_Data{
+			Data: &rpc.OutputFrame{
+				Payload:     []byte(`{"total": 42}`),
+				ContentType: "application/json",
+				Headers:     map[string]string{"ce-type": "com.example.order.priced", "ce-subject": "order"},
+			},
+		},
+	})
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, cloudEventRequest(`{"item": "book"}`))
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, `{"item": "book"}`, string(dataFrame.Payload))
+	assert.Equal(t, "application/json", dataFrame.ContentType)
+	assert.Equal(t, "1.0", dataFrame.Headers["Ce-Specversion"])
+	assert.Equal(t, "order-1", dataFrame.Headers["Ce-Id"])
+	assert.Equal(t, "/shop", dataFrame.Headers["Ce-Source"])
+	assert.Equal(t, "com.example.order.created", dataFrame.Headers["Ce-Type"])
+	assert.Equal(t, "order", dataFrame.Headers["Ce-Subject"])
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, `{"total": 42}`, responseRecorder.Body.String())
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "1.0", responseRecorder.Header().Get("ce-specversion"))
+	assert.Len(t, responseRecorder.Header().Get("ce-id"), 32)
+	assert.Equal(t, "/", responseRecorder.Header().Get("ce-source"))
+	assert.Equal(t, "com.example.order.priced", responseRecorder.Header().Get("ce-type"))
+	assert.Equal(t, "order", responseRecorder.Header().Get("ce-subject"))
+}
+
+func Test_cloud_events_reply_defaults(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, cloudEventRequest(`{}`))
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "1.0", responseRecorder.Header().Get("ce-specversion"))
+	assert.NotEmpty(t, responseRecorder.Header().Get("ce-id"))
+	assert.NotEqual(t, "order-1", responseRecorder.Header().Get("ce-id"))
+	assert.Equal(t, "/", responseRecorder.Header().Get("ce-source"))
+	assert.Equal(t, "com.example.order.created", responseRecorder.Header().Get("ce-type"))
+}
+
+func Test_cloud_events_missing_attribute(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request := cloudEventRequest(`{}`)
+	request.Header.Del("ce-source")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "missing CloudEvents attribute Ce-Source")
+	assert.Empty(t, responseRecorder.Header().Get("ce-id"))
+	assert.Empty(t, invokeClient.Calls)
+}
+
+func Test_cloud_events_unsupported_version(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request := cloudEventRequest(`{}`)
+	request.Header.Set("ce-specversion", "0.3")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), `unsupported CloudEvents spec version "0.3"`)
+}
+
+func Test_cloud_events_error_reply(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(metadataSignal(map[string]string{"X-Riff-Status": "422"}))
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, cloudEventRequest(`{}`))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Header().Get("ce-id"))
+}
+
+func Test_cloud_events_plain_request(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Header().Get("ce-specversion"))
+}
+
+func Test_cloud_events_disabled_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request := cloudEventRequest(`{}`)
+	request.Header.Del("ce-id")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Header().Get("ce-specversion"))
+}
+
+func Test_cloud_events_structured(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{
+		"specversion": "1.0",
+		"id": "order-1",
+		"source": "/shop",
+		"type": "com.example.order.created",
+		"priority": 3,
+		"datacontenttype": "application/json",
+		"data": {"item": "book"}
+	}`))
+	request.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "application/json", dataFrame.ContentType)
+	assert.Equal(t, `{"item": "book"}`, string(dataFrame.Payload))
+	assert.Equal(t, "1.0", dataFrame.Headers["Ce-Specversion"])
+	assert.Equal(t, "order-1", dataFrame.Headers["Ce-Id"])
+	assert.Equal(t, "/shop", dataFrame.Headers["Ce-Source"])
+	assert.Equal(t, "com.example.order.created", dataFrame.Headers["Ce-Type"])
+	assert.Equal(t, "3", dataFrame.Headers["Ce-Priority"])
+	assert.Equal(t, "com.example.order.created", responseRecorder.Header().Get("ce-type"))
+}
+
+func Test_cloud_events_structured_text_data(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(
+		`{"specversion": "1.0", "id": "1", "source": "/shop", "type": "note", `+
+			`"datacontenttype": "text/plain", "data": "hello"}`))
+	request.Header.Set("Content-Type", "application/cloudevents+json")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "text/plain", dataFrame.ContentType)
+	assert.Equal(t, "hello", string(dataFrame.Payload))
+}
+
+func Test_cloud_events_structured_base64_data(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(
+		`{"specversion": "1.0", "id": "1", "source": "/shop", "type": "blob", `+
+			`"datacontenttype": "application/octet-stream", "data_base64": "AAEC"}`))
+	request.Header.Set("Content-Type", "application/cloudevents+json")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "application/octet-stream", dataFrame.ContentType)
+	assert.Equal(t, []byte{0, 1, 2}, dataFrame.Payload)
+}
+
+func Test_cloud_events_structured_default_content_type(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithCloudEvents()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(
+		`{"specversion": "1.0", "id": "1", "source": "/shop", "type": "count", "data": 42}`))
+	request.Header.Set("Content-Type", "application/cloudevents+json")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "application/json", dataFrame.ContentType)
+	assert.Equal(t, "42", string(dataFrame.Payload))
+}
+
+func Test_cloud_events_structured_invalid(t *testing.T) {
+	for name, body := range map[string]string{
+		"malformed":        `{"specversion": "1.0",`,
+		"no specversion":   `{"id": "1", "source": "/shop", "type": "note"}`,
+		"missing type":     `{"specversion": "1.0", "id": "1", "source": "/shop"}`,
+		"bad data_base64":  `{"specversion": "1.0", "id": "1", "source": "/shop", "type": "blob", "data_base64": "!"}`,
+		"bad content type": `{"specversion": "1.0", "id": "1", "source": "/shop", "type": "note", "datacontenttype": 1}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			riffClient, invokeClient := mockRiffClient()
+			p := &proxy{riffClient: riffClient}
+			WithCloudEvents()(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/cloudevents+json")
+			responseRecorder := httptest.NewRecorder()
+			p.handler().ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+			assert.Empty(t, invokeClient.Calls)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithInputCoalescing sends chunked request bodies as they arrive rather than in full 32KiB frames, coalescing the
+// bytes read into frames of up to frameSize bytes (32KiB when not positive), a frame being sent no later than maxWait
+// after its first bytes were read. This bounds the latency added to bodies trickling in, while still sending the many
+// tiny chunks of unbuffered clients as fewer, larger frames. It only applies to bodies chunked by WithInputChunking,
+// and is disabled unless maxWait is positive.
+func WithInputCoalescing(frameSize int, maxWait time.Duration) Option {
+	return func(p *proxy) {
+		if frameSize <= 0 {
+			frameSize = inputChunkSize
+		}
+		p.coalesceSize = frameSize
+		p.coalesceWait = maxWait
+	}
+}
+
+// bodyReader reads a request body in the background, so that frames can be sent on time while reads block. The
+// bytes read are held until taken, reads pausing while at least size bytes are held.
+type bodyReader struct {
+	size  int
+	ready chan struct{}
+
+	mu      sync.Mutex
+	room    *sync.Cond
+	pending []byte
+	err     error
+	stopped bool
+}
+
+func readBody(body io.Reader, size int) *bodyReader {
+	r := &bodyReader{size: size, ready: make(chan struct{}, 1)}
+	r.room = sync.NewCond(&r.mu)
+	go r.read(body)
+	return r
+}
+
+func (r *bodyReader) read(body io.Reader) {
+	buffer := make([]byte, r.size)
+	for {
+		n, err := body.Read(buffer)
+		r.mu.Lock()
+		r.pending = append(r.pending, buffer[:n]...)
+		r.err = err
+		r.mu.Unlock()
+		select {
+		case r.ready <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		for len(r.pending) >= r.size && !r.stopped {
+			r.room.Wait()
+		}
+		stopped := r.stopped
+		r.mu.Unlock()
+		if stopped {
+			return
+		}
+	}
+}
+
+// take returns the bytes read since last taken, along with the error that ended the body, if any.
+func (r *bodyReader) take() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := r.pending
+	r.pending = nil
+	r.room.Signal()
+	return data, r.err
+}
+
+// stop ends reading, once the current read returns.
+func (r *bodyReader) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	r.room.Signal()
+}
+
+// sendCoalesced sends the request body as data frames of up to coalesceSize bytes, each sent once full, when the body
+// ends, or coalesceWait after its first bytes were read. An empty body still results in one (empty) frame.
+func (p *proxy) sendCoalesced(client rpc.Riff_InvokeClient, request *http.Request, contentType string,
+	argIndex int32) error {
+	body := readBody(request.Body, p.coalesceSize)
+	defer body.stop()
+
+	var pending []byte
+	var timer *time.Timer
+	var expired <-chan time.Time
+	first := true
+	send := func(payload []byte) error {
+		inputFrame := &rpc.InputFrame{
+			ContentType: contentType,
+			ArgIndex:    argIndex,
+			Payload:     payload,
+		}
+		if first {
+			inputFrame.Headers = frameHeaders(request)
+			first = false
+		}
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		return p.sendData(client, inputFrame)
+	}
+	for {
+		select {
+		case <-body.ready:
+			data, err := body.take()
+			pending = append(pending, data...)
+			for len(pending) >= p.coalesceSize {
+				if err := send(pending[:p.coalesceSize:p.coalesceSize]); err != nil {
+					return err
+				}
+				pending = pending[p.coalesceSize:]
+			}
+			if err == io.EOF {
+				if len(pending) > 0 || first {
+					return send(pending)
+				}
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if len(pending) > 0 && timer == nil {
+				timer = time.NewTimer(p.coalesceWait)
+				expired = timer.C
+			}
+		case <-expired:
+			if err := send(pending); err != nil {
+				return err
+			}
+			pending = nil
+		}
+	}
+}
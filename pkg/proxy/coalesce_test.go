@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_coalescing_small_chunks(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(16)(p)
+	WithInputCoalescing(64, time.Minute)(p)
+
+	body, bodyWriter := io.Pipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			_, _ = bodyWriter.Write([]byte("abcd"))
+		}
+		_ = bodyWriter.Close()
+	}()
+	request, _ := http.NewRequest("POST", "/", body)
+	request.ContentLength = -1
+	request.Header.Set("Content-Type", "text/plain")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 8, "400 bytes written 4 at a time should be sent as 7 frames")
+	var payload []byte
+	for i, signal := range signals[1:] {
+		if i < 6 {
+			assert.Len(t, signal.GetData().Payload, 64)
+		}
+		if i == 0 {
+			assert.Equal(t, "text/plain", signal.GetData().Headers["Content-Type"])
+		} else {
+			assert.Empty(t, signal.GetData().Headers)
+		}
+		payload = append(payload, signal.GetData().Payload...)
+	}
+	assert.Equal(t, bytes.Repeat([]byte("abcd"), 100), payload)
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_coalescing_max_wait(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	frames := make(chan *rpc.InputFrame, 1)
+	halfClosed := make(chan struct{})
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		if data := args.Get(0).(*rpc.InputSignal).GetData(); data != nil {
+			frames <- data
+		}
+	}).Return(nil)
+	invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(halfClosed) }).Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) { <-halfClosed }).Return(outputSignal("ok", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(16)(p)
+	WithInputCoalescing(64, 10*time.Millisecond)(p)
+
+	body, bodyWriter := io.Pipe()
+	request, _ := http.NewRequest("POST", "/", body)
+	request.ContentLength = -1
+	done := make(chan struct{})
+	go func() {
+		p.invokeGrpc(httptest.NewRecorder(), request)
+		close(done)
+	}()
+
+	// bytes are sent once the wait is over, while the body is still being written
+	received := func(expected string) {
+		select {
+		case frame := <-frames:
+			assert.Equal(t, expected, string(frame.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("frame %q not sent", expected)
+		}
+	}
+	_, _ = bodyWriter.Write([]byte("abc"))
+	received("abc")
+	_, _ = bodyWriter.Write([]byte("de"))
+	received("de")
+	_ = bodyWriter.Close()
+	<-done
+	select {
+	case frame := <-frames:
+		t.Fatalf("unexpected frame %q", frame.Payload)
+	default:
+	}
+}
+
+func Test_coalescing_empty_body(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(16)(p)
+	WithInputCoalescing(0, time.Minute)(p)
+
+	body, bodyWriter := io.Pipe()
+	_ = bodyWriter.Close()
+	request, _ := http.NewRequest("POST", "/", body)
+	request.ContentLength = -1
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Empty(t, signals[1].GetData().Payload)
+	assert.Equal(t, inputChunkSize, p.coalesceSize)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The content codings responses may be compressed with, by order of preference on equal quality values.
+var responseEncodings = []string{"br", "gzip"}
+
+// WithResponseCompression compresses response bodies of at least minSize bytes with br (Brotli) or gzip, whichever
+// the client prefers according to its Accept-Encoding header, br winning ties. Streamed responses, whose length isn't
+// known upfront, are always compressed, each frame being flushed to the client as it is written.
+func WithResponseCompression(minSize int64) Option {
+	return func(p *proxy) {
+		p.compressResponses = true
+		p.compressionMinSize = minSize
+	}
+}
+
+func (p *proxy) compressBodies(next http.Handler) http.Handler {
+	if !p.compressResponses {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		encoding := preferredEncoding(request.Header.Get("accept-encoding"))
+		if encoding == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		compressing := &compressingWriter{ResponseWriter: writer, encoding: encoding, minSize: p.compressionMinSize}
+		defer compressing.close()
+		next.ServeHTTP(compressing, request)
+	})
+}
+
+// preferredEncoding picks the supported content coding with the highest quality value in an Accept-Encoding
+// header, the * wildcard standing for codings not listed. It returns an empty string when none is acceptable.
+func preferredEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(entry, ";")
+		if coding := strings.ToLower(strings.TrimSpace(parts[0])); coding != "" {
+			qualities[coding] = quality(parts[1:])
+		}
+	}
+	preferred, best := "", 0.0
+	for _, encoding := range responseEncodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > best {
+			preferred, best = encoding, q
+		}
+	}
+	return preferred
+}
+
+// encoder compresses what is written to it, flushing pending output on demand.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressingWriter compresses the response body with the given content coding, unless the response turns out not
+// to be worth it once its headers are known: too short, without a body or encoded already.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int64
+	started  bool
+	// encoder, when non nil, compresses the body
+	encoder encoder
+}
+
+func (w *compressingWriter) WriteHeader(status int) {
+	if !w.started {
+		w.started = true
+		if w.compressible(status) {
+			w.Header().Del("content-length")
+			w.Header().Set("content-encoding", w.encoding)
+			if w.encoding == "br" {
+				w.encoder = brotli.NewWriter(w.ResponseWriter)
+			} else {
+				w.encoder = gzip.NewWriter(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressingWriter) compressible(status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	} else if w.Header().Get("content-encoding") != "" {
+		return false
+	}
+	if value := w.Header().Get("content-length"); value != "" {
+		length, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && length >= w.minSize
+	}
+	return true
+}
+
+func (w *compressingWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.started {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.encoder != nil {
+			_ = w.encoder.Flush()
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the writer compressed output goes to.
+func (w *compressingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close writes what is left of the compressed body.
+func (w *compressingWriter) close() {
+	if w.encoder != nil {
+		_ = w.encoder.Close()
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_preferredEncoding(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                     "",
+		"identity":             "",
+		"gzip":                 "gzip",
+		"br":                   "br",
+		"gzip, deflate, br":    "br",
+		"gzip;q=1, br;q=0.5":   "gzip",
+		"BR;q=0.8, gzip;q=0.2": "br",
+		"br;q=0, *":            "gzip",
+		"*":                    "br",
+		"*;q=0, gzip;q=0.1":    "gzip",
+		"deflate":              "",
+	} {
+		assert.Equal(t, expected, preferredEncoding(acceptEncoding), acceptEncoding)
+	}
+}
+
+func Test_response_compression_brotli_preferred(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse(strings.Repeat("some response ", 10), "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithResponseCompression(100)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept-Encoding", "gzip;q=0.8, br")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "br", responseRecorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", responseRecorder.Header().Get("Vary"))
+	assert.Empty(t, responseRecorder.Header().Get("Content-Length"))
+	body, err := ioutil.ReadAll(brotli.NewReader(responseRecorder.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("some response ", 10), string(body))
+}
+
+func Test_response_compression_gzip_fallback(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse(strings.Repeat("some response ", 10), "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithResponseCompression(100)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "gzip", responseRecorder.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(responseRecorder.Body)
+	if assert.NoError(t, err) {
+		body, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Repeat("some response ", 10), string(body))
+	}
+}
+
+func Test_response_compression_below_threshold(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithResponseCompression(100)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept-Encoding", "br, gzip")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, "13", responseRecorder.Header().Get("Content-Length"))
+	assert.Equal(t, "some response", responseRecorder.Body.String())
+}
+
+func Test_response_compression_not_accepted(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse(strings.Repeat("some response ", 10), "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithResponseCompression(0)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", responseRecorder.Header().Get("Vary"))
+	assert.Equal(t, strings.Repeat("some response ", 10), responseRecorder.Body.String())
+}
+
+func Test_response_compression_encoded_by_function(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(metadataSignal(map[string]string{"Content-Encoding": "gzip"}))
+	p := &proxy{riffClient: riffClient}
+	WithResponseCompression(0)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept-Encoding", "br")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "gzip", responseRecorder.Header().Get("Content-Encoding"))
+}
+
+func Test_response_compression_streamed(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("one,", "text/plain"), outputSignal("two", "text/plain"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithResponseCompression(1024)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept-Encoding", "br")
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "br", responseRecorder.Header().Get("Content-Encoding"))
+	assert.Len(t, responseRecorder.flushes, 2)
+	body, err := ioutil.ReadAll(brotli.NewReader(responseRecorder.Body))
+	assert.NoError(t, err)
+	assert.Equal(t, "one,two", string(body))
+}
+
+func Test_flushable_compressing(t *testing.T) {
+	assert.True(t, flushable(&compressingWriter{ResponseWriter: httptest.NewRecorder()}))
+	assert.False(t, flushable(&responseRecorder{ResponseWriter: &compressingWriter{ResponseWriter: unflushableWriter{}}}))
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentTypeChanges tells how output frames declaring another content type than the one of a streamed response are
+// handled, as HTTP can't change the content type of a body once sent.
+type ContentTypeChanges string
+
+const (
+	// ContentTypeChangesWarn logs a warning, once per response, and writes the frames as if they had the content type
+	// of the response
+	ContentTypeChangesWarn ContentTypeChanges = "warn"
+	// ContentTypeChangesReject cuts the response short with a 502 reported in the X-Riff-Error trailer
+	ContentTypeChangesReject ContentTypeChanges = "reject"
+)
+
+// WithContentTypeChanges sets how output frames changing the content type of a streamed response are handled, with a
+// warning by default. Only content types differing in their media type count as a change, not in their parameters,
+// and frames received before the response is committed decide its content type.
+func WithContentTypeChanges(policy ContentTypeChanges) Option {
+	return func(p *proxy) {
+		p.contentTypeChanges = policy
+	}
+}
+
+// contentTypeChange checks an output frame written to a committed response against the content type of the response,
+// warned telling whether a change was already logged for it.
+func (p *proxy) contentTypeChange(response *responseWriter, frame *rpc.OutputFrame, warned *bool) error {
+	if !response.committed || frame.ContentType == "" {
+		return nil
+	}
+	contentType := response.writer.Header().Get("content-type")
+	if sameMediaType(contentType, frame.ContentType) {
+		return nil
+	}
+	if p.contentTypeChanges == ContentTypeChangesReject {
+		return httpErrorf(http.StatusBadGateway, "output content type changed from %q to %q", contentType, frame.ContentType)
+	}
+	if !*warned {
+		*warned = true
+		log.Printf("output content type changed from %q to %q mid-stream, writing it as %q",
+			contentType, frame.ContentType, contentType)
+	}
+	return nil
+}
+
+// sameMediaType tells whether two content types have the same media type, whatever their parameters.
+func sameMediaType(a, b string) bool {
+	mediaTypeA, _, errA := mime.ParseMediaType(a)
+	mediaTypeB, _, errB := mime.ParseMediaType(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+	}
+	return mediaTypeA == mediaTypeB
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_content_type_change_warns_by_default(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "text/plain; charset=utf-8"),
+		outputSignal("three", "application/json"),
+		outputSignal("four", "application/json"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "text/plain", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"one", "two", "three", "four"}, responseRecorder.flushes)
+	assert.Empty(t, responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+	assert.Equal(t, 1, strings.Count(logs.String(), `output content type changed from "text/plain" to "application/json"`))
+}
+
+func Test_content_type_change_rejected(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "text/plain; charset=utf-8"),
+		outputSignal("three", "application/json"),
+		outputSignal("four", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithContentTypeChanges(ContentTypeChangesReject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, []string{"one", "two"}, responseRecorder.flushes)
+	assert.Contains(t, responseRecorder.Result().Trailer.Get("X-Riff-Error"),
+		`output content type changed from "text/plain" to "application/json"`)
+}
+
+func Test_content_type_change_before_commit(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "application/json"),
+		outputSignal("three", "application/json"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithHeaderReadAhead(2)(p)
+	WithContentTypeChanges(ContentTypeChangesReject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "onetwothree", responseRecorder.Body.String())
+	assert.Empty(t, responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
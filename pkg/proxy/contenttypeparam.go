@@ -0,0 +1,66 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// contentTypeParam is the query parameter telling the content type of requests not declaring any.
+const contentTypeParam = "content-type"
+
+// WithContentTypeParam lets clients unable to set headers tell the content type of their requests with a
+// content-type query parameter, only considered when the Content-Type header is absent. Requests whose parameter is
+// not a valid media type are rejected with a 400.
+func WithContentTypeParam() Option {
+	return func(p *proxy) {
+		p.contentTypeParam = true
+	}
+}
+
+func (p *proxy) contentTypeFromQuery(next http.Handler) http.Handler {
+	if !p.contentTypeParam {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		if _, ok := query[contentTypeParam]; !ok || request.Header.Get("content-type") != "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		contentType := query.Get(contentTypeParam)
+		if !validMediaType(contentType) {
+			p.writeError(writer, request,
+				httpErrorf(http.StatusBadRequest, "invalid %s parameter %q", contentTypeParam, contentType))
+			return
+		}
+		request.Header.Set("content-type", contentType)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// validMediaType tells whether a content type parses as a type/subtype media type, with optional parameters.
+func validMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	slash := strings.IndexByte(mediaType, '/')
+	return slash > 0 && slash < len(mediaType)-1
+}
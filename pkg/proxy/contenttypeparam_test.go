@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_content_type_param(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithContentTypeParam()(p)
+
+	request, _ := http.NewRequest("POST", "/?content-type=application%2Fjson%3B+charset%3Dutf-8", strings.NewReader(`{}`))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "application/json; charset=utf-8", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_content_type_param_header_precedence(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithContentTypeParam()(p)
+
+	request, _ := http.NewRequest("POST", "/?content-type=application/json", strings.NewReader(`{}`))
+	request.Header.Set("Content-Type", "text/plain")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "text/plain", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_content_type_param_invalid(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithContentTypeParam()(p)
+
+	request, _ := http.NewRequest("POST", "/?content-type=json", strings.NewReader(`{}`))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), `invalid content-type parameter "json"`)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_content_type_param_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/?content-type=application/json", strings.NewReader(`{}`))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "application/octet-stream", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_validMediaType(t *testing.T) {
+	assert.True(t, validMediaType("text/plain"))
+	assert.True(t, validMediaType("application/json; charset=utf-8"))
+	assert.False(t, validMediaType(""))
+	assert.False(t, validMediaType("json"))
+	assert.False(t, validMediaType("/json"))
+	assert.False(t, validMediaType("text/"))
+	assert.False(t, validMediaType("text/plain; charset"))
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// WithRequestDecompression decodes request bodies compressed with gzip, deflate or br, as told by their
+// Content-Encoding header, so that functions get the original body. The header is removed once decoded, and so is
+// the Content-Length as the decoded length isn't known upfront. Malformed bodies are rejected with a 400, other
+// encodings with a 415.
+func WithRequestDecompression() Option {
+	return func(p *proxy) {
+		p.decompressRequests = true
+	}
+}
+
+func (p *proxy) decompressBodies(next http.Handler) http.Handler {
+	if !p.decompressRequests {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		encodings := contentEncodings(request)
+		if len(encodings) == 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		source := &sourceReader{ReadCloser: request.Body}
+		var body io.Reader = source
+		// encodings are listed in the order they were applied
+		for i := len(encodings) - 1; i >= 0; i-- {
+			decoder, err := newDecoder(encodings[i], body)
+			if err != nil {
+				p.writeError(writer, request, source.decodingError(encodings[i], err))
+				return
+			}
+			body = &decodingReader{Reader: decoder, encoding: encodings[i], source: source}
+		}
+		request.Body = readCloser{Reader: body, Closer: request.Body}
+		request.Header.Del("content-encoding")
+		request.Header.Del("content-length")
+		request.ContentLength = -1
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// contentEncodings lists the encodings applied to a request body, identity excepted.
+func contentEncodings(request *http.Request) []string {
+	var encodings []string
+	for _, value := range request.Header["Content-Encoding"] {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+func newDecoder(encoding string, reader io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(reader)
+	case "deflate":
+		return zlib.NewReader(reader)
+	case "br":
+		return brotli.NewReader(reader), nil
+	default:
+		return nil, httpErrorf(http.StatusUnsupportedMediaType, "unsupported content encoding %s", encoding)
+	}
+}
+
+// sourceReader remembers the error reading the encoded body failed with, if any.
+type sourceReader struct {
+	io.ReadCloser
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// decodingError reports a body that can't be decoded as a client error, unless the encoded body itself couldn't be
+// read or its encoding isn't supported.
+func (r *sourceReader) decodingError(encoding string, err error) error {
+	if r.err != nil {
+		return r.err
+	} else if _, ok := err.(*httpError); ok {
+		return err
+	}
+	return httpErrorf(http.StatusBadRequest, "malformed %s request body: %v", encoding, err)
+}
+
+// decodingReader reports decoding failures as client errors, while failures reading the encoded body are returned
+// as is. Once decoded, the rest of the encoded body is read, so that it is read through for checksums to be verified.
+type decodingReader struct {
+	io.Reader
+	encoding string
+	source   *sourceReader
+}
+
+func (r *decodingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		return n, r.source.decodingError(r.encoding, err)
+	} else if err == io.EOF {
+		if _, drainErr := io.Copy(ioutil.Discard, r.source); drainErr != nil {
+			return n, drainErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compress(t *testing.T, payload string, newWriter func(io.Writer) io.WriteCloser) []byte {
+	var compressed bytes.Buffer
+	writer := newWriter(&compressed)
+	_, err := writer.Write([]byte(payload))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return compressed.Bytes()
+}
+
+func brotliWriter(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+func gzipWriter(w io.Writer) io.WriteCloser   { return gzip.NewWriter(w) }
+func zlibWriter(w io.Writer) io.WriteCloser   { return zlib.NewWriter(w) }
+
+func Test_decompress_brotli(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithRequestDecompression()(p)
+
+	body := compress(t, "some compressed body", brotliWriter)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("Content-Encoding", "br")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "some compressed body", string(dataFrame.Payload))
+	assert.Equal(t, "text/plain", dataFrame.ContentType)
+	assert.NotContains(t, dataFrame.Headers, "Content-Encoding")
+	assert.NotContains(t, dataFrame.Headers, "Content-Length")
+}
+
+func Test_decompress_gzip_and_deflate(t *testing.T) {
+	for encoding, newWriter := range map[string]func(io.Writer) io.WriteCloser{"gzip": gzipWriter, "deflate": zlibWriter} {
+		riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+		p := &proxy{riffClient: riffClient}
+		WithRequestDecompression()(p)
+
+		request, _ := http.NewRequest("POST", "/", bytes.NewReader(compress(t, "some compressed body", newWriter)))
+		request.Header.Set("Content-Encoding", encoding)
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusOK, responseRecorder.Code, encoding)
+		assert.Equal(t, "some compressed body", string(inputSignals(invokeClient.Calls)[1].GetData().Payload), encoding)
+	}
+}
+
+func Test_decompress_several_encodings(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithRequestDecompression()(p)
+
+	body := compress(t, string(compress(t, "some compressed body", gzipWriter)), brotliWriter)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Content-Encoding", "gzip, identity, br")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "some compressed body", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_decompress_malformed_brotli(t *testing.T) {
+	// the body is decoded while sent, the failure cancelling the invocation
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithRequestDecompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("not brotli at all"))
+	request.Header.Set("Content-Encoding", "br")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "malformed br request body")
+}
+
+func Test_decompress_malformed_gzip(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithRequestDecompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("not gzip at all"))
+	request.Header.Set("Content-Encoding", "gzip")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "malformed gzip request body")
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_decompress_unsupported_encoding(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithRequestDecompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Content-Encoding", "zstd")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "unsupported content encoding zstd")
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_decompress_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	body := compress(t, "some compressed body", brotliWriter)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	request.Header.Set("Content-Encoding", "br")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, body, dataFrame.Payload)
+	assert.Equal(t, "br", dataFrame.Headers["Content-Encoding"])
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// WithFlowControlWindows sets the initial HTTP/2 flow control windows of the connections to the backends, per stream
+// and per connection, in bytes. Invocations are multiplexed as streams over a single connection per backend, with
+// windows of 64KiB by default that grow dynamically. Larger fixed windows let streams carrying large frames reach a
+// higher throughput, at the expense of memory. Zero keeps the default.
+func WithFlowControlWindows(stream int32, connection int32) Option {
+	return func(p *proxy) {
+		p.streamWindowSize = stream
+		p.connWindowSize = connection
+	}
+}
+
+// dialOptions returns the options used to connect to the backends.
+func (p *proxy) dialOptions() []grpc.DialOption {
+	options := []grpc.DialOption{grpc.WithInsecure()}
+	if p.streamWindowSize > 0 {
+		options = append(options, grpc.WithInitialWindowSize(p.streamWindowSize))
+	}
+	if p.connWindowSize > 0 {
+		options = append(options, grpc.WithInitialConnWindowSize(p.connWindowSize))
+	}
+	return options
+}
+
+// WithCompression compresses the messages sent to the backends with gzip, trading CPU for bandwidth on large frames.
+// Backends reporting they can't decompress such messages get uncompressed ones from then on.
+func WithCompression() Option {
+	return func(p *proxy) {
+		p.compress = true
+	}
+}
+
+// callOptions returns the options of an invocation of the given backend.
+func (p *proxy) callOptions(backend *backend) []grpc.CallOption {
+	if !p.compress {
+		return nil
+	} else if _, rejected := p.uncompressed.Load(backend.Target); rejected {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(gzip.Name)}
+}
+
+// compressionRejected stops compressing the messages sent to a backend once an invocation failed because it can't
+// decompress them.
+func (p *proxy) compressionRejected(backend *backend, err error) {
+	if !p.compress {
+		return
+	}
+	grpcError, ok := status.FromError(err)
+	if ok && grpcError.Code() == codes.Unimplemented &&
+		strings.Contains(strings.ToLower(grpcError.Message()), "compress") {
+		p.uncompressed.Store(backend.Target, true)
+	}
+}
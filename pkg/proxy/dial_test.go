@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_dialOptions_default(t *testing.T) {
+	p := &proxy{}
+
+	assert.Len(t, p.dialOptions(), 1)
+}
+
+func Test_dialOptions_flow_control_windows(t *testing.T) {
+	p := &proxy{}
+	WithFlowControlWindows(1<<20, 1<<24)(p)
+
+	assert.Equal(t, int32(1<<20), p.streamWindowSize)
+	assert.Equal(t, int32(1<<24), p.connWindowSize)
+	options := p.dialOptions()
+	assert.Len(t, options, 3)
+
+	conn, err := grpc.Dial("localhost:0", options...)
+	if assert.NoError(t, err) {
+		_ = conn.Close()
+	}
+}
+
+func Test_dialOptions_stream_window_only(t *testing.T) {
+	p := &proxy{}
+	WithFlowControlWindows(1<<20, 0)(p)
+
+	assert.Len(t, p.dialOptions(), 2)
+}
+
+func Test_compression_call_option(t *testing.T) {
+	_, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything, mock.Anything).Return(invokeClient, nil)
+	p := &proxy{riffClient: riffClient}
+	WithCompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, grpc.UseCompressor(gzip.Name), riffClient.Calls[0].Arguments.Get(1))
+}
+
+func Test_compression_disabled(t *testing.T) {
+	p := &proxy{}
+
+	assert.Empty(t, p.callOptions(&backend{}))
+}
+
+func Test_compression_rejected_by_backend(t *testing.T) {
+	_, invokeClient := mockRiffClientWithError(codes.Unimplemented,
+		`grpc: Decompressor is not installed for grpc-encoding "gzip"`)
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything, mock.Anything).Return(invokeClient, nil)
+	p := &proxy{riffClient: riffClient, grpcAddress: "localhost:8081"}
+	WithCompression()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	assert.Empty(t, p.callOptions(p.resolve("/").backends[0]))
+}
+
+func Test_compression_other_errors(t *testing.T) {
+	p := &proxy{grpcAddress: "localhost:8081"}
+	WithCompression()(p)
+	backend := p.resolve("/").backends[0]
+
+	p.compressionRejected(backend, status.Error(codes.Unimplemented, "unknown method Invoke"))
+	p.compressionRejected(backend, status.Error(codes.Internal, "compression failed"))
+
+	assert.NotEmpty(t, p.callOptions(backend))
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxDrainBytes bounds what is left of HTTP/2 request bodies that is read and discarded once the function completed,
+// in line with what HTTP/1.x servers discard on their own.
+const maxDrainBytes = 256 << 10
+
+// drainBody reads and discards what is left of an HTTP/2 request body once the function completed without consuming
+// all its input, so that the stream ends cleanly rather than being reset while the client is still sending. Bodies
+// with more than maxDrainBytes left, or exceeding the input limit along the way, are left unread, for the server to
+// reset the stream instead. HTTP/1.x servers drain bodies themselves once the handler returned, hence are left alone.
+func drainBody(request *http.Request) {
+	if request.ProtoMajor < 2 {
+		return
+	}
+	_, _ = io.CopyN(ioutil.Discard, request.Body, maxDrainBytes)
+}
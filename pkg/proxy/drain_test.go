@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockRiffClientCompletingEarly returns a client whose invocation completes with the given output right away, the
+// stream being over by the time input is sent.
+func mockRiffClientCompletingEarly(outputBody string) (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.MatchedBy(isStartSignal)).Return(nil)
+	invokeClient.On("Send", mock.MatchedBy(isDataSignal)).Return(io.EOF)
+	invokeClient.On("Recv").Return(outputSignal(outputBody, "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	return riffClient, invokeClient
+}
+
+// postCounting posts the body, of unknown length, to the handler served by a real server, over HTTP/2 when http2 is
+// set. It returns the response body along with a function telling how many bytes of the request body were read.
+func postCounting(t *testing.T, handler http.Handler, http2 bool, body []byte) (*http.Response, string, func() int64) {
+	counted := make(chan *countingBody, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		counting := &countingBody{Reader: request.Body}
+		request.Body = ioutil.NopCloser(counting)
+		counted <- counting
+		handler.ServeHTTP(writer, request)
+	}))
+	if http2 {
+		server.TLS = &tls.Config{NextProtos: []string{"h2"}}
+		server.StartTLS()
+		server.Client().Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	} else {
+		server.Start()
+	}
+	defer server.Close()
+
+	response, err := server.Client().Post(server.URL, "text/plain", ioutil.NopCloser(bytes.NewReader(body)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	if http2 {
+		assert.Equal(t, 2, response.ProtoMajor)
+	} else {
+		assert.Equal(t, 1, response.ProtoMajor)
+	}
+	counting := <-counted
+	return response, string(responseBody), func() int64 {
+		return atomic.LoadInt64(&counting.read)
+	}
+}
+
+func Test_drain_body_on_early_completion(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientCompletingEarly("done")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	body := bytes.Repeat([]byte("x"), 3*inputChunkSize)
+	response, responseBody, read := postCounting(t, http.HandlerFunc(p.invokeGrpc), true, body)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "done", responseBody)
+	assert.Len(t, inputSignals(invokeClient.Calls), 2)
+	assert.Equal(t, int64(len(body)), read())
+}
+
+func Test_drain_body_on_early_completion_coalescing(t *testing.T) {
+	riffClient, _ := mockRiffClientCompletingEarly("done")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(16)(p)
+	WithInputCoalescing(64, time.Millisecond)(p)
+
+	body := bytes.Repeat([]byte("x"), 64*1024)
+	response, responseBody, read := postCounting(t, http.HandlerFunc(p.invokeGrpc), true, body)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "done", responseBody)
+	// the body may still be read in the background by the time the response is over
+	assert.Eventually(t, func() bool {
+		return read() == int64(len(body))
+	}, time.Second, time.Millisecond)
+}
+
+func Test_drain_body_too_large_left_unread(t *testing.T) {
+	riffClient, _ := mockRiffClientCompletingEarly("done")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	body := bytes.Repeat([]byte("x"), inputChunkSize+maxDrainBytes+10)
+	response, responseBody, read := postCounting(t, http.HandlerFunc(p.invokeGrpc), true, body)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "done", responseBody)
+	assert.Equal(t, int64(inputChunkSize+maxDrainBytes), read())
+}
+
+func Test_drain_body_within_input_limit(t *testing.T) {
+	riffClient, _ := mockRiffClientCompletingEarly("done")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+	WithMaxInputBytes(2 * inputChunkSize)(p)
+
+	body := bytes.Repeat([]byte("x"), 4*inputChunkSize)
+	response, responseBody, read := postCounting(t, p.handler(), true, body)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "done", responseBody)
+	assert.True(t, read() < int64(len(body)))
+}
+
+func Test_drain_body_left_to_http1_server(t *testing.T) {
+	riffClient, _ := mockRiffClientCompletingEarly("done")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+
+	body := bytes.Repeat([]byte("x"), 3*inputChunkSize)
+	response, responseBody, read := postCounting(t, http.HandlerFunc(p.invokeGrpc), false, body)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "done", responseBody)
+	assert.Equal(t, int64(inputChunkSize), read())
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// backendDurationHeader is the output frame header functions may use to tell their processing time, in
+	// milliseconds. Like other frame headers, it is copied to the response.
+	backendDurationHeader = "X-Riff-Backend-Duration"
+	// totalDurationHeader is the response header telling the time elapsed from the start of the invocation until
+	// the response started, in milliseconds.
+	totalDurationHeader = "X-Riff-Total-Duration"
+)
+
+// WithDurationHeaders adds a X-Riff-Total-Duration header to responses, telling how long the invocation took to start
+// the response, in milliseconds. Compared to the X-Riff-Backend-Duration header a function may set on its output, this
+// helps attributing latency.
+func WithDurationHeaders() Option {
+	return func(p *proxy) {
+		p.durationHeaders = true
+	}
+}
+
+// formatMillis formats a duration as a number of milliseconds, with microsecond precision.
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_duration_headers(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(&rpc.OutputSignal{
+		Frame: &rpc.OutputSignal_Data{
+			Data: &rpc.OutputFrame{
+				Payload:     []byte("ok"),
+				ContentType: "text/plain",
+				Headers:     map[string]string{backendDurationHeader: "12.5"},
+			},
+		},
+	})
+	p := &proxy{riffClient: riffClient}
+	WithDurationHeaders()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "12.5", responseRecorder.Header().Get("X-Riff-Backend-Duration"))
+	total, err := strconv.ParseFloat(responseRecorder.Header().Get("X-Riff-Total-Duration"), 64)
+	assert.NoError(t, err)
+	assert.True(t, total >= 0)
+}
+
+func Test_duration_headers_disabled_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Total-Duration"))
+}
+
+func Test_formatMillis(t *testing.T) {
+	assert.Equal(t, "1500.000", formatMillis(1500*time.Millisecond))
+	assert.Equal(t, "0.042", formatMillis(42*time.Microsecond))
+}
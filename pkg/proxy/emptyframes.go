@@ -0,0 +1,46 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+)
+
+// EmptyFrames tells how zero-length output frames are handled in streamed responses. Buffered responses are made of a
+// single frame, which is written whatever its length.
+type EmptyFrames string
+
+const (
+	// EmptyFramesWrite writes zero-length frames like any other, flushing the response. With newline delimited JSON
+	// output, each one becomes a blank line the client may take as a heartbeat
+	EmptyFramesWrite EmptyFrames = "write"
+	// EmptyFramesSkip ignores zero-length frames once the response is committed
+	EmptyFramesSkip EmptyFrames = "skip"
+)
+
+// WithEmptyFrames sets how zero-length output frames are handled in streamed responses, written by default. Frames
+// received before the response is committed are always kept, as they may carry its status and headers.
+func WithEmptyFrames(policy EmptyFrames) Option {
+	return func(p *proxy) {
+		p.emptyFrames = policy
+	}
+}
+
+// skippedOutput tells whether an output frame is left out of a streamed response.
+func (p *proxy) skippedOutput(response *responseWriter, frame *rpc.OutputFrame) bool {
+	return p.emptyFrames == EmptyFramesSkip && response.committed && len(frame.Payload) == 0
+}
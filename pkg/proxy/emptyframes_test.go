@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_empty_frames_written_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal(`{"n": 1}`, "application/json"),
+		outputSignal("", "application/json"),
+		outputSignal(`{"n": 2}`, "application/json"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(false)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/x-ndjson")
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, []string{"{\"n\": 1}\n", "\n", "{\"n\": 2}\n"}, responseRecorder.flushes)
+}
+
+func Test_empty_frames_skipped(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal(`{"n": 1}`, "application/json"),
+		outputSignal("", "application/json"),
+		outputSignal(`{"n": 2}`, "application/json"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(true)(p)
+	WithEmptyFrames(EmptyFramesSkip)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/x-ndjson")
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, []string{"{\"n\": 1}\n", "{\"n\": 2}\n"}, responseRecorder.flushes)
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Error"))
+}
+
+func Test_empty_frames_skipped_keeps_headers_frame(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		metadataSignal(map[string]string{"X-Riff-Status": "202", "Content-Type": "text/plain"}),
+		outputSignal("", "text/plain"),
+		outputSignal("done", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithEmptyFrames(EmptyFramesSkip)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusAccepted, responseRecorder.Code)
+	assert.Equal(t, []string{"done"}, responseRecorder.flushes)
+}
+
+func Test_empty_frames_buffered(t *testing.T) {
+	for _, policy := range []EmptyFrames{EmptyFramesWrite, EmptyFramesSkip} {
+		t.Run(string(policy), func(t *testing.T) {
+			riffClient, _ := mockRiffClientWithResponse("", "text/plain")
+			p := &proxy{riffClient: riffClient}
+			WithEmptyFrames(policy)(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, "0", responseRecorder.Header().Get("Content-Length"))
+			assert.Empty(t, responseRecorder.Body.String())
+		})
+	}
+}
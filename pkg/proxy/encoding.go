@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/base64"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"net/http"
+	"strings"
+)
+
+// encodingHeader is the frame header telling how the frame payload is encoded.
+const encodingHeader = "X-Riff-Encoding"
+
+// WithInputEncoding encodes request bodies before handing them to the function, for backends that only handle
+// text. The only supported encoding is base64. The encoding is advertised by the X-Riff-Encoding frame header.
+func WithInputEncoding(encoding string) Option {
+	return func(p *proxy) {
+		p.inputEncoding = strings.ToLower(encoding)
+	}
+}
+
+// encodeInputFrame encodes the payload of an input frame as configured.
+func (p *proxy) encodeInputFrame(frame *rpc.InputFrame) {
+	if p.inputEncoding != "base64" {
+		return
+	}
+	frame.Payload = []byte(base64.StdEncoding.EncodeToString(frame.Payload))
+	if frame.Headers == nil {
+		frame.Headers = make(map[string]string, 1)
+	}
+	frame.Headers[encodingHeader] = p.inputEncoding
+}
+
+// decodeOutputFrame decodes the payload of an output frame carrying an X-Riff-Encoding header, so that the binary
+// content is delivered to the client. The frame content type is the one of the decoded payload.
+func decodeOutputFrame(frame *rpc.OutputFrame) error {
+	key, encoding := frameHeader(frame.Headers, encodingHeader)
+	if key == "" {
+		return nil
+	}
+	switch strings.ToLower(encoding) {
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(string(frame.Payload))
+		if err != nil {
+			return httpErrorf(http.StatusBadGateway, "invalid base64 output: %v", err)
+		}
+		frame.Payload = decoded
+	default:
+		return httpErrorf(http.StatusBadGateway, "unsupported output encoding %q", encoding)
+	}
+	delete(frame.Headers, key)
+	return nil
+}
+
+// frameHeader looks up a frame header case insensitively, returning the actual key and the value. The key is empty
+// when the header is absent.
+func frameHeader(headers map[string]string, name string) (string, string) {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return k, v
+		}
+	}
+	return "", ""
+}
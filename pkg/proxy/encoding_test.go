@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a 1x1 transparent png
+var pixel = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4,
+	0x89, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x00, 0x01, 0x00, 0x00,
+	0x05, 0x00, 0x01, 0x0d, 0x0a, 0x2d, 0xb4, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae,
+	0x42, 0x60, 0x82,
+}
+
+func Test_output_base64_decoded(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(&rpc.OutputSignal{
+		Frame: &rpc.OutputSignal_Data{
+			Data: &rpc.OutputFrame{
+				Payload:     []byte(base64.StdEncoding.EncodeToString(pixel)),
+				ContentType: "image/png",
+				Headers:     map[string]string{"x-riff-encoding": "base64"},
+			},
+		},
+	})
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, pixel, responseRecorder.Body.Bytes())
+	assert.Equal(t, "image/png", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "67", responseRecorder.Header().Get("Content-Length"))
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Encoding"))
+}
+
+func Test_output_invalid_base64(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(&rpc.OutputSignal{
+		Frame: &rpc.OutputSignal_Data{
+			Data: &rpc.OutputFrame{
+				Payload:     []byte("not base64!"),
+				ContentType: "image/png",
+				Headers:     map[string]string{"X-Riff-Encoding": "base64"},
+			},
+		},
+	})
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+}
+
+func Test_output_invalid_base64_streamed(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("first frame", "text/plain"),
+		&rpc.OutputSignal{
+			Frame: &rpc.OutputSignal_Data{
+				Data: &rpc.OutputFrame{
+					Payload:     []byte("not base64!"),
+					ContentType: "text/plain",
+					Headers:     map[string]string{"X-Riff-Encoding": "base64"},
+				},
+			},
+		},
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "first frame", responseRecorder.Body.String())
+	assert.Contains(t, responseRecorder.Result().Trailer.Get("X-Riff-Error"), "base64")
+}
+
+func Test_input_base64_encoded(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputEncoding("base64")(p)
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(pixel))
+	request.Header.Set("Content-Type", "image/png")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, base64.StdEncoding.EncodeToString(pixel), string(dataFrame.Payload))
+	assert.Equal(t, "image/png", dataFrame.ContentType)
+	assert.Equal(t, "base64", dataFrame.Headers["X-Riff-Encoding"])
+}
+
+func Test_input_not_encoded_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(pixel))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, pixel, dataFrame.Payload)
+	assert.NotContains(t, dataFrame.Headers, "X-Riff-Encoding")
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// cachedErrorHeader marks error responses served from the error cache, without invoking the backend
+	cachedErrorHeader = "X-Riff-Cached-Error"
+
+	// maxErrorCacheTTL bounds how long errors are cached, so that a backend recovering is noticed right away
+	maxErrorCacheTTL = 500 * time.Millisecond
+	// defaultErrorCacheSize bounds the number of errors cached. When full, errors are not cached until some expire.
+	defaultErrorCacheSize = 1000
+)
+
+// WithErrorCaching answers requests with the transient error the backend failed an identical request with, for the
+// given time, so that a burst of requests doesn't all hit a failing backend. Requests are identical when of the same
+// method and URL and served by the same backend, whatever their body. The time is capped to 500ms. Only transient
+// backend failures (gRPC statuses Unavailable, ResourceExhausted and Aborted) are cached, never errors answered with a
+// 4xx.
+func WithErrorCaching(ttl time.Duration) Option {
+	return func(p *proxy) {
+		if ttl > maxErrorCacheTTL {
+			ttl = maxErrorCacheTTL
+		}
+		if ttl > 0 {
+			p.failures = newErrorCache(ttl, defaultErrorCacheSize)
+		}
+	}
+}
+
+// errorCacheKey identifies identical requests to a backend.
+func errorCacheKey(request *http.Request, backend *backend) string {
+	return backend.Target + " " + request.Method + " " + request.URL.RequestURI()
+}
+
+// isTransientFailure tells whether an invocation error is a backend failure worth caching briefly.
+func isTransientFailure(err error) bool {
+	grpcError, ok := status.FromError(err)
+	if !ok || newErrorPage(err).Status < http.StatusInternalServerError {
+		return false
+	}
+	switch grpcError.Code() {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// errorCache remembers the errors of requests for a time to live.
+type errorCache struct {
+	ttl      time.Duration
+	capacity int
+
+	mutex   sync.Mutex
+	entries map[string]cachedError
+}
+
+type cachedError struct {
+	err     error
+	expires time.Time
+}
+
+func newErrorCache(ttl time.Duration, capacity int) *errorCache {
+	return &errorCache{
+		ttl:      ttl,
+		capacity: capacity,
+		entries:  make(map[string]cachedError),
+	}
+}
+
+// lookup returns the error cached for a key, if any and still alive.
+func (c *errorCache) lookup(key string, now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	} else if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.err
+}
+
+// record caches the error of a request, if transient.
+func (c *errorCache) record(key string, err error, now time.Time) {
+	if c == nil || !isTransientFailure(err) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= c.capacity {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.capacity {
+			return
+		}
+	}
+	c.entries[key] = cachedError{err: err, expires: now.Add(c.ttl)}
+}
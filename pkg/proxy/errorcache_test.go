@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_error_caching_serves_cached_error(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend down")
+	p := &proxy{riffClient: riffClient}
+	WithErrorCaching(time.Minute)(p)
+
+	first := invokeErrorCaching(p, "/")
+	second := invokeErrorCaching(p, "/")
+
+	assert.Equal(t, http.StatusServiceUnavailable, first.Code)
+	assert.Empty(t, first.Header().Get("X-Riff-Cached-Error"))
+	assert.Equal(t, http.StatusServiceUnavailable, second.Code)
+	assert.Equal(t, "true", second.Header().Get("X-Riff-Cached-Error"))
+	assert.Contains(t, second.Body.String(), "backend down")
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+func Test_error_caching_expires(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend down")
+	p := &proxy{riffClient: riffClient}
+	WithErrorCaching(10 * time.Millisecond)(p)
+
+	invokeErrorCaching(p, "/")
+	time.Sleep(20 * time.Millisecond)
+	response := invokeErrorCaching(p, "/")
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Empty(t, response.Header().Get("X-Riff-Cached-Error"))
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_error_caching_skips_client_errors(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.FailedPrecondition, "bad input")
+	p := &proxy{riffClient: riffClient}
+	WithErrorCaching(time.Minute)(p)
+
+	invokeErrorCaching(p, "/")
+	response := invokeErrorCaching(p, "/")
+
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Empty(t, response.Header().Get("X-Riff-Cached-Error"))
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_error_caching_skips_permanent_errors(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Internal, "bug")
+	p := &proxy{riffClient: riffClient}
+	WithErrorCaching(time.Minute)(p)
+
+	invokeErrorCaching(p, "/")
+	invokeErrorCaching(p, "/")
+
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_error_caching_by_url(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend down")
+	p := &proxy{riffClient: riffClient}
+	WithErrorCaching(time.Minute)(p)
+
+	invokeErrorCaching(p, "/?n=1")
+	response := invokeErrorCaching(p, "/?n=2")
+
+	assert.Empty(t, response.Header().Get("X-Riff-Cached-Error"))
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_error_caching_ttl_capped(t *testing.T) {
+	p := &proxy{}
+	WithErrorCaching(time.Minute)(p)
+
+	assert.Equal(t, 500*time.Millisecond, p.failures.ttl)
+}
+
+func Test_errorCache_full(t *testing.T) {
+	cache := newErrorCache(time.Second, 1)
+	now := time.Now()
+	err := status.Error(codes.Unavailable, "down")
+
+	cache.record("a", err, now)
+	cache.record("b", err, now)
+	assert.Equal(t, err, cache.lookup("a", now))
+	assert.Nil(t, cache.lookup("b", now), "errors should not be cached once full")
+
+	cache.record("b", err, now.Add(time.Second))
+	assert.Equal(t, err, cache.lookup("b", now.Add(time.Second)), "expired errors should make room")
+}
+
+func Test_error_caching_leaves_breaker_alone(t *testing.T) {
+	_, failingClient := mockRiffClientWithError(codes.Unavailable, "backend down")
+	_, recoveredClient := mockRiffClientWithResponse("ok", "text/plain")
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything).Return(failingClient, nil).Once()
+	riffClient.On("Invoke", mock.Anything).Return(recoveredClient, nil).Once()
+	now := time.Now()
+	p := &proxy{riffClient: riffClient}
+	p.breakers = newCircuitBreakers(1, time.Minute, func() time.Time { return now })
+	WithErrorCaching(20 * time.Millisecond)(p)
+
+	invokeErrorCaching(p, "/")
+	now = now.Add(time.Minute)
+	cached := invokeErrorCaching(p, "/")
+	time.Sleep(30 * time.Millisecond)
+	probe := invokeErrorCaching(p, "/")
+
+	assert.Equal(t, "true", cached.Header().Get("X-Riff-Cached-Error"))
+	assert.Equal(t, http.StatusOK, probe.Code, "the breaker should let a probe through once the cached error expired")
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func invokeErrorCaching(p *proxy, url string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", url, strings.NewReader("hello"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+	return responseRecorder
+}
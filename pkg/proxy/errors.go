@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcCodeHeader tells the name of the gRPC status code of error responses, e.g. INVALID_ARGUMENT, for clients to
+// branch on it without parsing the body.
+const grpcCodeHeader = "X-Riff-Grpc-Code"
+
+// grpcCodeNames are the canonical names of the gRPC status codes, as used across gRPC implementations.
+var grpcCodeNames = map[codes.Code]string{
+	codes.OK:                 "OK",
+	codes.Canceled:           "CANCELLED",
+	codes.Unknown:            "UNKNOWN",
+	codes.InvalidArgument:    "INVALID_ARGUMENT",
+	codes.DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	codes.NotFound:           "NOT_FOUND",
+	codes.AlreadyExists:      "ALREADY_EXISTS",
+	codes.PermissionDenied:   "PERMISSION_DENIED",
+	codes.ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	codes.FailedPrecondition: "FAILED_PRECONDITION",
+	codes.Aborted:            "ABORTED",
+	codes.OutOfRange:         "OUT_OF_RANGE",
+	codes.Unimplemented:      "UNIMPLEMENTED",
+	codes.Internal:           "INTERNAL",
+	codes.Unavailable:        "UNAVAILABLE",
+	codes.DataLoss:           "DATA_LOSS",
+	codes.Unauthenticated:    "UNAUTHENTICATED",
+}
+
+// httpError is an error that is reported to the client with a specific status code.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// httpErrorf formats an error reported to the client with the given status code.
+func httpErrorf(status int, format string, a ...interface{}) error {
+	return &httpError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+// WithErrorTemplate renders error responses with the given html template for clients accepting text/html. The
+// template is executed with an errorPage.
+func WithErrorTemplate(t *template.Template) Option {
+	return func(p *proxy) {
+		p.errorTemplate = t
+	}
+}
+
+// errorPage holds the values available to error templates.
+type errorPage struct {
+	// Status is the http status code
+	Status int
+	// StatusText is the standard description of the http status code
+	StatusText string
+	// Code is the canonical name of the gRPC status code (e.g. UNAVAILABLE), as in the X-Riff-Grpc-Code header, if the
+	// error came from the backend
+	Code string
+	// Message describes the error
+	Message string
+	// RequestID identifies the request, if request ids are enabled
+	RequestID string
+}
+
+// writeError reports an error to the client, as html when an error template is configured and accepted, as plain
+// text otherwise.
+func (p *proxy) writeError(writer http.ResponseWriter, request *http.Request, err error) {
+	page := newErrorPage(err)
+	page.RequestID = p.requestID(request)
+	p.logError(request, page)
+	writer.Header().Set(grpcCodeHeader, grpcCodeName(err, page.Status))
+	if p.errorTemplate != nil && acceptsHTML(request) {
+		var buffer bytes.Buffer
+		if renderErr := p.errorTemplate.Execute(&buffer, page); renderErr == nil {
+			writer.Header().Set("content-type", "text/html; charset=utf-8")
+			writer.Header().Set("content-length", strconv.Itoa(buffer.Len()))
+			writer.WriteHeader(page.Status)
+			_, _ = buffer.WriteTo(writer)
+			return
+		}
+	}
+	writer.Header().Set("content-type", "text/plain")
+	writer.WriteHeader(page.Status)
+	_, _ = writer.Write([]byte(page.Message))
+	_, _ = writer.Write([]byte("\n"))
+	if page.RequestID != "" {
+		_, _ = writer.Write([]byte("request id: " + page.RequestID + "\n"))
+	}
+}
+
+// writeInvocationError reports a failed invocation, unless the client cancelled the request and is gone already. An
+// expired request deadline is reported as a 504, whatever error the invocation ended with.
+func (p *proxy) writeInvocationError(writer http.ResponseWriter, request *http.Request, err error) {
+	switch request.Context().Err() {
+	case context.Canceled:
+		return
+	case context.DeadlineExceeded:
+		err = httpErrorf(http.StatusGatewayTimeout, "invocation timed out")
+	}
+	p.writeError(writer, request, err)
+}
+
+func newErrorPage(err error) errorPage {
+	page := errorPage{Status: http.StatusInternalServerError, Message: err.Error()}
+	if httpError, ok := err.(*httpError); ok {
+		page.Status = httpError.status
+	} else if grpcError, ok := status.FromError(err); ok {
+		page.Status = httpStatusFromGrpcError(grpcError)
+		page.Code = grpcCodeName(err, page.Status)
+		page.Message = grpcError.Message()
+	}
+	page.StatusText = http.StatusText(page.Status)
+	return page
+}
+
+// grpcCodeName returns the name of the gRPC status code of an error reported with the given http status. Errors that
+// didn't come from the backend get the code matching their http status.
+func grpcCodeName(err error, httpStatus int) string {
+	code := grpcCodeFromHTTPStatus(httpStatus)
+	if _, ok := err.(*httpError); !ok {
+		if grpcError, ok := status.FromError(err); ok {
+			code = grpcError.Code()
+		}
+	}
+	if name, ok := grpcCodeNames[code]; ok {
+		return name
+	}
+	return grpcCodeNames[codes.Unknown]
+}
+
+// grpcCodeFromHTTPStatus returns the gRPC status code closest to an http error status.
+func grpcCodeFromHTTPStatus(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 400 && httpStatus < 500 {
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
+
+// acceptsHTML tells whether the client explicitly accepts html.
+func acceptsHTML(request *http.Request) bool {
+	return accepts(request, "text/html")
+}
+
+// accepts tells whether the client explicitly accepts the given media type.
+func accepts(request *http.Request, mediaType string) bool {
+	for _, mediaRange := range strings.Split(request.Header.Get("accept"), ",") {
+		acceptedType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || acceptedType != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// httpStatusFromGrpcError maps the status of a failed invocation to an http status code. Invalid arguments are
+// only blamed on the client when the invoker could not negotiate content types, as functions report their own
+// failures with that code as well.
+func httpStatusFromGrpcError(grpcError *status.Status) int {
+	switch grpcError.Code() {
+	case codes.InvalidArgument:
+		if strings.HasPrefix(grpcError.Message(), "Invoker: Unsupported Media Type") {
+			return http.StatusUnsupportedMediaType
+		} else if strings.HasPrefix(grpcError.Message(), "Invoker: Not Acceptable") {
+			return http.StatusNotAcceptable
+		}
+		return http.StatusInternalServerError
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errorTemplate = template.Must(template.New("error").Parse(
+	`<html><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Code}}: {{.Message}}</p></html>`))
+
+func Test_error_template_html(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend <down>")
+	p := &proxy{riffClient: riffClient}
+	WithErrorTemplate(errorTemplate)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Equal(t, "text/html; charset=utf-8", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "UNAVAILABLE", responseRecorder.Header().Get("X-Riff-Grpc-Code"))
+	assert.Equal(t, "<html><h1>503 Service Unavailable</h1><p>UNAVAILABLE: backend &lt;down&gt;</p></html>",
+		responseRecorder.Body.String())
+}
+
+func Test_error_template_plain_text(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend down")
+	p := &proxy{riffClient: riffClient}
+	WithErrorTemplate(errorTemplate)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Equal(t, "text/plain", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "backend down\n", responseRecorder.Body.String())
+}
+
+func Test_client_cancellation_not_reported(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Canceled, "context canceled")
+	p := &proxy{riffClient: riffClient}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, _ := http.NewRequestWithContext(ctx, "POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.False(t, responseRecorder.Flushed)
+	assert.Empty(t, responseRecorder.Header().Get("Content-Type"))
+	assert.Empty(t, responseRecorder.Body.String())
+}
+
+func Test_request_deadline_exceeded(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Canceled, "context canceled")
+	p := &proxy{riffClient: riffClient}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusGatewayTimeout, responseRecorder.Code)
+	assert.Equal(t, "invocation timed out\n", responseRecorder.Body.String())
+}
+
+func Test_backend_deadline_exceeded(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.DeadlineExceeded, "deadline exceeded")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusGatewayTimeout, responseRecorder.Code)
+	assert.Equal(t, "deadline exceeded\n", responseRecorder.Body.String())
+}
+
+func Test_grpc_code_header(t *testing.T) {
+	for _, c := range []struct {
+		code   codes.Code
+		status int
+		name   string
+	}{
+		{codes.InvalidArgument, http.StatusInternalServerError, "INVALID_ARGUMENT"},
+		{codes.FailedPrecondition, http.StatusBadRequest, "FAILED_PRECONDITION"},
+		{codes.Unavailable, http.StatusServiceUnavailable, "UNAVAILABLE"},
+		{codes.Unimplemented, http.StatusNotImplemented, "UNIMPLEMENTED"},
+		{codes.PermissionDenied, http.StatusInternalServerError, "PERMISSION_DENIED"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			riffClient, _ := mockRiffClientWithError(c.code, "failed")
+			p := &proxy{riffClient: riffClient}
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, c.status, responseRecorder.Code)
+			assert.Equal(t, c.name, responseRecorder.Header().Get("X-Riff-Grpc-Code"))
+		})
+	}
+}
+
+func Test_grpc_code_header_adapter_errors(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Canceled, "context canceled")
+	p := &proxy{riffClient: riffClient}
+	WithMaxInputBytes(4)(p)
+
+	tooLarge, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	tooLargeResponse := httptest.NewRecorder()
+	p.handler().ServeHTTP(tooLargeResponse, tooLarge)
+	unmatched, _ := http.NewRequest("POST", "/unknown", strings.NewReader(""))
+	unmatchedResponse := httptest.NewRecorder()
+	p.handler().ServeHTTP(unmatchedResponse, unmatched)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	late, _ := http.NewRequestWithContext(ctx, "POST", "/", strings.NewReader(""))
+	lateResponse := httptest.NewRecorder()
+	p.handler().ServeHTTP(lateResponse, late)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, tooLargeResponse.Code)
+	assert.Equal(t, "RESOURCE_EXHAUSTED", tooLargeResponse.Header().Get("X-Riff-Grpc-Code"))
+	assert.Equal(t, http.StatusNotImplemented, unmatchedResponse.Code)
+	assert.Equal(t, "UNIMPLEMENTED", unmatchedResponse.Header().Get("X-Riff-Grpc-Code"))
+	assert.Equal(t, http.StatusGatewayTimeout, lateResponse.Code)
+	assert.Equal(t, "DEADLINE_EXCEEDED", lateResponse.Header().Get("X-Riff-Grpc-Code"))
+}
+
+func Test_grpc_code_trailer(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(outputSignal("partial", "text/plain"))
+	invokeClient.ExpectedCalls = invokeClient.ExpectedCalls[:len(invokeClient.ExpectedCalls)-1]
+	invokeClient.On("Recv").Return(nil, status.Error(codes.DataLoss, "lost"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "lost", responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+	assert.Equal(t, "DATA_LOSS", responseRecorder.Result().Trailer.Get("X-Riff-Grpc-Code"))
+}
+
+func Test_acceptsHTML(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	assert.False(t, acceptsHTML(request))
+
+	request.Header.Set("Accept", "text/html;q=0")
+	assert.False(t, acceptsHTML(request))
+
+	request.Header.Set("Accept", "application/json, text/html;q=0.5")
+	assert.True(t, acceptsHTML(request))
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The http server sends a 100 Continue to clients expecting one when the request body is first read. As the body is
+// only read once the invocation is open and the start frame accepted, clients don't upload bodies to a backend that
+// is down: errors reaching the backend are reported straight away instead. Filters needing the body must thus not
+// read it upfront for such requests.
+
+// expectsContinue tells whether the client waits for a 100 Continue before sending the request body.
+func expectsContinue(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Expect"), "100-continue")
+}
+
+// checkBody runs check against the request body before handing the request to next, reporting the error returned by
+// check otherwise. For requests expecting a 100 Continue, the check is deferred until the body is read, failing the
+// read (and thus the invocation) instead.
+func (p *proxy) checkBody(writer http.ResponseWriter, request *http.Request, next http.Handler,
+	check func(body []byte) error) {
+	if expectsContinue(request) {
+		request.Body = &checkedBody{ReadCloser: request.Body, check: check}
+		next.ServeHTTP(writer, request)
+		return
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = check(body)
+	}
+	if err != nil {
+		p.writeError(writer, request, err)
+		return
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	next.ServeHTTP(writer, request)
+}
+
+// checkedBody reads the whole body on the first read, failing that read and the following ones if it doesn't pass
+// the check.
+type checkedBody struct {
+	io.ReadCloser
+	check  func(body []byte) error
+	reader io.Reader
+	err    error
+}
+
+func (b *checkedBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		body, err := ioutil.ReadAll(b.ReadCloser)
+		if err == nil {
+			err = b.check(body)
+		}
+		b.reader, b.err = bytes.NewReader(body), err
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.reader.Read(p)
+}
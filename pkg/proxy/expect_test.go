@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_continue_withheld_when_backend_down(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything).Return(nil, status.Error(codes.Unavailable, "connection refused"))
+	p := &proxy{riffClient: riffClient}
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	conn, reader := sendExpectContinue(t, server)
+	defer conn.Close()
+
+	response, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+}
+
+func Test_continue_sent_when_backend_ready(t *testing.T) {
+	// the function answers once its input is complete
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	closed := make(chan struct{})
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(closed) }).Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) { <-closed }).Return(outputSignal("ok", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	conn, reader := sendExpectContinue(t, server)
+	defer conn.Close()
+
+	status, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", status)
+	_, _ = reader.ReadString('\n')
+	_, _ = fmt.Fprint(conn, "hello")
+	response, err := http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "hello", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_continue_validation_deferred(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithJSONValidation()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": `))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Expect", "100-continue")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, "malformed JSON request body\n", responseRecorder.Body.String())
+}
+
+// sendExpectContinue sends the headers of a request expecting a 100 Continue, holding back its body.
+func sendExpectContinue(t *testing.T, server *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n"+
+		"Expect: 100-continue\r\n\r\n")
+	return conn, bufio.NewReader(conn)
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// WithFallbackAccept retries invocations the function answered with Not Acceptable once, expecting the given media
+// type instead of those the client accepts. Request bodies are kept in memory as they are sent, so that they can be
+// sent again.
+func WithFallbackAccept(accept string) Option {
+	return func(p *proxy) {
+		p.fallbackAccept = accept
+	}
+}
+
+// invokeWithFallback performs the invocation, retrying it with the fallback media type when the function could not
+// produce any of the accepted ones, as long as nothing has been written to the response yet.
+func (p *proxy) invokeWithFallback(writer *responseRecorder, request *http.Request, route *route,
+	backend *backend) error {
+	if p.fallbackAccept == "" || requestedAccept(request) == p.fallbackAccept {
+		return p.invoke(writer, request, route, backend)
+	}
+	var sent bytes.Buffer
+	body := request.Body
+	request.Body = readCloser{Reader: io.TeeReader(body, &sent), Closer: body}
+	err := p.invoke(writer, request, route, backend)
+	if err == nil || writer.status != 0 || newErrorPage(err).Status != http.StatusNotAcceptable {
+		return err
+	}
+
+	retry := request.Clone(request.Context())
+	retry.Header.Set("accept", p.fallbackAccept)
+	retry.Header.Del(acceptOverrideHeader)
+	// whatever was read already is sent again, followed by the rest of the body
+	retry.Body = readCloser{Reader: io.MultiReader(&sent, body), Closer: body}
+	return p.invoke(writer, retry, route, backend)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const notAcceptable = "Invoker: Not Acceptable: unrecognized output #0's content-type text/zglorbf"
+
+func Test_fallback_accept(t *testing.T) {
+	_, rejecting := mockRiffClientWithError(codes.InvalidArgument, notAcceptable)
+	_, accepting := mockRiffClientWithResponse(`{"name":"riff"}`, "application/json")
+	riffClient := &mocks.RiffClient{}
+	riffClient.On("Invoke", mock.Anything).Return(rejecting, nil).Once()
+	riffClient.On("Invoke", mock.Anything).Return(accepting, nil).Once()
+	p := &proxy{riffClient: riffClient}
+	WithFallbackAccept("application/json")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("accept", "text/zglorbf")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, `{"name":"riff"}`, responseRecorder.Body.String())
+	assert.Equal(t, []string{"text/zglorbf"}, inputSignals(rejecting.Calls)[0].GetStart().ExpectedContentTypes)
+	retried := inputSignals(accepting.Calls)
+	assert.Equal(t, []string{"application/json"}, retried[0].GetStart().ExpectedContentTypes)
+	assert.Equal(t, "some body", string(retried[1].GetData().Payload))
+	assert.Equal(t, "text/zglorbf", request.Header.Get("accept"))
+}
+
+func Test_fallback_accept_not_acceptable_either(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithError(codes.InvalidArgument, notAcceptable)
+	p := &proxy{riffClient: riffClient}
+	WithFallbackAccept("application/json")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("accept", "text/zglorbf")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotAcceptable, responseRecorder.Code)
+	assert.Equal(t, notAcceptable+"\n", responseRecorder.Body.String())
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+	assert.Equal(t, "some body", string(inputSignals(invokeClient.Calls)[3].GetData().Payload))
+}
+
+func Test_fallback_accept_other_errors(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "shutting down")
+	p := &proxy{riffClient: riffClient}
+	WithFallbackAccept("application/json")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// forwardedHeadersHeader is the response header listing the names of the request headers forwarded to the function.
+const forwardedHeadersHeader = "X-Riff-Forwarded-Headers"
+
+// WithForwardedHeadersEcho adds a X-Riff-Forwarded-Headers header to responses, listing the names of the headers
+// actually forwarded to the function once middlewares are done with the request. It is meant for debugging, values
+// are left out as they may hold credentials.
+func WithForwardedHeadersEcho() Option {
+	return func(p *proxy) {
+		p.echoForwardedHeaders = true
+	}
+}
+
+// forwardedHeaderNames returns the sorted, comma separated names of the headers input frames carry for a request.
+func forwardedHeaderNames(request *http.Request) string {
+	headers := frameHeaders(request)
+	names := make([]string, 0, len(headers))
+	for h := range headers {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
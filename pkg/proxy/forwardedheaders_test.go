@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_forwarded_headers_echo(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMiddlewares(authenticate)(p)
+	WithForwardedHeadersEcho()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.SetBasicAuth("frank", "secret")
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("X-Custom", "value")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	var forwarded []string
+	for h := range inputSignals(invokeClient.Calls)[1].GetData().Headers {
+		forwarded = append(forwarded, h)
+	}
+	sort.Strings(forwarded)
+	assert.Equal(t, strings.Join(forwarded, ", "), responseRecorder.Header().Get("X-Riff-Forwarded-Headers"))
+	assert.Contains(t, forwarded, "X-Subject")
+}
+
+func Test_forwarded_headers_echo_disabled_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Forwarded-Headers"))
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+)
+
+// HostForwarding tells which header forwards the Host of requests to the function, as net/http takes it out of the
+// request headers.
+type HostForwarding string
+
+const (
+	// HostForwardingForwardedHost forwards the Host in an X-Forwarded-Host header, unless the request already carries
+	// one, as set by a proxy in front of the adapter with the original host
+	HostForwardingForwardedHost HostForwarding = "x-forwarded-host"
+	// HostForwardingRiffHost forwards the Host the adapter received in an X-Riff-Host header, replacing any header of
+	// the same name set by the client
+	HostForwardingRiffHost HostForwarding = "x-riff-host"
+)
+
+// WithHostForwarding forwards the Host of requests to the function in the given header. The Host isn't forwarded by
+// default.
+func WithHostForwarding(forwarding HostForwarding) Option {
+	return func(p *proxy) {
+		p.hostForwarding = forwarding
+	}
+}
+
+func (p *proxy) forwardHost(next http.Handler) http.Handler {
+	if p.hostForwarding == "" {
+		return next
+	}
+	header := http.CanonicalHeaderKey(string(p.hostForwarding))
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Host == "" || (p.hostForwarding == HostForwardingForwardedHost && request.Header.Get(header) != "") {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ctx := ContextWithFrameHeader(request.Context(), header, request.Host)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
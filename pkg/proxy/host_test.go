@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_host_forwarding(t *testing.T) {
+	for _, c := range []struct {
+		forwarding HostForwarding
+		header     string
+		clientSet  string
+		expected   string
+	}{
+		{HostForwardingForwardedHost, "X-Forwarded-Host", "", "function.example.com"},
+		{HostForwardingForwardedHost, "X-Forwarded-Host", "edge.example.com", "edge.example.com"},
+		{HostForwardingRiffHost, "X-Riff-Host", "", "function.example.com"},
+		{HostForwardingRiffHost, "X-Riff-Host", "spoofed.example.com", "function.example.com"},
+	} {
+		t.Run(c.header+" "+c.clientSet, func(t *testing.T) {
+			riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+			p := &proxy{riffClient: riffClient}
+			WithHostForwarding(c.forwarding)(p)
+
+			request, _ := http.NewRequest("POST", "http://function.example.com/", strings.NewReader("some body"))
+			if c.clientSet != "" {
+				request.Header.Set(c.header, c.clientSet)
+			}
+			responseRecorder := httptest.NewRecorder()
+			p.handler().ServeHTTP(responseRecorder, request)
+
+			assert.Equal(t, http.StatusOK, responseRecorder.Code)
+			assert.Equal(t, c.expected, inputSignals(invokeClient.Calls)[1].GetData().Headers[c.header])
+		})
+	}
+}
+
+func Test_host_forwarding_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "http://function.example.com/", strings.NewReader("some body"))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	headers := inputSignals(invokeClient.Calls)[1].GetData().Headers
+	assert.NotContains(t, headers, "X-Forwarded-Host")
+	assert.NotContains(t, headers, "X-Riff-Host")
+	assert.NotContains(t, headers, "Host")
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// replayedHeader marks responses served from the cache
+	replayedHeader = "Idempotent-Replayed"
+
+	// defaultResponseCacheSize bounds the number of responses kept. When full, the oldest responses are forgotten
+	// even if their time to live hasn't elapsed.
+	defaultResponseCacheSize = 1000
+)
+
+// perRequestHeaders describe the handling of a given request rather than its response, and are left out of the
+// responses remembered, for replays to keep those of the retry.
+var perRequestHeaders = []string{requestIDHeader, serverTimingHeader, totalDurationHeader, backendDurationHeader}
+
+// WithIdempotency remembers the successful responses of requests carrying an Idempotency-Key header for the given
+// time, so that retries of such requests get the same response without invoking the function again. Only buffered
+// responses are remembered, by route and client, streamed responses such as server-sent events being left alone, as
+// well as responses that failed once started. Clients are told apart by their Authorization header, or else by their
+// address, so that they never get each other's responses.
+func WithIdempotency(ttl time.Duration) Option {
+	return func(p *proxy) {
+		if ttl > 0 {
+			p.responses = newResponseCache(ttl, defaultResponseCacheSize)
+		}
+	}
+}
+
+func (p *proxy) dedupeRequests(next http.Handler) http.Handler {
+	if p.responses == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get(idempotencyKeyHeader)
+		route := p.resolve(request.URL.Path)
+		if key == "" || request.Method != http.MethodPost || route == nil || p.streamedResponse(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// the same key may well be used for different functions, or by different clients
+		key = route.Prefix + " " + p.idempotencyScope(request) + " " + key
+		cached, found := p.responses.reserve(key, time.Now())
+		if found && cached == nil {
+			p.writeError(writer, request,
+				httpErrorf(http.StatusConflict, "a request with the same %s is in progress", idempotencyKeyHeader))
+			return
+		} else if found {
+			cached.write(writer)
+			return
+		}
+
+		capture := &capturingWriter{ResponseWriter: writer}
+		next.ServeHTTP(capture, request)
+		// a response that started well may still have failed along the way, as told by the error trailer
+		failed := writer.Header().Get(http.TrailerPrefix+errorTrailer) != ""
+		if capture.status >= 200 && capture.status < 300 && !failed {
+			header := capture.header
+			for _, h := range perRequestHeaders {
+				header.Del(h)
+			}
+			p.responses.store(key, &cachedResponse{
+				status: capture.status,
+				header: header,
+				body:   capture.body.Bytes(),
+			})
+		} else {
+			p.responses.release(key)
+		}
+	})
+}
+
+// idempotencyScope identifies the client of a request, by a digest of its credentials when it has any, by its address
+// otherwise.
+func (p *proxy) idempotencyScope(request *http.Request) string {
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		digest := sha256.Sum256([]byte(authorization))
+		return hex.EncodeToString(digest[:])
+	}
+	return p.clientIP(request)
+}
+
+// streamedResponse tells whether the response to a request is to be streamed, such as server-sent events, rather than
+// written at once.
+func (p *proxy) streamedResponse(request *http.Request) bool {
+	streaming, _ := p.streamingRequested(request)
+	return streaming || p.streamFormatRequested(request) != streamPayloads
+}
+
+// capturingWriter keeps a copy of the response it writes. The headers are copied as the response is committed, before
+// the writers it wraps get to change them, so that a response compressed on its way to the client is remembered with
+// the headers matching its uncompressed body, to be compressed again as replays require.
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *capturingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the writer being captured.
+func (w *capturingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *cachedResponse) write(writer http.ResponseWriter) {
+	for h, v := range r.header {
+		writer.Header()[h] = v
+	}
+	writer.Header().Set(replayedHeader, "true")
+	writer.WriteHeader(r.status)
+	_, _ = writer.Write(r.body)
+}
+
+// responseCache remembers responses by idempotency key for a time to live, evicting the oldest ones once full.
+type responseCache struct {
+	ttl      time.Duration
+	capacity int
+
+	mutex   sync.Mutex
+	order   *list.List // of *responseEntry, most recent first
+	entries map[string]*list.Element
+}
+
+type responseEntry struct {
+	key string
+	at  time.Time
+	// response is nil while the first request is in progress
+	response *cachedResponse
+}
+
+func newResponseCache(ttl time.Duration, capacity int) *responseCache {
+	return &responseCache{
+		ttl:      ttl,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element, capacity),
+	}
+}
+
+// reserve looks up the response for a key, reporting whether the key is known. A known key without a response is
+// in progress. Unknown keys are reserved for the caller to either store a response or release them.
+func (c *responseCache) reserve(key string, now time.Time) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(now)
+	if element, ok := c.entries[key]; ok {
+		return element.Value.(*responseEntry).response, true
+	} else if len(c.entries) >= c.capacity {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&responseEntry{key: key, at: now})
+	return nil, false
+}
+
+// store records the response of a reserved key.
+func (c *responseCache) store(key string, response *cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*responseEntry).response = response
+	}
+}
+
+// release forgets a reserved key, letting the request be retried.
+func (c *responseCache) release(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// expire drops the entries that outlived their time to live. As entries are ordered by time, it stops at the first
+// entry still alive.
+func (c *responseCache) expire(now time.Time) {
+	for element := c.order.Back(); element != nil; element = c.order.Back() {
+		if now.Sub(element.Value.(*responseEntry).at) < c.ttl {
+			return
+		}
+		c.remove(element)
+	}
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*responseEntry).key)
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_idempotency_duplicate_served_from_cache(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("created", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+
+	first := idempotentRequest(p.handler(), "abc")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "created", first.Body.String())
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	duplicate := idempotentRequest(p.handler(), "abc")
+	assert.Equal(t, http.StatusOK, duplicate.Code)
+	assert.Equal(t, "created", duplicate.Body.String())
+	assert.Equal(t, "text/plain", duplicate.Header().Get("Content-Type"))
+	assert.Equal(t, "true", duplicate.Header().Get("Idempotent-Replayed"))
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+func Test_idempotency_distinct_keys(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(2, "created", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+
+	assert.Equal(t, http.StatusOK, idempotentRequest(p.handler(), "abc").Code)
+	assert.Equal(t, http.StatusOK, idempotentRequest(p.handler(), "def").Code)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_idempotency_failure_not_cached(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "connection refused")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+
+	assert.Equal(t, http.StatusServiceUnavailable, idempotentRequest(p.handler(), "abc").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, idempotentRequest(p.handler(), "abc").Code)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_idempotency_failure_once_started_not_cached(t *testing.T) {
+	p := &proxy{}
+	WithIdempotency(time.Hour)(p)
+	calls := 0
+	handler := p.dedupeRequests(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		_, _ = writer.Write([]byte("partial"))
+		setErrorTrailer(writer, errors.New("connection reset"))
+	}))
+
+	first := idempotentRequest(handler, "abc")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "connection reset", first.Result().Trailer.Get("X-Riff-Error"))
+	retry := idempotentRequest(handler, "abc")
+	assert.Empty(t, retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, calls)
+}
+
+func Test_idempotency_streaming_not_cached(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(2, "chunk", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithIdempotency(time.Hour)(p)
+
+	idempotentRequest(p.handler(), "abc")
+	idempotentRequest(p.handler(), "abc")
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_idempotency_event_stream_not_cached(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(2, "tick", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithIdempotency(time.Hour)(p)
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("order"))
+		request.Header.Set("Idempotency-Key", "abc")
+		request.Header.Set("Accept", "text/event-stream")
+		responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, "text/event-stream", responseRecorder.Header().Get("Content-Type"))
+		assert.NotEmpty(t, responseRecorder.flushes, "events should be flushed as they come")
+		assert.Empty(t, responseRecorder.Header().Get("Idempotent-Replayed"))
+	}
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_idempotency_keys_by_route(t *testing.T) {
+	clientA, _ := mockRiffClientWithResponse("from a", "text/plain")
+	clientB, _ := mockRiffClientWithResponse("from b", "text/plain")
+	p := &proxy{}
+	WithIdempotency(time.Hour)(p)
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081"},
+		{Prefix: "/fn/b", Target: "b:8081"},
+	})(p)
+	p.routes[0].backends[0].client = clientA
+	p.routes[1].backends[0].client = clientB
+
+	var bodies []string
+	for _, path := range []string{"/fn/a", "/fn/b", "/fn/a"} {
+		request, _ := http.NewRequest("POST", path, strings.NewReader("order"))
+		request.Header.Set("Idempotency-Key", "abc")
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+		bodies = append(bodies, responseRecorder.Body.String())
+	}
+
+	assert.Equal(t, []string{"from a", "from b", "from a"}, bodies)
+	clientA.AssertNumberOfCalls(t, "Invoke", 1)
+	clientB.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+func Test_idempotency_keys_by_client(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(4, "created", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+
+	post := func(remoteAddr string, authorization string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("order"))
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Idempotency-Key", "abc")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	assert.Empty(t, post("10.0.0.1:1234", "").Header().Get("Idempotent-Replayed"))
+	assert.Empty(t, post("10.0.0.2:1234", "").Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "true", post("10.0.0.1:5678", "").Header().Get("Idempotent-Replayed"))
+	assert.Empty(t, post("10.0.0.1:1234", "Bearer alice").Header().Get("Idempotent-Replayed"))
+	assert.Empty(t, post("10.0.0.1:1234", "Bearer bob").Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "true", post("10.0.0.3:1234", "Bearer alice").Header().Get("Idempotent-Replayed"))
+	riffClient.AssertNumberOfCalls(t, "Invoke", 4)
+}
+
+func Test_idempotency_compressed_per_client(t *testing.T) {
+	body := strings.Repeat("some response ", 100)
+	riffClient, _ := mockRiffClientWithResponse(body, "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+	WithResponseCompression(10)(p)
+
+	post := func(acceptEncoding string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("order"))
+		request.Header.Set("Idempotency-Key", "abc")
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	first := post("gzip")
+	assert.Equal(t, "gzip", first.Header().Get("Content-Encoding"))
+
+	plain := post("")
+	assert.Equal(t, "true", plain.Header().Get("Idempotent-Replayed"))
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, plain.Body.String())
+	assert.Equal(t, []string{"Accept-Encoding"}, plain.Header()["Vary"])
+
+	compressed := post("gzip")
+	assert.Equal(t, "true", compressed.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "gzip", compressed.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(compressed.Body)
+	if assert.NoError(t, err) {
+		decompressed, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, body, string(decompressed))
+	}
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+func Test_flushable_capturing(t *testing.T) {
+	assert.True(t, flushable(&capturingWriter{ResponseWriter: httptest.NewRecorder()}))
+}
+
+func Test_idempotency_replay_keeps_request_headers(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("created", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithIdempotency(time.Hour)(p)
+	WithRequestIDs(log.New(ioutil.Discard, "", 0))(p)
+	WithDurationHeaders()(p)
+	WithServerTiming()(p)
+
+	first := idempotentRequest(p.handler(), "abc")
+	duplicate := idempotentRequest(p.handler(), "abc")
+
+	assert.Equal(t, "true", duplicate.Header().Get("Idempotent-Replayed"))
+	assert.NotEmpty(t, first.Header().Get("X-Request-Id"))
+	assert.NotEmpty(t, duplicate.Header().Get("X-Request-Id"))
+	assert.NotEqual(t, first.Header().Get("X-Request-Id"), duplicate.Header().Get("X-Request-Id"))
+	assert.NotEmpty(t, first.Header().Get("X-Riff-Total-Duration"))
+	assert.Empty(t, duplicate.Header().Get("X-Riff-Total-Duration"))
+	assert.Empty(t, duplicate.Header().Get("X-Riff-Backend-Duration"))
+	assert.Empty(t, duplicate.Header().Get("Server-Timing"))
+}
+
+func Test_idempotency_disabled_by_default(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(2, "created", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	idempotentRequest(p.handler(), "abc")
+	idempotentRequest(p.handler(), "abc")
+	riffClient.AssertNumberOfCalls(t, "Invoke", 2)
+}
+
+func Test_responseCache_in_progress(t *testing.T) {
+	cache := newResponseCache(time.Minute, 10)
+	now := time.Now()
+
+	_, found := cache.reserve("abc", now)
+	assert.False(t, found)
+	response, found := cache.reserve("abc", now)
+	assert.True(t, found)
+	assert.Nil(t, response)
+
+	cache.release("abc")
+	_, found = cache.reserve("abc", now)
+	assert.False(t, found)
+}
+
+func Test_responseCache_expiry(t *testing.T) {
+	cache := newResponseCache(time.Minute, 10)
+	now := time.Now()
+
+	cache.reserve("abc", now)
+	cache.store("abc", &cachedResponse{status: http.StatusOK})
+	response, found := cache.reserve("abc", now.Add(59*time.Second))
+	assert.True(t, found)
+	assert.Equal(t, http.StatusOK, response.status)
+
+	_, found = cache.reserve("abc", now.Add(time.Minute))
+	assert.False(t, found)
+}
+
+func Test_responseCache_capacity(t *testing.T) {
+	cache := newResponseCache(time.Minute, 2)
+	now := time.Now()
+
+	cache.reserve("a", now)
+	cache.reserve("b", now)
+	cache.reserve("c", now)
+	_, found := cache.reserve("a", now)
+	assert.False(t, found, "the oldest key should have been evicted")
+}
+
+func idempotentRequest(handler http.Handler, key string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("order"))
+	request.Header.Set("Idempotency-Key", key)
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	return responseRecorder
+}
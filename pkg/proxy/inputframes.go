@@ -0,0 +1,48 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"net/http"
+)
+
+// WithMaxInputFrames limits the number of data frames a request is sent as, when split by line or in chunks. Going
+// over the limit cancels the invocation, which is answered with a 413 if the response hasn't started yet. This bounds
+// the per frame overhead of bodies made of many tiny lines, which byte limits don't.
+func WithMaxInputFrames(limit int) Option {
+	return func(p *proxy) {
+		p.maxInputFrames = limit
+	}
+}
+
+// limitedFramesClient fails sending more than remaining data frames.
+type limitedFramesClient struct {
+	rpc.Riff_InvokeClient
+	limit     int
+	remaining int
+}
+
+func (c *limitedFramesClient) Send(inputSignal *rpc.InputSignal) error {
+	if inputSignal.GetData() != nil {
+		if c.remaining == 0 {
+			return httpErrorf(http.StatusRequestEntityTooLarge, "request body exceeds %d frames", c.limit)
+		}
+		c.remaining--
+	}
+	return c.Riff_InvokeClient.Send(inputSignal)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_input_frames_limit_lines(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONInput()(p)
+	WithMaxInputFrames(10)(p)
+
+	// many tiny lines, read one byte at a time
+	body := iotest.OneByteReader(strings.NewReader(strings.Repeat("1\n", 1000)))
+	request, _ := http.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, "request body exceeds 10 frames\n", responseRecorder.Body.String())
+	// the start frame, then the data frames up to the limit
+	assert.Len(t, inputSignals(invokeClient.Calls), 11)
+	invokeClient.AssertNotCalled(t, "CloseSend")
+}
+
+func Test_input_frames_limit_chunks(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+	WithMaxInputFrames(2)(p)
+
+	body := bytes.Repeat([]byte("x"), 2*inputChunkSize+1)
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Len(t, inputSignals(invokeClient.Calls), 3)
+}
+
+func Test_input_frames_within_limit(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONInput()(p)
+	WithMaxInputFrames(3)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("1\n2\n3\n"))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Len(t, inputSignals(invokeClient.Calls), 4)
+	invokeClient.AssertCalled(t, "CloseSend")
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// maxInputBytesHeader advertises the limit of request bodies in OPTIONS responses, for clients to size uploads.
+const maxInputBytesHeader = "X-Riff-Max-Input-Bytes"
+
+// WithMaxInputBytes limits the size of request bodies, rejecting larger ones with a 413. Bodies declaring a larger
+// Content-Length are rejected upfront, without invoking the function. Bodies of unknown length, sent with chunked
+// transfer encoding, are counted as they are read and fail as soon as they exceed the limit, also when they are
+// streamed to the function as several frames. The limit is advertised in an X-Riff-Max-Input-Bytes header of OPTIONS
+// responses.
+func WithMaxInputBytes(limit int64) Option {
+	return func(p *proxy) {
+		p.maxInputBytes = limit
+	}
+}
+
+func (p *proxy) limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		limit := p.inputLimit(p.resolve(request.URL.Path))
+		if limit <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if request.ContentLength > limit {
+			p.writeError(writer, request, inputLimitError(limit))
+			return
+		}
+		request.Body = &limitedBody{ReadCloser: request.Body, remaining: limit, err: inputLimitError(limit)}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// inputLimit returns the limit of the request bodies of a route, if any, the one of the adapter unless overridden.
+func (p *proxy) inputLimit(route *route) int64 {
+	if route != nil && route.MaxInputBytes > 0 {
+		return route.MaxInputBytes
+	}
+	return p.current().maxInputBytes
+}
+
+func inputLimitError(limit int64) error {
+	return httpErrorf(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", limit)
+}
+
+// limitedBody fails reads with err once more than remaining bytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining -= int64(n); b.remaining < 0 {
+		// hand over the bytes within the limit, the next read fails
+		return n + int(b.remaining), nil
+	}
+	return n, err
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_input_limit_content_length(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMaxInputBytes(4)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, "request body exceeds 4 bytes\n", responseRecorder.Body.String())
+	riffClient.AssertNotCalled(t, "Invoke")
+}
+
+func Test_input_limit_options(t *testing.T) {
+	p := &proxy{}
+	WithMaxInputBytes(1048576)(p)
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Equal(t, "1048576", responseRecorder.Header().Get("X-Riff-Max-Input-Bytes"))
+}
+
+func Test_input_limit_options_reloaded(t *testing.T) {
+	p := &proxy{}
+	WithMaxInputBytes(1024)(p)
+	assert.NoError(t, p.Reload(WithMaxInputBytes(2048)))
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "2048", responseRecorder.Header().Get("X-Riff-Max-Input-Bytes"))
+}
+
+func Test_input_limit_options_unlimited(t *testing.T) {
+	p := &proxy{}
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Max-Input-Bytes"))
+}
+
+// countingBody counts the bytes read from it.
+type countingBody struct {
+	io.Reader
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	return n, err
+}
+
+func Test_input_limit_content_length_not_uploaded(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMaxInputBytes(1024)(p)
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	body := &countingBody{Reader: bytes.NewReader(make([]byte, 1<<20))}
+	request, _ := http.NewRequest("POST", server.URL, body)
+	request.ContentLength = 1 << 20
+	request.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	response, err := client.Do(request)
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	// the server answered without asking for the body, which was never sent
+	assert.Zero(t, atomic.LoadInt64(&body.read))
+	riffClient.AssertNotCalled(t, "Invoke")
+}
+
+func Test_input_limit_within(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMaxInputBytes(9)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "some body", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_input_limit_chunked_body(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+	WithMaxInputBytes(3 * inputChunkSize)(p)
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	body := bytes.Repeat([]byte("x"), 2*inputChunkSize+10)
+	response, err := http.Post(server.URL, "text/plain", ioutil.NopCloser(bytes.NewReader(body)))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 4)
+	var payload []byte
+	for _, signal := range signals[1:] {
+		payload = append(payload, signal.GetData().Payload...)
+	}
+	assert.Equal(t, body, payload)
+}
+
+func Test_input_limit_chunked_body_exceeded(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithInputChunking(1024)(p)
+	WithMaxInputBytes(inputChunkSize + 10)(p)
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	body := bytes.Repeat([]byte("x"), 3*inputChunkSize)
+	response, err := http.Post(server.URL, "text/plain", ioutil.NopCloser(bytes.NewReader(body)))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(response.Body)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	assert.Equal(t, "request body exceeds 32778 bytes\n", string(message))
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Len(t, signals[1].GetData().Payload, inputChunkSize)
+	invokeClient.AssertNotCalled(t, "CloseSend")
+}
+
+func Test_limited_body(t *testing.T) {
+	source := ioutil.NopCloser(strings.NewReader("0123456789"))
+	body := &limitedBody{ReadCloser: source, remaining: 6, err: io.ErrShortBuffer}
+
+	read, err := ioutil.ReadAll(body)
+
+	assert.Equal(t, "012345", string(read))
+	assert.Equal(t, io.ErrShortBuffer, err)
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+// WithOutputWriteSize writes the payload of output frames larger than size bytes to the response in pieces of that
+// size, flushing each one to the client, rather than in a single write. This avoids the spikes of memory of buffering
+// large frames all at once along the way, down to the connection. Disabled unless size is positive.
+func WithOutputWriteSize(size int) Option {
+	return func(p *proxy) {
+		p.outputWriteSize = size
+	}
+}
+
+// writePayload writes the payload of a frame to the body, in pieces of splitSize bytes flushed one by one when larger
+// than that.
+func (w *responseWriter) writePayload(payload []byte) error {
+	for w.splitSize > 0 && len(payload) > w.splitSize {
+		if _, err := w.out.Write(payload[:w.splitSize]); err != nil {
+			return err
+		}
+		payload = payload[w.splitSize:]
+		w.flush()
+	}
+	_, err := w.out.Write(payload)
+	return err
+}
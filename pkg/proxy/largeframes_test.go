@@ -0,0 +1,68 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_output_write_size_streamed(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("ab", "text/plain"),
+		outputSignal("cdefghij", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithOutputWriteSize(3)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, []string{"ab", "cde", "fgh", "ij"}, responseRecorder.flushes)
+	assert.Equal(t, "abcdefghij", responseRecorder.Body.String())
+}
+
+func Test_output_write_size_buffered(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("abcdefgh", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithOutputWriteSize(3)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "8", responseRecorder.Header().Get("Content-Length"))
+	assert.Equal(t, []string{"abc", "def", "gh"}, responseRecorder.flushes)
+	assert.Equal(t, "abcdefgh", responseRecorder.Body.String())
+}
+
+func Test_output_write_size_disabled(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("abcdefgh", "text/plain"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, []string{"abcdefgh"}, responseRecorder.flushes)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+)
+
+// WithLineBuffering makes streamed text/plain responses only write whole lines, holding the end of a line split
+// across output frames until its newline arrives, for cleaner rendering by clients. Whatever is left once the function
+// completes is written as is. Lines are held in memory, up to the output limit if any.
+func WithLineBuffering() Option {
+	return func(p *proxy) {
+		p.lineBuffering = true
+	}
+}
+
+// lineBuffered tells whether the streamed output of the given content type is to be written line by line.
+func (p *proxy) lineBuffered(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return p.lineBuffering && mediaType == "text/plain"
+}
+
+// lineWriter writes up to the last newline of what it is given, holding the rest until the next newline or flush.
+type lineWriter struct {
+	writer  io.Writer
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	end := bytes.LastIndexByte(p, '\n')
+	if end < 0 {
+		w.partial = append(w.partial, p...)
+		return len(p), nil
+	}
+	if len(w.partial) > 0 {
+		if _, err := w.writer.Write(w.partial); err != nil {
+			return 0, err
+		}
+		w.partial = w.partial[:0]
+	}
+	if _, err := w.writer.Write(p[:end+1]); err != nil {
+		return 0, err
+	}
+	w.partial = append(w.partial, p[end+1:]...)
+	return len(p), nil
+}
+
+// flush writes what is left of the last line.
+func (w *lineWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	_, err := w.writer.Write(w.partial)
+	w.partial = nil
+	return err
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// flushesRecorder records what is written to the response between flushes, as clients see it.
+type flushesRecorder struct {
+	*httptest.ResponseRecorder
+	unflushed string
+	flushes   []string
+}
+
+func (r *flushesRecorder) Write(p []byte) (int, error) {
+	r.unflushed += string(p)
+	return r.ResponseRecorder.Write(p)
+}
+
+func (r *flushesRecorder) Flush() {
+	if r.unflushed != "" {
+		r.flushes = append(r.flushes, r.unflushed)
+		r.unflushed = ""
+	}
+	r.ResponseRecorder.Flush()
+}
+
+func Test_line_buffering(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("first li", "text/plain"),
+		outputSignal("ne\nsecond ", "text/plain"),
+		outputSignal("line\nthird", "text/plain"),
+		outputSignal(" line\nfourth line\nunfinished", "text/plain"),
+		outputSignal(" line", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithLineBuffering()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "first line\nsecond line\nthird line\nfourth line\nunfinished line", responseRecorder.Body.String())
+	assert.Equal(t, []string{"first line\n", "second line\n", "third line\nfourth line\n"}, responseRecorder.flushes)
+	// the end of the response is flushed by the server, once the handler returns
+	assert.Equal(t, "unfinished line", responseRecorder.unflushed)
+}
+
+func Test_line_buffering_read_ahead(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain; charset=utf-8"),
+		outputSignal(",two\nthr", "text/plain; charset=utf-8"),
+		outputSignal("ee\n", "text/plain; charset=utf-8"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithLineBuffering()(p)
+	WithHeaderReadAhead(2)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "one,two\nthree\n", responseRecorder.Body.String())
+	assert.Equal(t, []string{"one,two\n", "three\n"}, responseRecorder.flushes)
+}
+
+func Test_line_buffering_other_types(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("{\"a\":", "application/json"),
+		outputSignal("1}", "application/json"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithLineBuffering()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, []string{"{\"a\":", "1}"}, responseRecorder.flushes)
+}
+
+func Test_line_buffering_disabled(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("first li", "text/plain"),
+		outputSignal("ne\n", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, []string{"first li", "ne\n"}, responseRecorder.flushes)
+}
+
+func Test_line_buffering_backend_error(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Return(outputSignal("whole line\nunfinis", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Internal, "function crashed"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithLineBuffering()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "whole line\nunfinis", responseRecorder.Body.String())
+	assert.Equal(t, "function crashed", responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
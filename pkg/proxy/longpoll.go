@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// waitHeader is the request header telling how many seconds a long poll may wait for output.
+const waitHeader = "X-Riff-Wait"
+
+// WithLongPolling accepts GET requests, which invoke the function without any input and wait for its first output
+// frame. Clients may ask to wait for less than maxWait using the X-Riff-Wait header.
+func WithLongPolling(maxWait time.Duration) Option {
+	return func(p *proxy) {
+		p.longPollWait = maxWait
+	}
+}
+
+// longPoll waits for the first output frame of an input-less invocation, answering with a 204 if none arrives in
+// time. The invocation is cancelled once done with, whatever the outcome.
+func (p *proxy) longPoll(writer http.ResponseWriter, request *http.Request, route *route, backend *backend) error {
+	wait := p.current().longPollWait
+	if value := request.Header.Get(waitHeader); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			return httpErrorf(http.StatusBadRequest, "invalid %s header %q", waitHeader, value)
+		}
+		if requested := time.Duration(seconds * float64(time.Second)); requested < wait {
+			wait = requested
+		}
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	client, err := p.open(ctx, request, route, backend)
+	if err != nil {
+		return err
+	}
+	if err := client.CloseSend(); err != nil {
+		return err
+	}
+
+	type received struct {
+		signal *rpc.OutputSignal
+		err    error
+	}
+	first := make(chan received, 1)
+	go func() {
+		signal, err := client.Recv()
+		first <- received{signal: signal, err: err}
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r := <-first:
+		if r.err != nil {
+			return r.err
+		}
+		frame, err := dataFrame(r.signal)
+		if err != nil {
+			return err
+		}
+		if err := decodeOutputFrame(frame); err != nil {
+			return err
+		}
+		if err := p.newUTF8Validator(true).validate(frame); err != nil {
+			return err
+		}
+		response := &responseWriter{writer: writer, exactLength: true}
+		return response.write(frame)
+	case <-timer.C:
+		p.metrics.cancelled(cancelTimeout)
+		writer.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_longPoll_output_within_window(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("job-1", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithLongPolling(time.Minute)(p)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Riff-Wait", "5")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "job-1", responseRecorder.Body.String())
+	assert.Len(t, inputSignals(invokeClient.Calls), 1, "only the start frame should be sent")
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_longPoll_timeout(t *testing.T) {
+	var ctx context.Context
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	}).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) {
+		<-ctx.Done()
+	}).Return(nil, status.Error(codes.Canceled, "context canceled"))
+	p := &proxy{riffClient: riffClient}
+	WithLongPolling(time.Minute)(p)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Riff-Wait", "0.05")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Empty(t, responseRecorder.Body.String())
+	assert.Error(t, ctx.Err(), "the invocation should have been cancelled")
+}
+
+func Test_longPoll_invalid_wait(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithLongPolling(time.Minute)(p)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Riff-Wait", "soon")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	methodOverrideHeader = "X-HTTP-Method-Override"
+	// methodHeader tells the function the method of an invocation, when overridden
+	methodHeader = "X-Riff-Method"
+)
+
+// WithMethodOverride lets clients tunnel one of the given methods through a POST request, using the
+// X-HTTP-Method-Override header. The function is told the effective method by the X-Riff-Method header.
+func WithMethodOverride(methods []string) Option {
+	return func(p *proxy) {
+		p.overrideMethods = nil
+		for _, m := range methods {
+			p.overrideMethods = append(p.overrideMethods, strings.ToUpper(m))
+		}
+	}
+}
+
+// overrideMethod replaces the method of POST requests carrying an X-HTTP-Method-Override header. It wraps the
+// invocation directly, so that request filters see the request as sent. The X-Riff-Method header of clients is dropped
+// whether overrides are enabled or not, as only the adapter may tell the method to functions.
+func (p *proxy) overrideMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.Header.Del(methodHeader)
+		if len(p.current().overrideMethods) == 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		override := strings.ToUpper(request.Header.Get(methodOverrideHeader))
+		if override == "" || request.Method != http.MethodPost {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if !p.isOverrideMethod(override) {
+			p.writeError(writer, request, httpErrorf(http.StatusBadRequest, "method override %q not allowed", override))
+			return
+		}
+		request.Method = override
+		request.Header.Del(methodOverrideHeader)
+		request.Header.Set(methodHeader, override)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (p *proxy) isOverrideMethod(method string) bool {
+	for _, m := range p.current().overrideMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// overridden tells whether the request method was set by the X-HTTP-Method-Override header.
+func (p *proxy) overridden(request *http.Request) bool {
+	return len(p.current().overrideMethods) > 0 && request.Header.Get(methodHeader) == request.Method
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_method_override(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("deleted", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMethodOverride([]string{"PUT", "delete"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-HTTP-Method-Override", "DELETE")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "DELETE", request.Method)
+	headers := inputSignals(invokeClient.Calls)[1].GetData().Headers
+	assert.Equal(t, "DELETE", headers["X-Riff-Method"])
+	assert.NotContains(t, headers, "X-Http-Method-Override")
+}
+
+func Test_method_override_not_allowed(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMethodOverride([]string{"PUT"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-HTTP-Method-Override", "DELETE")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_method_override_client_method_header_ignored(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMethodOverride([]string{"PUT"})(p)
+
+	request, _ := http.NewRequest("PUT", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Riff-Method", "PUT")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+}
+
+func Test_method_override_disabled_client_method_header_stripped(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Riff-Method", "DELETE")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.NotContains(t, inputSignals(invokeClient.Calls)[1].GetData().Headers, "X-Riff-Method")
+}
+
+func Test_method_override_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-HTTP-Method-Override", "DELETE")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "POST", request.Method)
+	assert.NotContains(t, inputSignals(invokeClient.Calls)[1].GetData().Headers, "X-Riff-Method")
+}
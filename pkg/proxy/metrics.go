@@ -0,0 +1,228 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+const metricsNamespace = "riff_adapter"
+
+// sizeBuckets range from 64B to 16MiB
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+// reasons for an invocation to end early
+const (
+	cancelClientDisconnect = "client-disconnect"
+	cancelTimeout          = "timeout"
+	cancelBackend          = "backend"
+	cancelClientError      = "client-error"
+	cancelError            = "error"
+)
+
+// WithMetrics exposes prometheus metrics about the proxy on the given path.
+func WithMetrics(path string) Option {
+	return func(p *proxy) {
+		p.metrics = newMetrics()
+		p.metricsPath = path
+	}
+}
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	activeStreams    prometheus.Gauge
+	backendConnected prometheus.Gauge
+	cancellations    *prometheus.CounterVec
+	invocations      *prometheus.CounterVec
+	outputFrames     prometheus.Counter
+	sequenceErrors   *prometheus.CounterVec
+	reapedConns      *prometheus.CounterVec
+	requestBytes     prometheus.Histogram
+	responseBytes    prometheus.Histogram
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_streams",
+			Help:      "Number of invocations currently in flight.",
+		}),
+		backendConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_connected",
+			Help:      "Whether the connection to the invoker is ready (1) or not (0).",
+		}),
+		cancellations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_cancellations_total",
+			Help:      "Number of invocations that ended early, by reason.",
+		}, []string{"reason"}),
+		invocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_invocations_total",
+			Help:      "Number of invocations, by backend target.",
+		}, []string{"backend"}),
+		outputFrames: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "output_frames_total",
+			Help:      "Number of output frames received from functions.",
+		}),
+		sequenceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "output_sequence_errors_total",
+			Help:      "Number of streamed outputs whose frames were missing or out of order, by reason.",
+		}, []string{"reason"}),
+		reapedConns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_connections_reaped_total",
+			Help:      "Number of route backend connections closed, by reason.",
+		}, []string{"reason"}),
+		requestBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_bytes",
+			Help:      "Size of the request bodies read, in bytes.",
+			Buckets:   sizeBuckets,
+		}),
+		responseBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_bytes",
+			Help:      "Size of the response bodies written, in bytes.",
+			Buckets:   sizeBuckets,
+		}),
+	}
+	m.registry.MustRegister(m.activeStreams, m.backendConnected, m.cancellations, m.invocations, m.outputFrames,
+		m.sequenceErrors, m.reapedConns, m.requestBytes, m.responseBytes)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// streamStarted accounts for a new invocation, returning a function to call when it ends. A nil metrics ignores
+// everything, as do all its methods.
+func (m *metrics) streamStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.activeStreams.Inc()
+	return m.activeStreams.Dec
+}
+
+func (m *metrics) backendInvoked(target string) {
+	if m == nil {
+		return
+	}
+	m.invocations.WithLabelValues(target).Inc()
+}
+
+func (m *metrics) cancelled(reason string) {
+	if m == nil {
+		return
+	}
+	m.cancellations.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) outputFrameReceived() {
+	if m == nil {
+		return
+	}
+	m.outputFrames.Inc()
+}
+
+func (m *metrics) connectionReaped(reason string) {
+	if m == nil {
+		return
+	}
+	m.reapedConns.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) sequenceBroken(reason string) {
+	if m == nil {
+		return
+	}
+	m.sequenceErrors.WithLabelValues(reason).Inc()
+}
+
+// transferred accounts for the bytes of an invocation's request and response bodies.
+func (m *metrics) transferred(requestBytes int64, responseBytes int64) {
+	if m == nil {
+		return
+	}
+	m.requestBytes.Observe(float64(requestBytes))
+	m.responseBytes.Observe(float64(responseBytes))
+}
+
+// invocationEnded counts the invocation as cancelled if it ended with an error, telling why: the client went away,
+// the request timed out, the backend ended the stream with an error status, the client sent invalid input (e.g. a
+// body over the limit), or the adapter itself gave up on it.
+func (m *metrics) invocationEnded(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	switch {
+	case ctx.Err() == context.Canceled:
+		m.cancelled(cancelClientDisconnect)
+	case ctx.Err() == context.DeadlineExceeded || status.Code(err) == codes.DeadlineExceeded:
+		m.cancelled(cancelTimeout)
+	case endedByBackend(err):
+		m.cancelled(cancelBackend)
+	case clientError(err):
+		m.cancelled(cancelClientError)
+	default:
+		m.cancelled(cancelError)
+	}
+}
+
+// watchConnection keeps the backend connected gauge up to date until the connection is closed.
+func (m *metrics) watchConnection(conn *grpc.ClientConn) {
+	if m == nil {
+		return
+	}
+	for state := conn.GetState(); state != connectivity.Shutdown; state = conn.GetState() {
+		if state == connectivity.Ready {
+			m.backendConnected.Set(1)
+		} else {
+			m.backendConnected.Set(0)
+		}
+		conn.WaitForStateChange(context.Background(), state)
+	}
+	m.backendConnected.Set(0)
+}
+
+// clientError tells whether an invocation error is the client's fault, as reported with a 4xx status.
+func clientError(err error) bool {
+	httpError, ok := err.(*httpError)
+	return ok && httpError.status < http.StatusInternalServerError
+}
+
+// endedByBackend tells whether an invocation error is a status the backend ended the stream with. Cancellations
+// are the adapter's own doing, when it stops an invocation for failing on its side.
+func endedByBackend(err error) bool {
+	grpcError, ok := status.FromError(err)
+	return ok && grpcError.Code() != codes.Canceled
+}
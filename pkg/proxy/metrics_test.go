@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_metrics_active_streams(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{})
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) {
+		close(received)
+		<-release
+	}).Return(outputSignal("ok", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+
+	done := make(chan struct{})
+	go func() {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+		p.invokeGrpc(httptest.NewRecorder(), request)
+		close(done)
+	}()
+
+	<-received
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.activeStreams))
+	close(release)
+	<-done
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.activeStreams))
+}
+
+func Test_metrics_client_disconnect(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Canceled, "context canceled")
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	p.invokeGrpc(httptest.NewRecorder(), request.WithContext(ctx))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("client-disconnect")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("error")))
+}
+
+func Test_metrics_client_disconnect_mid_stream(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+	started := make(chan struct{})
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer close(done)
+		close(started)
+		p.invokeGrpc(writer, request)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader("some body"))
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := http.DefaultClient.Do(request.WithContext(ctx))
+	assert.Error(t, err)
+	<-done
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("client-disconnect")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("backend")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("error")))
+}
+
+func Test_metrics_backend(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Internal, "boom")
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("backend")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("error")))
+}
+
+func Test_metrics_error(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+
+	body, bodyWriter := io.Pipe()
+	_ = bodyWriter.CloseWithError(errors.New("connection reset"))
+	request, _ := http.NewRequest("POST", "/", body)
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("error")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("backend")))
+}
+
+func Test_metrics_client_error(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+	WithInputChunking(1024)(p)
+	WithMaxInputBytes(10)(p)
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(bytes.Repeat([]byte("x"), 2*inputChunkSize)))
+	request.ContentLength = -1
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("client-error")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(p.metrics.cancellations.WithLabelValues("error")))
+}
+
+func Test_metrics_scrape(t *testing.T) {
+	p := &proxy{}
+	WithMetrics("/metrics")(p)
+	p.metrics.backendConnected.Set(1)
+
+	responseRecorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	p.metrics.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Contains(t, responseRecorder.Body.String(), "riff_adapter_backend_connected 1")
+	assert.Contains(t, responseRecorder.Body.String(), "riff_adapter_active_streams 0")
+}
+
+func Test_metrics_bytes_buffered(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMetrics("/metrics")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some request"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	scraped := scrape(p)
+	assert.Contains(t, scraped, "riff_adapter_request_bytes_sum 12")
+	assert.Contains(t, scraped, "riff_adapter_response_bytes_sum 13")
+	assert.Contains(t, scraped, "riff_adapter_response_bytes_count 1")
+}
+
+func Test_metrics_bytes_streamed(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		outputSignal("two,", "text/plain"),
+		outputSignal("three", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithInputChunking(1)(p)
+	WithMetrics("/metrics")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some request"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	scraped := scrape(p)
+	assert.Contains(t, scraped, "riff_adapter_request_bytes_sum 12")
+	assert.Contains(t, scraped, "riff_adapter_response_bytes_sum 13")
+}
+
+func scrape(p *proxy) string {
+	responseRecorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	p.metrics.handler().ServeHTTP(responseRecorder, request)
+	return responseRecorder.Body.String()
+}
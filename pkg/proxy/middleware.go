@@ -0,0 +1,63 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Middleware wraps the handling of requests to the function, for instance to authenticate them.
+type Middleware func(next http.Handler) http.Handler
+
+// WithMiddlewares adds middlewares to the handling of requests to the function, once rate limited and before any
+// other check, the first middleware seeing requests first. Middlewares may pass values they derived from a request
+// to the function with ContextWithFrameHeader.
+func WithMiddlewares(middlewares ...Middleware) Option {
+	return func(p *proxy) {
+		p.middlewares = append(p.middlewares, middlewares...)
+	}
+}
+
+func (p *proxy) applyMiddlewares(next http.Handler) http.Handler {
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		next = p.middlewares[i](next)
+	}
+	return next
+}
+
+// frameHeadersKey is the context key of the headers set on input frames by middlewares.
+type frameHeadersKey struct{}
+
+// ContextWithFrameHeader returns a copy of ctx carrying a header to set on the input frames of the invocation, taking
+// precedence over the request header of the same name. It lets middlewares pass values they derived from the request,
+// such as an authenticated subject or a trace id, to the function without relying on global state.
+func ContextWithFrameHeader(ctx context.Context, name string, value string) context.Context {
+	inherited := frameHeadersFrom(ctx)
+	headers := make(map[string]string, len(inherited)+1)
+	for h, v := range inherited {
+		headers[h] = v
+	}
+	headers[http.CanonicalHeaderKey(name)] = value
+	return context.WithValue(ctx, frameHeadersKey{}, headers)
+}
+
+// frameHeadersFrom returns the headers set on input frames by middlewares, carried by ctx.
+func frameHeadersFrom(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(frameHeadersKey{}).(map[string]string)
+	return headers
+}
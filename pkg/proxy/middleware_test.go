@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// authenticate is an auth middleware passing the subject of the request to the function.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, password, ok := request.BasicAuth()
+		if !ok || password != "secret" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := ContextWithFrameHeader(request.Context(), "x-subject", user)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func Test_middleware_frame_header(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMiddlewares(authenticate)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.SetBasicAuth("frank", "secret")
+	// set by the client, the header is overridden by the middleware
+	request.Header.Set("X-Subject", "admin")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "frank", inputSignals(invokeClient.Calls)[1].GetData().Headers["X-Subject"])
+}
+
+func Test_middleware_rejects(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMiddlewares(authenticate)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusUnauthorized, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_middlewares_order(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	var order []string
+	record := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(writer, request)
+			})
+		}
+	}
+	WithMiddlewares(record("first"), record("second"))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, []string{"first", "second"}, order)
+}
+
+func Test_ContextWithFrameHeader(t *testing.T) {
+	parent := ContextWithFrameHeader(context.Background(), "x-subject", "frank")
+	child := ContextWithFrameHeader(parent, "X-Trace-Id", "abc")
+
+	assert.Equal(t, map[string]string{"X-Subject": "frank"}, frameHeadersFrom(parent))
+	assert.Equal(t, map[string]string{"X-Subject": "frank", "X-Trace-Id": "abc"}, frameHeadersFrom(child))
+	assert.Empty(t, frameHeadersFrom(context.Background()))
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// multipartMixedContentType is the media type of bodies made of independent, ordered parts.
+const multipartMixedContentType = "multipart/mixed"
+
+// defaultPartContentType is the content type of parts that don't tell theirs, see RFC 2046.
+const defaultPartContentType = "text/plain"
+
+// WithMultipartInput splits multipart/mixed request bodies into their parts, sending each one as its own data frame, in
+// order, as soon as it has been read. Only one part is held in memory at a time. Only the first frame carries the
+// request headers.
+func WithMultipartInput() Option {
+	return func(p *proxy) {
+		p.multipartInput = true
+	}
+}
+
+// multipartBoundary returns the boundary of a multipart/mixed content type, or false for other content types.
+func multipartBoundary(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || strings.ToLower(mediaType) != multipartMixedContentType {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// sendParts sends each part of a multipart request body as a data frame, in the order they appear.
+func (p *proxy) sendParts(client rpc.Riff_InvokeClient, request *http.Request, boundary string, argIndex int32) error {
+	if boundary == "" {
+		return httpErrorf(http.StatusBadRequest, "missing multipart boundary")
+	}
+	reader := multipart.NewReader(request.Body, boundary)
+	for first := true; ; first = false {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return httpErrorf(http.StatusBadRequest, "malformed multipart request body: %v", err)
+		}
+		payload, err := ioutil.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return httpErrorf(http.StatusBadRequest, "malformed multipart request body: %v", err)
+		}
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = defaultPartContentType
+		}
+		inputFrame := &rpc.InputFrame{
+			ContentType: contentType,
+			ArgIndex:    argIndex,
+			Payload:     payload,
+		}
+		if first {
+			inputFrame.Headers = frameHeaders(request)
+		}
+		if err := p.sendData(client, inputFrame); err != nil {
+			return err
+		}
+	}
+}
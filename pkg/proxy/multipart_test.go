@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_multipart_input_streams_parts_in_order(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	frames := make(chan *rpc.InputFrame, 1)
+	halfClosed := make(chan struct{})
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		if data := args.Get(0).(*rpc.InputSignal).GetData(); data != nil {
+			frames <- data
+		}
+	}).Return(nil)
+	invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(halfClosed) }).Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) { <-halfClosed }).Return(outputSignal("ok", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	WithMultipartInput()(p)
+
+	body, bodyWriter := io.Pipe()
+	parts := multipart.NewWriter(bodyWriter)
+	request, _ := http.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+	responseRecorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		p.invokeGrpc(responseRecorder, request)
+		close(done)
+	}()
+
+	// each part is sent as soon as the next boundary tells it is over, before the rest of the body is written
+	const count = 8
+	payload := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i)}, 256*1024)
+	}
+	received := func(i int) {
+		select {
+		case frame := <-frames:
+			assert.Equal(t, payload(i), frame.Payload)
+			assert.Equal(t, fmt.Sprintf("text/x-part-%d", i), frame.ContentType)
+			if i == 0 {
+				assert.Equal(t, "multipart/mixed; boundary="+parts.Boundary(), frame.Headers["Content-Type"])
+			} else {
+				assert.Empty(t, frame.Headers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("part %d not sent", i)
+		}
+	}
+	for i := 0; i < count; i++ {
+		part, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {fmt.Sprintf("text/x-part-%d", i)}})
+		if i > 0 {
+			received(i - 1)
+		}
+		_, _ = part.Write(payload(i))
+	}
+	_ = parts.Close()
+	received(count - 1)
+	_ = bodyWriter.Close()
+	<-done
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	invokeClient.AssertNumberOfCalls(t, "CloseSend", 1)
+}
+
+func Test_multipart_input_default_part_content_type(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithMultipartInput()(p)
+
+	body := "--xyz\r\n\r\nfirst\r\n--xyz\r\nContent-Type: application/json\r\n\r\n{}\r\n--xyz--\r\n"
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "multipart/mixed; boundary=xyz")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 3)
+	assert.Equal(t, "first", string(signals[1].GetData().Payload))
+	assert.Equal(t, "text/plain", signals[1].GetData().ContentType)
+	assert.Equal(t, "{}", string(signals[2].GetData().Payload))
+	assert.Equal(t, "application/json", signals[2].GetData().ContentType)
+}
+
+func Test_multipart_input_malformed(t *testing.T) {
+	for _, contentType := range []string{"multipart/mixed", "multipart/mixed; boundary=xyz"} {
+		t.Run(contentType, func(t *testing.T) {
+			riffClient, _ := mockRiffClientUntilCancelled()
+			p := &proxy{riffClient: riffClient}
+			WithMultipartInput()(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader("--abc\r\n\r\nnot closed"))
+			request.Header.Set("Content-Type", contentType)
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+		})
+	}
+}
+
+func Test_multipart_input_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	body := "--xyz\r\n\r\nfirst\r\n--xyz--\r\n"
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "multipart/mixed; boundary=xyz")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, body, string(signals[1].GetData().Payload))
+}
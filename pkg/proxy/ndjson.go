@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ndjsonContentType is the media type of newline delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// WithNDJSONInput splits application/x-ndjson request bodies into lines, sending each JSON value as its own
+// application/json data frame. Only the first frame carries the request headers.
+func WithNDJSONInput() Option {
+	return func(p *proxy) {
+		p.ndjsonInput = true
+	}
+}
+
+// WithNDJSONOutput writes the output frames as newline delimited JSON, streamed as they arrive, to clients accepting
+// application/x-ndjson. The function is expected to produce application/json frames instead. When validate is set,
+// frames that are not a valid JSON value cut the response short.
+func WithNDJSONOutput(validate bool) Option {
+	return func(p *proxy) {
+		p.ndjsonOutput = true
+		p.validateNDJSON = validate
+	}
+}
+
+// ndjsonOutputRequested tells whether the output should be written as newline delimited JSON.
+func (p *proxy) ndjsonOutputRequested(request *http.Request) bool {
+	return p.ndjsonOutput && !p.rawHTTP && accepts(request, ndjsonContentType)
+}
+
+// ndjsonLine turns an output frame into a line of newline delimited JSON.
+func (p *proxy) ndjsonLine(frame *rpc.OutputFrame) error {
+	payload := bytes.TrimSpace(frame.Payload)
+	if p.validateNDJSON && !json.Valid(payload) {
+		return httpErrorf(http.StatusBadGateway, "output frame is not valid JSON")
+	}
+	frame.ContentType = ndjsonContentType
+	frame.Payload = append(payload, '\n')
+	return nil
+}
+
+// isNDJSON tells whether a content type is newline delimited JSON.
+func isNDJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.ToLower(mediaType) == ndjsonContentType
+}
+
+// sendLines sends each non blank line of the request body as a data frame, as soon as it has been read.
+func (p *proxy) sendLines(client rpc.Riff_InvokeClient, request *http.Request, argIndex int32) error {
+	reader := bufio.NewReader(request.Body)
+	for first := true; ; {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			inputFrame := &rpc.InputFrame{
+				ContentType: "application/json",
+				ArgIndex:    argIndex,
+				Payload:     line,
+			}
+			if first {
+				inputFrame.Headers = frameHeaders(request)
+				first = false
+			}
+			if err := p.sendData(client, inputFrame); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_ndjson_input_one_frame_per_line(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONInput()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("{\"n\": 1}\n{\"n\": 2}\r\n\n{\"n\": 3}"))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 4)
+	for i, expected := range []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`} {
+		assert.Equal(t, expected, string(signals[i+1].GetData().Payload))
+		assert.Equal(t, "application/json", signals[i+1].GetData().ContentType)
+	}
+	assert.Equal(t, "application/x-ndjson", signals[1].GetData().Headers["Content-Type"])
+	assert.Empty(t, signals[2].GetData().Headers)
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_ndjson_input_partial_reads(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONInput()(p)
+
+	long := `"` + strings.Repeat("x", 10000) + `"`
+	body := iotest.OneByteReader(strings.NewReader(long + "\n" + `"short"` + "\n"))
+	request, _ := http.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 3)
+	assert.Equal(t, long, string(signals[1].GetData().Payload))
+	assert.Equal(t, `"short"`, string(signals[2].GetData().Payload))
+}
+
+func Test_ndjson_input_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("{\"n\": 1}\n{\"n\": 2}\n"))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 2)
+	assert.Equal(t, "application/x-ndjson", signals[1].GetData().ContentType)
+}
+
+func Test_ndjson_output_one_line_per_frame(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(
+		outputSignal(`{"n": 1}`, "application/json"),
+		outputSignal(`{"n": 2}`, "application/json"),
+		outputSignal(`{"n": 3}`, "application/json"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(true)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/x-ndjson")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "application/x-ndjson", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"n\": 1}\n{\"n\": 2}\n{\"n\": 3}\n", responseRecorder.Body.String())
+	assert.True(t, responseRecorder.Flushed)
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/json"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_ndjson_output_invalid_json(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal(`{"n": 1}`, "application/json"),
+		outputSignal(`{"n": `, "application/json"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(true)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/x-ndjson")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, "{\"n\": 1}\n", responseRecorder.Body.String())
+	assert.Equal(t, "output frame is not valid JSON", response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_ndjson_output_not_accepted(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse(`{"n": 1}`, "application/json")
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(false)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, `{"n": 1}`, responseRecorder.Body.String())
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Negotiator tells the media types the function is expected to output for a request, most preferred first. Entries
+// may be media ranges, or lists of them as found in Accept headers. They are joined into a single list, expected from
+// each output selected for the invocation.
+type Negotiator interface {
+	ExpectedContentTypes(request *http.Request) []string
+}
+
+// NegotiatorFunc adapts a function to a Negotiator.
+type NegotiatorFunc func(request *http.Request) []string
+
+func (f NegotiatorFunc) ExpectedContentTypes(request *http.Request) []string {
+	return f(request)
+}
+
+// WithNegotiator replaces the default negotiation, which expects the media ranges of the X-Riff-Accept or else the
+// Accept header of requests (application/octet-stream when missing) as adjusted by WithAcceptWildcards,
+// WithCharsetNegotiation and the newline delimited JSON or server-sent events output, for instance to take the API
+// version asked for into account. Exchanges of raw http messages always expect message/http.
+func WithNegotiator(negotiator Negotiator) Option {
+	return func(p *proxy) {
+		p.negotiator = negotiator
+	}
+}
+
+// expectedContentTypes negotiates the media types expected from the function, one entry per output as the start frame
+// requires, application/octet-stream when the negotiator has no preference.
+func (p *proxy) expectedContentTypes(request *http.Request, outputs int) []string {
+	accept := p.negotiatedAccept(request)
+	expected := make([]string, outputs)
+	for i := range expected {
+		expected[i] = accept
+	}
+	return expected
+}
+
+func (p *proxy) negotiatedAccept(request *http.Request) string {
+	if p.rawHTTP {
+		return rawHTTPContentType
+	}
+	negotiator := p.negotiator
+	if negotiator == nil {
+		negotiator = acceptNegotiator{p: p}
+	}
+	if expected := negotiator.ExpectedContentTypes(request); len(expected) > 0 {
+		return strings.Join(expected, ", ")
+	}
+	return "application/octet-stream"
+}
+
+// acceptNegotiator is the default negotiator, expecting what the X-Riff-Accept or Accept header of requests tells.
+type acceptNegotiator struct {
+	p *proxy
+}
+
+func (n acceptNegotiator) ExpectedContentTypes(request *http.Request) []string {
+	p := n.p
+	accept := requestedAccept(request)
+	if accept == "" {
+		accept = "application/octet-stream"
+	}
+	accept = expandAcceptWildcards(accept, p.acceptWildcards)
+	if p.ndjsonOutputRequested(request) {
+		// each line is a JSON value of its own
+		accept = expandAcceptWildcards(accept, map[string][]string{ndjsonContentType: {"application/json"}})
+	} else if p.sseOutputRequested(request) {
+		// each event carries lines of text
+		accept = expandAcceptWildcards(accept,
+			map[string][]string{eventStreamContentType: {"text/plain", "application/json"}})
+	}
+	if p.defaultCharset != "" {
+		accept = addCharset(accept, preferredCharset(request.Header.Get("accept-charset"), p.defaultCharset))
+	}
+	return []string{accept}
+}
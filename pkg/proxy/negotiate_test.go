@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_invokeGrpc_negotiator(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithNegotiator(NegotiatorFunc(func(request *http.Request) []string {
+		if version := request.Header.Get("api-version"); version != "" {
+			return []string{"application/vnd.example.v" + version + "+json", "application/json"}
+		}
+		return nil
+	}))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "application/json")
+	request.Header.Add("api-version", "2")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/vnd.example.v2+json, application/json"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_invokeGrpc_negotiator_no_preference(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithNegotiator(NegotiatorFunc(func(request *http.Request) []string {
+		return nil
+	}))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Add("accept", "application/json")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"application/octet-stream"}, startFrame.ExpectedContentTypes)
+}
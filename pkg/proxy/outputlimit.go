@@ -0,0 +1,59 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+)
+
+// errorTrailer reports errors happening after a streamed response has started.
+const errorTrailer = "X-Riff-Error"
+
+// WithMaxOutputBytes limits the size of response bodies. Buffered responses exceeding the limit are rejected with a
+// 502, while streamed responses are cut short before the frame going over the limit, with an X-Riff-Error trailer.
+// In both cases, the invocation is cancelled.
+func WithMaxOutputBytes(max int64) Option {
+	return func(p *proxy) {
+		p.maxOutputBytes = max
+	}
+}
+
+// outputLimit returns the limit of the response bodies of a route, if any, the one of the adapter unless overridden.
+func (p *proxy) outputLimit(route *route) int64 {
+	if route.MaxOutputBytes > 0 {
+		return route.MaxOutputBytes
+	}
+	return p.current().maxOutputBytes
+}
+
+// exceedsOutputLimit tells whether a response body of the given size is over the limit of the route.
+func (p *proxy) exceedsOutputLimit(route *route, size int64) bool {
+	max := p.outputLimit(route)
+	return max > 0 && size > max
+}
+
+// outputLimitError is the error reported for responses over the limit of the route.
+func (p *proxy) outputLimitError(route *route) error {
+	return httpErrorf(http.StatusBadGateway, "output exceeds %d bytes", p.outputLimit(route))
+}
+
+// setErrorTrailer reports an error in a trailer, for responses that have already started, along with its gRPC code.
+func setErrorTrailer(writer http.ResponseWriter, err error) {
+	page := newErrorPage(err)
+	writer.Header().Set(http.TrailerPrefix+errorTrailer, page.Message)
+	writer.Header().Set(http.TrailerPrefix+grpcCodeHeader, grpcCodeName(err, page.Status))
+}
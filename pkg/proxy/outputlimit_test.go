@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_output_limit_buffered(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("0123456789", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMaxOutputBytes(5)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+	assert.Equal(t, "output exceeds 5 bytes\n", responseRecorder.Body.String())
+}
+
+func Test_output_limit_buffered_within(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("01234", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMaxOutputBytes(5)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "01234", responseRecorder.Body.String())
+}
+
+func Test_output_limit_streaming(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("0123", "text/plain"),
+		outputSignal("4567", "text/plain"),
+		outputSignal("89", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithMaxOutputBytes(6)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "0123", responseRecorder.Body.String())
+	assert.Equal(t, "output exceeds 6 bytes", response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_output_limit_streaming_first_frame(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("0123456789", "text/plain"))
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithMaxOutputBytes(6)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+}
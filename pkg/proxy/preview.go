@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WithBodyPreview logs the first limit bytes of each request body as it is sent to the function, for debugging.
+// Bytes other than printable ASCII are hex escaped.
+func WithBodyPreview(logger *log.Logger, limit int) Option {
+	return func(p *proxy) {
+		if limit > 0 {
+			p.previewLogger = logger
+			p.previewLimit = limit
+		}
+	}
+}
+
+// previewBody captures the beginning of the request body while it is read, returning a function logging it once
+// done. It does nothing unless body previews are enabled.
+func (p *proxy) previewBody(request *http.Request) func() {
+	if p.previewLogger == nil {
+		return func() {}
+	}
+	body := &previewReader{ReadCloser: request.Body, limit: p.previewLimit}
+	request.Body = body
+	return func() {
+		p.previewLogger.Printf("%s %s request body (%d of %d bytes): %s", request.Method, request.URL.Path,
+			len(body.preview), body.size, escapeBinary(body.preview))
+	}
+}
+
+// previewReader keeps a copy of the first bytes read.
+type previewReader struct {
+	io.ReadCloser
+	limit   int
+	preview []byte
+	size    int64
+}
+
+func (r *previewReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	if room := r.limit - len(r.preview); room > 0 {
+		if room > n {
+			room = n
+		}
+		r.preview = append(r.preview, p[:room]...)
+	}
+	return n, err
+}
+
+// escapeBinary hex escapes the bytes that are not printable ASCII, as well as backslashes.
+func escapeBinary(b []byte) string {
+	var escaped strings.Builder
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e || c == '\\' {
+			_, _ = fmt.Fprintf(&escaped, `\x%02x`, c)
+		} else {
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_body_preview(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	var logs bytes.Buffer
+	WithBodyPreview(log.New(&logs, "", 0), 5)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello world"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "POST / request body (5 of 11 bytes): hello\n", logs.String())
+	assert.Equal(t, "hello world", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_body_preview_binary(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	var logs bytes.Buffer
+	WithBodyPreview(log.New(&logs, "", 0), 8)(p)
+
+	request, _ := http.NewRequest("POST", "/", bytes.NewReader(pixel))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	assert.Equal(t, `POST / request body (8 of 67 bytes): \x89PNG\x0d\x0a\x1a\x0a`+"\n", logs.String())
+	assert.Equal(t, pixel, inputSignals(invokeClient.Calls)[1].GetData().Payload)
+}
+
+func Test_escapeBinary(t *testing.T) {
+	assert.Equal(t, `a\x5cb\x00\xff`, escapeBinary([]byte("a\\b\x00\xff")))
+}
@@ -22,11 +22,17 @@ import (
 	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,31 +40,262 @@ type proxy struct {
 	server      *http.Server
 	riffClient  rpc.RiffClient
 	grpcAddress string
+
+	// warmupInterval, when positive, enables warming the invoker up while idle
+	warmupInterval time.Duration
+	warmupStop     chan struct{}
+	// reaperMaxIdle, when positive, enables closing route backend connections idle or unhealthy for that long
+	reaperMaxIdle time.Duration
+	reaperStop    chan struct{}
+	// stopLoops closes warmupStop and reaperStop once, however many times Shutdown is called
+	stopLoops sync.Once
+	// inFlight and lastActivity (in unix nanoseconds) tell whether requests are being served
+	inFlight     int32
+	lastActivity int64
+
+	// streamWindowSize and connWindowSize, when positive, set the HTTP/2 flow control windows towards backends
+	streamWindowSize int32
+	connWindowSize   int32
+	// compress gzips the messages sent to backends, except for the targets in uncompressed
+	compress     bool
+	uncompressed sync.Map
+	// connectTimeout, when positive, limits how long backends take to accept invocations
+	connectTimeout time.Duration
+
+	// nonces, when non nil, enables replay protection based on the X-Riff-Nonce header
+	nonces *nonceCache
+
+	// responses, when non nil, remembers responses by Idempotency-Key header
+	responses *responseCache
+
+	// limiter, when non nil, limits the rate of requests per client
+	limiter        *rateLimiter
+	clientIPHeader string
+	trustedProxies []*net.IPNet
+
+	// streaming writes output frames as they arrive rather than expecting a single one
+	streaming bool
+	// readAheadFrames, when above one, is the number of output frames read before committing streamed responses
+	readAheadFrames int
+	// lineBuffering writes streamed text/plain responses by whole lines
+	lineBuffering bool
+	// invalidUTF8, when set, validates text outputs as UTF-8, handling invalid bytes as told
+	invalidUTF8 InvalidUTF8
+	// emptyFrames tells whether zero-length output frames are written to streamed responses
+	emptyFrames EmptyFrames
+	// contentTypeChanges tells how output frames changing the content type of streamed responses are handled
+	contentTypeChanges ContentTypeChanges
+	// unflushableWarning warns once that responses are buffered as the writer can't flush
+	unflushableWarning sync.Once
+
+	// reloadable holds the settings that may change while serving, as set by options. Once reloaded, the settings
+	// in effect are the ones stored in reloaded instead, see current
+	reloadable
+	reloaded atomic.Value
+	// clients are the clients of the route backends, by target
+	clients     map[string]rpc.RiffClient
+	clientsLock sync.Mutex
+
+	// breakers, when non nil, stop calling failing backends for a while
+	breakers *circuitBreakers
+	// failures, when non nil, briefly answers identical requests with the transient error of the backend
+	failures *errorCache
+
+	// acceptWildcards maps wildcard media ranges to concrete types to expect instead
+	acceptWildcards map[string][]string
+	// strictAccept rejects requests not telling the media types they accept
+	strictAccept bool
+	// producedContentTypes, when set, are the media types the function may output, for requests accepting none of
+	// them to be rejected upfront
+	producedContentTypes []string
+
+	// defaultCharset, when set, enables charset negotiation for text outputs
+	defaultCharset string
+
+	// negotiator, when non nil, replaces the negotiation of the media types expected from the function
+	negotiator Negotiator
+
+	// fallbackAccept, when set, is expected instead when the function cannot produce any accepted media type
+	fallbackAccept string
+
+	// rawHTTP exchanges whole http messages with the function, rather than just their body
+	rawHTTP bool
+
+	// cloudEvents checks CloudEvents requests in binary content mode and makes replies events too
+	cloudEvents bool
+
+	// decompressRequests decodes request bodies according to their Content-Encoding
+	decompressRequests bool
+	// verifyChecksums rejects request bodies not matching their Content-MD5 or X-Riff-Checksum header
+	verifyChecksums bool
+	// compressResponses compresses response bodies of at least compressionMinSize bytes, as accepted by clients
+	compressResponses  bool
+	compressionMinSize int64
+	// ignoreBlankBodies sends no data frame for whitespace only request bodies
+	ignoreBlankBodies bool
+
+	// inputEncoding, when set, is applied to request payloads
+	inputEncoding string
+
+	// previewLogger, when non nil, logs the first previewLimit bytes of request bodies
+	previewLogger *log.Logger
+	previewLimit  int
+
+	// asyncStatus, when set, makes invocations fire-and-forget, responding with that status
+	asyncStatus int
+
+	// upgradeStatus, when set, rejects requests asking to switch protocols with that status
+	upgradeStatus int
+
+	// ndjsonInput sends each line of newline delimited JSON request bodies as its own frame
+	ndjsonInput bool
+
+	// multipartInput sends each part of multipart/mixed request bodies as its own frame
+	multipartInput bool
+
+	// ndjsonOutput writes output frames as newline delimited JSON to clients accepting it, validating them when
+	// validateNDJSON is set
+	ndjsonOutput   bool
+	validateNDJSON bool
+
+	// sseOutput writes output frames as server-sent events to clients accepting them, with a keepalive comment each
+	// time the stream stays idle for sseHeartbeat, if positive, possibly only until the first frame. Events are named
+	// as told by sseEventNames
+	sseOutput             bool
+	sseHeartbeat          time.Duration
+	sseHeartbeatUntilData bool
+	sseEventNames         SSEEventNames
+
+	// reorderSize, when positive, is the number of output frames held to write them in sequence, for up to reorderWait
+	reorderSize int
+	reorderWait time.Duration
+
+	// chunkThreshold, when positive, is the body size above which requests are sent as several frames
+	chunkThreshold int64
+	// coalesceSize and coalesceWait, when the wait is positive, send chunked bodies as they arrive in frames of up to
+	// coalesceSize bytes, sent no later than coalesceWait after their first bytes were read
+	coalesceSize int
+	coalesceWait time.Duration
+	// outputWriteSize, when positive, is the size of the pieces larger output payloads are written in, flushing each
+	outputWriteSize int
+
+	// metrics, when non nil, are exposed on metricsPath
+	metrics     *metrics
+	metricsPath string
+
+	// durationHeaders reports how long responses took to start
+	durationHeaders bool
+	// serverTiming reports the phases of invocations in a Server-Timing header
+	serverTiming bool
+	// echoForwardedHeaders lists the headers forwarded to the function in responses
+	echoForwardedHeaders bool
+	// receivedAtHeader tells the function when the adapter received each request
+	receivedAtHeader bool
+	// hostForwarding, when set, forwards the Host of requests to the function in a header
+	hostForwarding HostForwarding
+
+	// errorTemplate, when non nil, renders errors for clients accepting html
+	errorTemplate *template.Template
+	// errorLogger, when non nil, enables request ids and logs errors along with them
+	errorLogger *log.Logger
+	// middlewares are added to the handling of requests, after rate limiting
+	middlewares []Middleware
+	// accessLogger, when non nil, logs a line in accessLogFormat for each request
+	accessLogger    *log.Logger
+	accessLogFormat AccessLogFormat
+
+	// sniffJSON defaults the content type of requests looking like JSON
+	sniffJSON bool
+
+	// validateJSON rejects malformed JSON request bodies upfront
+	validateJSON bool
+	// duplicateContentTypes tells how to handle requests with several Content-Type headers
+	duplicateContentTypes DuplicateContentTypes
+	// contentTypeParam takes the content type of requests not declaring any from the query
+	contentTypeParam bool
+
+	// validators check request bodies by media type
+	validators map[string]Validator
+
+	// inputTypes map request media types to input names, for the invoker started by the adapter
+	inputTypes map[string]string
+	// trailingSlash tells how to handle paths ending with a slash
+	trailingSlash TrailingSlash
+
+	// sessionHeader and sessionCookie identify sessions sticking to a backend
+	sessionHeader string
+	sessionCookie string
+
+	// readinessPath, when set, exposes a readiness probe
+	readinessPath string
+	// adminToken, when set, enables the admin endpoints
+	adminToken string
+	// draining is set (to 1) to report as not ready while still serving requests
+	draining int32
+	// requestSimulation exposes a debug endpoint replaying requests through the proxy
+	requestSimulation bool
 }
 
-func NewProxy(grpcAddress string, httpAddress string) (*proxy, error) {
+// responseModeHeader lets clients choose between streamed and buffered responses.
+const responseModeHeader = "X-Riff-Response-Mode"
 
-	p := proxy{grpcAddress: grpcAddress}
+// Option configures optional behavior of the proxy.
+type Option func(*proxy)
 
-	m := http.NewServeMux()
-	m.HandleFunc("/", p.invokeGrpc)
+func NewProxy(grpcAddress string, httpAddress string, options ...Option) (*proxy, error) {
+
+	p := proxy{grpcAddress: grpcAddress}
+	for _, option := range options {
+		option(&p)
+	}
 
 	p.server = &http.Server{
 		Addr:    httpAddress,
-		Handler: m,
+		Handler: p.mux(),
 	}
 
 	return &p, nil
 }
 
+// mux dispatches requests to the function or to the enabled operational endpoints.
+func (p *proxy) mux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.Handle("/", p.handler())
+	if p.metrics != nil {
+		m.Handle(p.metricsPath, p.metrics.handler())
+	}
+	if p.readinessPath != "" {
+		m.HandleFunc(p.readinessPath, p.ready)
+	}
+	if p.adminToken != "" {
+		m.HandleFunc(drainPath, p.drain(true))
+		m.HandleFunc(undrainPath, p.drain(false))
+		if p.requestSimulation {
+			m.HandleFunc(simulatePath, p.simulate)
+		}
+	}
+	return m
+}
+
 func (p *proxy) Run() error {
 
-	timeout, _ := context.WithTimeout(context.Background(), 1*time.Minute)
-	conn, err := grpc.DialContext(timeout, p.grpcAddress, grpc.WithInsecure(), grpc.WithBlock())
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	conn, err := grpc.DialContext(timeout, p.grpcAddress, append(p.dialOptions(), grpc.WithBlock())...)
 	if err != nil {
 		return err
 	}
 	p.riffClient = rpc.NewRiffClient(conn)
+	go p.metrics.watchConnection(conn)
+	if err := p.dialRoutes(p.current().routes); err != nil {
+		return err
+	}
+	if p.warmupInterval > 0 {
+		go p.warmupLoop(p.warmupStop)
+	}
+	if p.reaperMaxIdle > 0 {
+		go p.reaperLoop(p.reaperStop)
+	}
 
 	err = p.server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
@@ -69,113 +306,734 @@ func (p *proxy) Run() error {
 }
 
 func (p *proxy) Shutdown(ctx context.Context) error {
+	p.stopLoops.Do(func() {
+		if p.warmupStop != nil {
+			close(p.warmupStop)
+		}
+		if p.reaperStop != nil {
+			close(p.reaperStop)
+		}
+	})
 	return p.server.Shutdown(ctx)
 }
 
+// WithStreaming makes the proxy write any number of output frames to the response as they arrive, using chunked
+// transfer encoding. By default, a single output frame is expected and written with a Content-Length.
+func WithStreaming() Option {
+	return func(p *proxy) {
+		p.streaming = true
+	}
+}
+
+// handler wraps invokeGrpc with the enabled request filters, innermost first: each filter wraps the ones listed
+// before it, hence sees requests before them.
+func (p *proxy) handler() http.Handler {
+	var h http.Handler = http.HandlerFunc(p.invokeGrpc)
+	h = p.overrideMethod(h)
+	h = p.validateBodies(h)
+	h = p.rejectMalformedJSON(h)
+	h = p.defaultJSONContentType(h)
+	h = p.rejectContentTypes(h)
+	h = p.checkDuplicateContentTypes(h)
+	h = p.contentTypeFromQuery(h)
+	h = p.rejectUnacceptable(h)
+	h = p.requireAccept(h)
+	h = p.limitBodies(h)
+	h = p.decompressBodies(h)
+	h = p.checkBodies(h)
+	h = p.dedupeRequests(h)
+	h = p.rejectReplays(h)
+	h = p.rejectUpgrades(h)
+	h = p.applyMiddlewares(h)
+	h = p.forwardHost(h)
+	h = p.limitRate(h)
+	h = p.identifyRequests(h)
+	h = p.compressBodies(h)
+	h = p.logAccess(h)
+	h = p.stampRequests(h)
+	return h
+}
+
+// WithAcceptedContentTypes advertises the request content types supported by the function, in answer to OPTIONS
+// requests. This is informational only, requests of other types are still forwarded.
+func WithAcceptedContentTypes(contentTypes []string) Option {
+	return func(p *proxy) {
+		p.acceptedContentTypes = contentTypes
+	}
+}
+
 func (p *proxy) invokeGrpc(writer http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodPost || request.URL.Path != "/" {
+	if p.redirectTrailingSlash(writer, request) {
+		return
+	}
+	route := p.resolve(request.URL.Path)
+	if request.Method == http.MethodOptions && route != nil {
+		p.writeOptions(writer, route)
+		return
+	}
+	longPoll := request.Method == http.MethodGet && p.current().longPollWait > 0
+	if (request.Method != http.MethodPost && !longPoll && !p.overridden(request)) || route == nil {
+		writer.Header().Set(grpcCodeHeader, grpcCodeNames[codes.Unimplemented])
 		writer.WriteHeader(http.StatusNotImplemented)
 		return
 	}
-	client, err := p.riffClient.Invoke(context.Background())
+	var event *cloudEvent
+	if p.cloudEvents {
+		var err error
+		if event, err = readCloudEvent(request); err != nil {
+			p.writeError(writer, request, err)
+			return
+		}
+	}
+	ctx, cancel := p.invocationContext(request.Context(), route)
+	defer cancel()
+	request = request.WithContext(ctx)
+
+	backend := route.pick(p.sessionKey(request))
+	if len(route.backends) > 1 {
+		writer.Header().Set(backendHeader, backend.Target)
+	}
+	if p.echoForwardedHeaders {
+		writer.Header().Set(forwardedHeadersHeader, forwardedHeaderNames(request))
+	}
+	// cached errors are answered without letting a request through the breaker, which would then wait for its outcome
+	var failureKey string
+	if p.failures != nil {
+		failureKey = errorCacheKey(request, backend)
+		if err := p.failures.lookup(failureKey, time.Now()); err != nil {
+			writer.Header().Set(cachedErrorHeader, "true")
+			p.writeError(writer, request, err)
+			return
+		}
+	}
+	breaker := p.breakers.forBackend(backend)
+	if !breaker.allow() {
+		p.writeError(writer, request, httpErrorf(http.StatusServiceUnavailable, "backend unavailable"))
+		return
+	}
+	p.metrics.backendInvoked(backend.Target)
+	done := p.metrics.streamStarted()
+	defer done()
+	defer p.activity()()
+
+	response := &responseRecorder{ResponseWriter: writer, event: event}
+	if p.durationHeaders {
+		response.started = time.Now()
+	}
+	if p.serverTiming {
+		response.timing = newServerTiming()
+		request = request.WithContext(withServerTiming(request.Context(), response.timing))
+	}
+	body := &countingReader{ReadCloser: request.Body}
+	request.Body = body
+	var err error
+	async := !longPoll && p.asyncStatus != 0
+	if longPoll {
+		err = p.longPoll(response, request, route, backend)
+	} else if async {
+		err = p.invokeAsync(response, request, route, backend)
+	} else {
+		err = p.invokeWithFallback(response, request, route, backend)
+	}
+	if !async || err != nil {
+		// started async invocations are recorded once completed in the background
+		breaker.record(err)
+	}
+	p.compressionRejected(backend, err)
+	p.metrics.invocationEnded(request.Context(), err)
+	p.metrics.transferred(body.read, response.written)
+	if err != nil && response.status == 0 {
+		p.failures.record(failureKey, err, time.Now())
+		p.writeInvocationError(response, request, err)
+	}
+}
+
+// writeOptions describes how the function can be invoked, without contacting the backend.
+func (p *proxy) writeOptions(writer http.ResponseWriter, route *route) {
+	settings := p.current()
+	acceptPost := "*/*"
+	if len(settings.acceptedContentTypes) > 0 {
+		acceptPost = strings.Join(settings.acceptedContentTypes, ", ")
+	}
+	allow := "OPTIONS, POST"
+	if settings.longPollWait > 0 {
+		allow = "GET, " + allow
+	}
+	writer.Header().Set("Allow", allow)
+	writer.Header().Set("Accept-Post", acceptPost)
+	if limit := p.inputLimit(route); limit > 0 {
+		writer.Header().Set(maxInputBytesHeader, strconv.FormatInt(limit, 10))
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// invoke performs the invocation, writing the output to the response. Errors are returned for the caller to report,
+// unless the response has already been started.
+func (p *proxy) invoke(writer *responseRecorder, request *http.Request, route *route, backend *backend) error {
+	streaming, err := p.streamingRequested(request)
+	if err != nil {
+		return err
+	}
+	format := p.streamFormatRequested(request)
+	argIndex, err := route.inputIndex(inputContentType(request))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	client, err := p.open(ctx, request, route, backend)
+	if err != nil {
+		return err
+	}
+
+	// Input is sent while output is received, so that functions may produce output before having consumed all
+	// their input. Once the request body is over, the input side is half-closed with CloseSend while output keeps
+	// being received, as duplex clients finish sending before the response is over. Whichever side fails first
+	// cancels the invocation, unblocking the other side.
+	input := &sentInput{done: make(chan struct{})}
+	go func() {
+		input.err = p.sendInput(client, request, argIndex)
+		if input.err != nil && input.err != io.EOF {
+			cancel()
+		}
+		close(input.done)
+	}()
+
+	var out http.ResponseWriter = writer
+	var held *inputFirstWriter
+	if request.ProtoMajor < 2 {
+		// HTTP/1.x servers don't let the body be read once the response has started
+		held = newInputFirstWriter(writer, input)
+		out = held
+	}
+	if p.rawHTTP {
+		err = p.writeRaw(out, client, request, route)
+	} else if format != streamPayloads || streaming {
+		err = p.writeStreamed(out, client, request, route, format)
+	} else {
+		err = p.writeBuffered(out, client, route)
+	}
 	if err != nil {
-		writeError(writer, err)
+		cancel()
+	}
+	<-input.done
+	if held != nil && held.overflow != nil {
+		// sending the input then only failed for having been cancelled
+		return held.overflow
+	}
+	// io.EOF means the stream was ended by the backend, which the receiving side reports best
+	if sendErr := input.err; sendErr != nil && sendErr != io.EOF {
+		if writer.status != 0 {
+			setErrorTrailer(writer, sendErr)
+		}
+		return sendErr
+	}
+	if held != nil {
+		// the function may have completed before its input was sent, leaving its whole output held back
+		if commitErr := held.commit(); err == nil {
+			err = commitErr
+		}
+	}
+	if err == nil {
+		// the function may have completed before the client was done uploading
+		drainBody(request)
+	}
+	return err
+}
+
+// sentInput tells how sending the input of an invocation went, once done.
+type sentInput struct {
+	done chan struct{}
+	err  error
+}
+
+// maxHeldOutputBytes bounds the output held back while the input of HTTP/1.x requests is still being sent.
+const maxHeldOutputBytes = 16 << 20
+
+// inputFirstWriter holds back the response until the input has been sent, as HTTP/1.x servers discard what is left of
+// request bodies once the response starts. The output keeps being received meanwhile, its writes and flushes being
+// replayed in order once the input has been sent, so that functions answering as they read their input don't stall it
+// waiting for their output to be consumed. Up to maxHeldOutputBytes are held. Headers are kept aside too, for the
+// response to be left untouched should sending the input fail, leaving that error to be reported instead.
+type inputFirstWriter struct {
+	http.ResponseWriter
+	input  *sentInput
+	header http.Header
+	status int
+	// held are the writes held back, nil standing for a flush
+	held      [][]byte
+	heldBytes int
+	overflow  error
+	committed bool
+}
+
+func newInputFirstWriter(writer http.ResponseWriter, input *sentInput) *inputFirstWriter {
+	return &inputFirstWriter{ResponseWriter: writer, input: input, header: writer.Header().Clone()}
+}
+
+// sent tells whether the input is done being sent, without waiting for it.
+func (w *inputFirstWriter) sent() bool {
+	select {
+	case <-w.input.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// commit, once the input has been sent, passes on the headers, status and output held meanwhile unless that failed.
+func (w *inputFirstWriter) commit() error {
+	if w.committed {
+		return nil
+	}
+	if err := w.input.err; err != nil && err != io.EOF {
+		return err
+	}
+	w.committed = true
+	header := w.ResponseWriter.Header()
+	for h := range header {
+		delete(header, h)
+	}
+	for h, v := range w.header {
+		header[h] = v
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	held := w.held
+	w.held = nil
+	for _, b := range held {
+		if b == nil {
+			w.Flush()
+		} else if _, err := w.ResponseWriter.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *inputFirstWriter) Header() http.Header {
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *inputFirstWriter) WriteHeader(status int) {
+	if w.committed || w.sent() {
+		if w.commit() == nil {
+			w.ResponseWriter.WriteHeader(status)
+		}
+	} else if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *inputFirstWriter) Write(b []byte) (int, error) {
+	if w.committed || w.sent() {
+		if err := w.commit(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	if w.heldBytes+len(b) > maxHeldOutputBytes {
+		w.overflow = httpErrorf(http.StatusBadGateway,
+			"output exceeds %d bytes before the request body was sent, which HTTP/2 clients can stream",
+			maxHeldOutputBytes)
+		return 0, w.overflow
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.held = append(w.held, append([]byte{}, b...))
+	w.heldBytes += len(b)
+	return len(b), nil
+}
+
+func (w *inputFirstWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
 		return
 	}
+	if w.committed || w.sent() {
+		if w.commit() == nil {
+			flusher.Flush()
+		}
+	} else {
+		w.held = append(w.held, nil)
+	}
+}
 
-	accept := request.Header.Get("accept")
-	if accept == "" {
-		accept = "application/octet-stream"
+// Unwrap returns the writer the response is held back from.
+func (w *inputFirstWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sendInput sends the request as input data frames for the input stream at argIndex, then half-closes the stream.
+func (p *proxy) sendInput(client rpc.Riff_InvokeClient, request *http.Request, argIndex int32) error {
+	defer p.previewBody(request)()
+	if limit := p.current().maxInputFrames; limit > 0 {
+		client = &limitedFramesClient{Riff_InvokeClient: client, limit: limit, remaining: limit}
+	}
+	contentType := inputContentType(request)
+	if p.ndjsonInput && !p.rawHTTP && isNDJSON(contentType) {
+		if err := p.sendLines(client, request, argIndex); err != nil {
+			return err
+		}
+		return client.CloseSend()
+	}
+	if boundary, ok := multipartBoundary(contentType); ok && p.multipartInput && !p.rawHTTP {
+		if err := p.sendParts(client, request, boundary, argIndex); err != nil {
+			return err
+		}
+		return client.CloseSend()
+	}
+	if p.chunkedInput(request) && p.coalesceWait > 0 {
+		if err := p.sendCoalesced(client, request, contentType, argIndex); err != nil {
+			return err
+		}
+		return client.CloseSend()
+	}
+	if p.chunkedInput(request) {
+		if err := p.sendChunks(client, request, contentType, argIndex); err != nil {
+			return err
+		}
+		return client.CloseSend()
+	}
+
+	var inputFrame *rpc.InputFrame
+	var err error
+	if p.rawHTTP {
+		inputFrame, err = rawInputFrame(request, argIndex)
+	} else {
+		inputFrame, err = bodyInputFrame(request, contentType, argIndex)
+		if err == nil && p.ignoredInput(inputFrame) {
+			return client.CloseSend()
+		}
 	}
-	contentType := request.Header.Get("content-type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	if err != nil {
+		return err
 	}
+	if err := p.sendData(client, inputFrame); err != nil {
+		return err
+	}
+	return client.CloseSend()
+}
+
+// sendData encodes an input frame as configured and sends it.
+func (p *proxy) sendData(client rpc.Riff_InvokeClient, inputFrame *rpc.InputFrame) error {
+	p.encodeInputFrame(inputFrame)
+	dataSignal := rpc.InputSignal{
+		Frame: &rpc.InputSignal_Data{
+			Data: inputFrame,
+		},
+	}
+	return client.Send(&dataSignal)
+}
+
+// streamingRequested tells whether the response should be streamed, as asked by the X-Riff-Response-Mode header or
+// as configured by default.
+func (p *proxy) streamingRequested(request *http.Request) (bool, error) {
+	switch mode := request.Header.Get(responseModeHeader); mode {
+	case "":
+		return p.streaming, nil
+	case "stream":
+		return true, nil
+	case "buffer":
+		return false, nil
+	default:
+		return false, httpErrorf(http.StatusBadRequest, "invalid %s header %q, must be stream or buffer",
+			responseModeHeader, mode)
+	}
+}
+
+// open starts an invocation on a backend of the route, sending the start frame negotiated from the request, within the
+// connect timeout if any.
+func (p *proxy) open(ctx context.Context, request *http.Request, route *route,
+	backend *backend) (rpc.Riff_InvokeClient, error) {
+	ctx, connected := p.connectContext(ctx, route)
+	client, err := p.start(ctx, request, route, backend)
+	if timeoutErr := connected(); timeoutErr != nil {
+		return nil, timeoutErr
+	}
+	return client, err
+}
+
+// start opens the invocation stream and sends the start frame.
+func (p *proxy) start(ctx context.Context, request *http.Request, route *route,
+	backend *backend) (rpc.Riff_InvokeClient, error) {
+	outputNames, err := route.selectOutputs(request.Header.Get(outputHeader))
+	if err != nil {
+		return nil, err
+	}
+	client, err := backend.client.Invoke(ctx, p.callOptions(backend)...)
+	if err != nil {
+		return nil, err
+	}
+	if timing := serverTimingFrom(ctx); timing != nil {
+		timing.end(dialPhase)
+		client = &timedClient{Riff_InvokeClient: client, timing: timing}
+	}
+	client = p.breakers.forBackend(backend).observe(client)
 
 	startSignal := rpc.InputSignal{
 		Frame: &rpc.InputSignal_Start{
 			Start: &rpc.StartFrame{
-				ExpectedContentTypes: []string{accept},
-				InputNames:           []string{"in"},
-				OutputNames:          []string{"out"},
+				ExpectedContentTypes: p.expectedContentTypes(request, len(outputNames)),
+				InputNames:           route.inputNames(),
+				OutputNames:          outputNames,
 			},
 		},
 	}
 	if err := client.Send(&startSignal); err != nil {
-		writeError(writer, err)
-		return
+		// the backend rejected the invocation upfront, don't bother sending data
+		return nil, sendError(client, err)
+	}
+	return client, nil
+}
+
+// inputContentType returns the content type of the request body, application/octet-stream when not set.
+func inputContentType(request *http.Request) string {
+	if contentType := request.Header.Get("content-type"); contentType != "" {
+		return contentType
 	}
+	return "application/octet-stream"
+}
 
+// bodyInputFrame forwards the request body and headers as a data frame.
+func bodyInputFrame(request *http.Request, contentType string, argIndex int32) (*rpc.InputFrame, error) {
 	bytes, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		writeError(writer, err)
-		return
+		return nil, err
 	}
 	inputFrame := rpc.InputFrame{
 		ContentType: contentType,
-		ArgIndex:    0,
+		ArgIndex:    argIndex,
 		Payload:     bytes,
-		Headers:     make(map[string]string, len(request.Header)),
+		Headers:     frameHeaders(request),
 	}
+	return &inputFrame, nil
+}
+
+// frameHeaders copies the first value of each request header, skipping headers without any value, along with the
+// headers set by middlewares through the request context. The map can't be pooled, as gRPC doesn't allow messages to
+// be modified once sent, even after Send returned.
+func frameHeaders(request *http.Request) map[string]string {
+	headers := make(map[string]string, len(request.Header))
 	for h, v := range request.Header {
-		inputFrame.Headers[h] = v[0]
+		if len(v) > 0 {
+			headers[h] = v[0]
+		}
 	}
-	dataSignal := rpc.InputSignal{
-		Frame: &rpc.InputSignal_Data{
-			Data: &inputFrame,
-		},
-	}
-	if err := client.Send(&dataSignal); err != nil {
-		writeError(writer, err)
-		return
-	}
-	if err := client.CloseSend(); err != nil {
-		writeError(writer, err)
-		return
+	for h, v := range frameHeadersFrom(request.Context()) {
+		headers[h] = v
 	}
+	return headers
+}
 
+// writeBuffered expects exactly one output frame, which is written as the whole response body with an accurate
+// Content-Length.
+func (p *proxy) writeBuffered(writer http.ResponseWriter, client rpc.Riff_InvokeClient, route *route) error {
 	outputSignal, err := client.Recv()
 	if err != nil {
-		writeError(writer, err)
-		return
+		return err
 	}
+	p.metrics.outputFrameReceived()
 	if _, err := client.Recv(); err != io.EOF {
-		writeError(writer, errors.New("expected EOF"))
-		return
+		return errors.New("expected EOF")
 	}
-	writer.Header().Set("content-type", outputSignal.GetData().ContentType)
-	for h, v := range outputSignal.GetData().Headers {
-		writer.Header().Set(h, v)
+	frame, err := dataFrame(outputSignal)
+	if err != nil {
+		return err
 	}
-	if _, err = writer.Write(outputSignal.GetData().Payload); err != nil {
-		writeError(writer, err)
-		return
+	if err := decodeOutputFrame(frame); err != nil {
+		return err
+	}
+	if err := p.newUTF8Validator(true).validate(frame); err != nil {
+		return err
+	}
+	if p.exceedsOutputLimit(route, int64(len(frame.Payload))) {
+		return p.outputLimitError(route)
 	}
+	response := &responseWriter{writer: writer, exactLength: true}
+	if p.outputWriteSize > 0 {
+		response.flusher, _ = writer.(http.Flusher)
+		response.splitSize = p.outputWriteSize
+	}
+	return response.write(frame)
 }
 
-func writeError(writer http.ResponseWriter, err error) {
-	if grpcError, ok := status.FromError(err); ok {
-		writeHeaderFromGrpcError(grpcError, writer)
-		writer.Header().Set("content-type", "text/plain")
-		_, _ = writer.Write([]byte(grpcError.Message()))
-		_, _ = writer.Write([]byte("\n"))
-	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Header().Set("content-type", "text/plain")
-		_, _ = writer.Write([]byte(err.Error()))
-		_, _ = writer.Write([]byte("\n"))
+// streamFormat is how output frames are written to streamed responses.
+type streamFormat int
+
+const (
+	// streamPayloads writes the payload of frames as is
+	streamPayloads streamFormat = iota
+	// streamNDJSON writes each frame as a line of newline delimited JSON
+	streamNDJSON
+	// streamEvents writes each frame as a server-sent event
+	streamEvents
+)
+
+// streamFormatRequested tells how the output should be written, as negotiated with the client. Formats other than
+// streamPayloads imply streaming.
+func (p *proxy) streamFormatRequested(request *http.Request) streamFormat {
+	switch {
+	case p.ndjsonOutputRequested(request):
+		return streamNDJSON
+	case p.sseOutputRequested(request):
+		return streamEvents
+	default:
+		return streamPayloads
 	}
+}
 
+// writeStreamed writes each output frame to the response body as soon as it is received, relying on chunked
+// transfer encoding as the total length is unknown. Headers are taken from the first frames read ahead, before the
+// response is committed. Each frame is written according to the format, such as a line of newline delimited JSON.
+// When the writer can't flush, all frames are read ahead instead and written at once, with their total length.
+func (p *proxy) writeStreamed(writer http.ResponseWriter, client rpc.Riff_InvokeClient, request *http.Request,
+	route *route, format streamFormat) error {
+	flusher, _ := writer.(http.Flusher)
+	readAhead := p.headerReadAhead()
+	buffered := !flushable(writer)
+	if buffered {
+		p.unflushableWarning.Do(func() {
+			log.Printf("response writer can't flush, buffering streamed responses")
+		})
+		readAhead = math.MaxInt32
+	}
+	response := &responseWriter{
+		writer:       writer,
+		flusher:      flusher,
+		readAhead:    readAhead,
+		exactLength:  buffered,
+		lineBuffered: p.lineBuffered,
+	}
+	if !buffered {
+		response.splitSize = p.outputWriteSize
+	}
+	if p.reorderSize > 0 {
+		client = newReorderingClient(client, p.reorderSize, p.reorderWait)
+	}
+	if format == streamEvents && p.sseHeartbeat > 0 && !buffered {
+		client = &heartbeatClient{
+			Riff_InvokeClient: client,
+			response:          response,
+			interval:          p.sseHeartbeat,
+			untilData:         p.sseHeartbeatUntilData,
+		}
+	}
+	var written int64
+	var sequence outputSequence
+	var contentTypeWarned bool
+	eventID := firstEventID(request)
+	text := p.newUTF8Validator(format != streamPayloads)
+	for {
+		outputSignal, err := client.Recv()
+		if err == io.EOF {
+			tail, err := text.end()
+			if err != nil {
+				return response.cut(err)
+			}
+			if tail != nil {
+				if err := response.write(&rpc.OutputFrame{Payload: tail}); err != nil {
+					return err
+				}
+			}
+			return response.close()
+		} else if err != nil {
+			// once the status has been sent, the best we can do is to cut the response short
+			return response.cut(err)
+		}
+		p.metrics.outputFrameReceived()
+		frame, err := dataFrame(outputSignal)
+		if err != nil {
+			return response.cut(err)
+		}
+		if err := sequence.verify(frame, p.metrics); err != nil {
+			return response.cut(err)
+		}
+		if err := decodeOutputFrame(frame); err != nil {
+			return response.cut(err)
+		}
+		if p.skippedOutput(response, frame) {
+			continue
+		}
+		if err := text.validate(frame); err != nil {
+			return response.cut(err)
+		}
+		switch format {
+		case streamPayloads:
+			if err := p.contentTypeChange(response, frame, &contentTypeWarned); err != nil {
+				return response.cut(err)
+			}
+		case streamNDJSON:
+			if err := p.ndjsonLine(frame); err != nil {
+				return response.cut(err)
+			}
+		case streamEvents:
+			if err := p.sseEvent(frame, eventID); err != nil {
+				return response.cut(err)
+			}
+			eventID++
+		}
+		written += int64(len(frame.Payload))
+		if p.exceedsOutputLimit(route, written) {
+			return response.cut(p.outputLimitError(route))
+		}
+		if err := response.write(frame); err != nil {
+			return err
+		}
+	}
 }
 
-func writeHeaderFromGrpcError(grpcError *status.Status, writer http.ResponseWriter) {
-	if grpcError.Code() != codes.InvalidArgument {
-		writer.WriteHeader(http.StatusInternalServerError)
-	} else if strings.HasPrefix(grpcError.Message(), "Invoker: Unsupported Media Type") {
-		writer.WriteHeader(http.StatusUnsupportedMediaType)
-	} else if strings.HasPrefix(grpcError.Message(), "Invoker: Not Acceptable") {
-		writer.WriteHeader(http.StatusNotAcceptable)
-	} else {
-		writer.WriteHeader(http.StatusInternalServerError)
+// dataFrame returns the output frame carried by a signal. Data is the only kind of output signal in the riff protocol,
+// failures being reported through the status of the stream, so anything else is a protocol violation by the backend.
+func dataFrame(outputSignal *rpc.OutputSignal) (*rpc.OutputFrame, error) {
+	switch frame := outputSignal.GetFrame().(type) {
+	case *rpc.OutputSignal_Data:
+		if frame.Data != nil {
+			return frame.Data, nil
+		}
+	}
+	return nil, httpErrorf(http.StatusBadGateway, "unexpected output signal %T", outputSignal.GetFrame())
+}
+
+// writeOutputHeaders sets the response headers from those of the given output frames, later frames taking precedence,
+// and returns the response status set by the function with the X-Riff-Status header, 200 by default.
+func writeOutputHeaders(writer http.ResponseWriter, outputFrames ...*rpc.OutputFrame) (int, error) {
+	header := http.Header{}
+	for i, outputFrame := range outputFrames {
+		if i == 0 || outputFrame.ContentType != "" {
+			header.Set("content-type", outputFrame.ContentType)
+		}
+		for h, v := range outputFrame.Headers {
+			header.Set(h, v)
+		}
+	}
+	status := http.StatusOK
+	if value := header.Get(statusHeader); value != "" {
+		var err error
+		if status, err = strconv.Atoi(value); err != nil || status < 200 || status > 599 {
+			return 0, httpErrorf(http.StatusBadGateway, "invalid %s header %q", statusHeader, value)
+		}
+		header.Del(statusHeader)
+	}
+	for h, v := range header {
+		writer.Header()[h] = v
+	}
+	return status, nil
+}
+
+// sendError returns the actual cause of a failed Send. When the stream was aborted by the backend, Send only
+// reports io.EOF and the status has to be discovered by receiving.
+func sendError(client rpc.Riff_InvokeClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if _, recvErr := client.Recv(); recvErr != nil && recvErr != io.EOF {
+		return recvErr
 	}
+	return err
 }
@@ -1,19 +1,27 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
 	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_invokeGrpc_input_startFrame(t *testing.T) {
@@ -48,6 +56,20 @@ func Test_invokeGrpc_input_dataFrame(t *testing.T) {
 	assert.Equal(t, dataFrame.Headers["X-Custom-Header"], "header-value")
 }
 
+func Test_frameHeaders(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Add("Content-Type", "text/plain")
+	request.Header.Add("X-Multiple", "first")
+	request.Header.Add("X-Multiple", "second")
+	request.Header["X-Empty"] = []string{}
+
+	headers := frameHeaders(request)
+
+	assert.Equal(t, map[string]string{"Content-Type": "text/plain", "X-Multiple": "first"}, headers)
+	headers["Content-Type"] = "application/json"
+	assert.Equal(t, "text/plain", request.Header.Get("Content-Type"))
+}
+
 func Test_invokeGrpc_output(t *testing.T) {
 	riffClient, _ := mockRiffClientWithResponse("<data>some response</data>", "application/xml")
 	p := &proxy{riffClient: riffClient}
@@ -98,6 +120,32 @@ func Test_unsupported_request_method(t *testing.T) {
 	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
 }
 
+func Test_options(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithAcceptedContentTypes([]string{"application/json", "text/plain"})(p)
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Equal(t, "OPTIONS, POST", responseRecorder.Header().Get("Allow"))
+	assert.Equal(t, "application/json, text/plain", responseRecorder.Header().Get("Accept-Post"))
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_options_any_content_type(t *testing.T) {
+	p := &proxy{}
+
+	request, _ := http.NewRequest("OPTIONS", "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNoContent, responseRecorder.Code)
+	assert.Equal(t, "*/*", responseRecorder.Header().Get("Accept-Post"))
+}
+
 func Test_unsupported_request_path(t *testing.T) {
 	riffClient, _ := mockRiffClient()
 	p := &proxy{riffClient: riffClient}
@@ -125,6 +173,488 @@ func Test_unsupported_content_type(t *testing.T) {
 	assert.Equal(t, errorMsg+"\n", responseRecorder.Body.String())
 }
 
+func Test_invokeGrpc_buffered_contentLength(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	server := httptest.NewServer(http.HandlerFunc(p.invokeGrpc))
+	defer server.Close()
+
+	response, err := http.Post(server.URL, "text/plain", strings.NewReader(""))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, int64(len("some response")), response.ContentLength)
+	assert.Equal(t, "13", response.Header.Get("Content-Length"))
+	assert.Empty(t, response.TransferEncoding)
+}
+
+func Test_invokeGrpc_streaming(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	server := httptest.NewServer(http.HandlerFunc(p.invokeGrpc))
+	defer server.Close()
+
+	response, err := http.Post(server.URL, "text/plain", strings.NewReader(""))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	assert.Equal(t, "one,two", string(body))
+	assert.Equal(t, "text/plain", response.Header.Get("Content-Type"))
+	assert.Equal(t, int64(-1), response.ContentLength)
+	assert.Empty(t, response.Header.Get("Content-Length"))
+	assert.Equal(t, []string{"chunked"}, response.TransferEncoding)
+}
+
+func Test_invokeGrpc_unexpected_output_signal(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(&rpc.OutputSignal{})
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+	assert.Equal(t, "unexpected output signal <nil>\n", responseRecorder.Body.String())
+}
+
+func Test_invokeGrpc_streaming_unexpected_output_signal(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		&rpc.OutputSignal{},
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "unexpected output signal <nil>", response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_invokeGrpc_streaming_backend_error(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Return(outputSignal("one,", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(outputSignal("two,", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Internal, "function crashed"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(p.invokeGrpc))
+	// the server complains about any attempt to write an error status once the response started
+	var serverLog bytes.Buffer
+	server.Config.ErrorLog = log.New(&serverLog, "", 0)
+	server.Start()
+	defer server.Close()
+
+	response, err := http.Post(server.URL, "text/plain", strings.NewReader("some body"))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "one,two,", string(body))
+	assert.Equal(t, "function crashed", response.Trailer.Get("X-Riff-Error"))
+	assert.Empty(t, serverLog.String())
+}
+
+// unflushableWriter hides the Flusher of the writer it wraps, as some middlewares do.
+type unflushableWriter struct {
+	http.ResponseWriter
+}
+
+func Test_invokeGrpc_streaming_input_completed_first(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	outputStarted := make(chan struct{})
+	halfClosed := make(chan struct{})
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(halfClosed) }).Return(nil).Once()
+	invokeClient.On("Recv").Return(outputSignal("one,", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Run(func(mock.Arguments) {
+		close(outputStarted)
+		select {
+		case <-halfClosed:
+		case <-time.After(time.Second):
+			t.Error("input not half-closed")
+		}
+	}).Return(outputSignal("two", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	body, bodyWriter := io.Pipe()
+	request, _ := http.NewRequest("POST", "/", body)
+	request.ProtoMajor = 2
+	responseRecorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		p.invokeGrpc(responseRecorder, request)
+		close(done)
+	}()
+	// the output is under way while the client is still sending its body
+	<-outputStarted
+	_, _ = bodyWriter.Write([]byte("some body"))
+	_ = bodyWriter.Close()
+	<-done
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "one,two", responseRecorder.Body.String())
+	assert.Equal(t, "some body", string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+	invokeClient.AssertNumberOfCalls(t, "CloseSend", 1)
+}
+
+func Test_invokeGrpc_streaming_unflushable(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		outputSignal("two,", "text/plain"),
+		outputSignal("three", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		p.invokeGrpc(unflushableWriter{writer}, request)
+	}))
+	defer server.Close()
+
+	response, err := http.Post(server.URL, "text/plain", strings.NewReader("some body"))
+	assert.NoError(t, err)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "one,two,three", string(body))
+	assert.Equal(t, int64(len("one,two,three")), response.ContentLength)
+	assert.Empty(t, response.TransferEncoding)
+}
+
+func Test_invokeGrpc_streaming_unflushable_backend_error(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Return(outputSignal("one,", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Internal, "function crashed"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(unflushableWriter{responseRecorder}, request)
+
+	// nothing was sent before the error, which is reported with a proper status
+	assert.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "function crashed")
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Error"))
+}
+
+func Test_invokeGrpc_start_frame_rejected(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.MatchedBy(isStartSignal)).Return(status.Error(codes.FailedPrecondition, "not ready"))
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, "not ready\n", responseRecorder.Body.String())
+	invokeClient.AssertNumberOfCalls(t, "Send", 1)
+	invokeClient.AssertNotCalled(t, "CloseSend")
+}
+
+func Test_invokeGrpc_start_frame_aborted(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.MatchedBy(isStartSignal)).Return(io.EOF)
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Unavailable, "shutting down"))
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	invokeClient.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func Test_invokeGrpc_response_mode_stream(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("X-Riff-Response-Mode", "stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "one,two", responseRecorder.Body.String())
+	assert.True(t, responseRecorder.Flushed)
+	assert.Empty(t, responseRecorder.Header().Get("Content-Length"))
+}
+
+func Test_invokeGrpc_response_mode_buffer(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("X-Riff-Response-Mode", "buffer")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "some response", responseRecorder.Body.String())
+	assert.False(t, responseRecorder.Flushed)
+	assert.Equal(t, "13", responseRecorder.Header().Get("Content-Length"))
+}
+
+func Test_invokeGrpc_response_mode_invalid(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("X-Riff-Response-Mode", "trickle")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_invokeGrpc_output_before_input_completes(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("early output", "text/plain"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	body, bodyWriter := io.Pipe()
+	writer := &notifyingWriter{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		request, _ := http.NewRequest("POST", "/", body)
+		// only HTTP/2 lets the body be read once the response has started
+		request.ProtoMajor = 2
+		p.invokeGrpc(writer, request)
+		close(done)
+	}()
+
+	select {
+	case <-writer.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output should be written while input is still being sent")
+	}
+	_, _ = bodyWriter.Write([]byte("late input"))
+	_ = bodyWriter.Close()
+	<-done
+
+	assert.Equal(t, "early output", writer.Body.String())
+}
+
+func Test_invokeGrpc_input_error_reported(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+
+	body, bodyWriter := io.Pipe()
+	_ = bodyWriter.CloseWithError(errors.New("connection reset"))
+	request, _ := http.NewRequest("POST", "/", body)
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.Equal(t, "connection reset\n", responseRecorder.Body.String())
+	invokeClient.AssertNotCalled(t, "CloseSend")
+}
+
+func Test_invokeGrpc_http1_input_sent_before_output(t *testing.T) {
+	for _, size := range []int{100 * 1024, 1024 * 1024} {
+		riffClient := &mocks.RiffClient{}
+		invokeClient := &mocks.Riff_InvokeClient{}
+		var received int
+		var lock sync.Mutex
+		var ctx context.Context
+		halfClosed := make(chan struct{})
+		riffClient.On("Invoke", mock.Anything).Run(func(args mock.Arguments) {
+			ctx = args.Get(0).(context.Context)
+		}).Return(invokeClient, nil)
+		invokeClient.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+			lock.Lock()
+			defer lock.Unlock()
+			received += len(args.Get(0).(*rpc.InputSignal).GetData().GetPayload())
+		}).Return(nil)
+		invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(halfClosed) }).Return(nil)
+		// the function writes its output straight away, before reading its input
+		invokeClient.On("Recv").Return(outputSignal("early output", "text/plain"), nil).Once()
+		invokeClient.On("Recv").Run(func(mock.Arguments) {
+			select {
+			case <-halfClosed:
+			case <-ctx.Done():
+			}
+		}).Return(nil, io.EOF)
+		p := &proxy{riffClient: riffClient, streaming: true}
+		WithInputChunking(1024)(p)
+		server := httptest.NewServer(p.handler())
+
+		// without a Content-Length, the body is sent with chunked transfer encoding
+		body := ioutil.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), size)))
+		response, err := http.Post(server.URL, "text/plain", body)
+		if assert.NoError(t, err) {
+			output, _ := ioutil.ReadAll(response.Body)
+			_ = response.Body.Close()
+
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, "early output", string(output))
+			assert.Empty(t, response.Trailer.Get("X-Riff-Error"))
+			lock.Lock()
+			assert.Equal(t, size, received)
+			lock.Unlock()
+		}
+		server.Close()
+	}
+}
+
+func Test_invokeGrpc_http1_echo_beyond_flow_control(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterRiffServer(grpcServer, streamingEchoServer{})
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &proxy{riffClient: rpc.NewRiffClient(conn), streaming: true}
+	WithInputChunking(1024)(p)
+	server := httptest.NewServer(p.handler())
+	defer server.Close()
+
+	// far more than gRPC flow control lets the function send before its output is received
+	size := 8 << 20
+	body := ioutil.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), size)))
+	response, err := http.Post(server.URL, "text/plain", body)
+	if assert.NoError(t, err) {
+		output, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, size, len(output))
+		assert.Empty(t, response.Trailer.Get("X-Riff-Error"))
+	}
+}
+
+func Test_invokeGrpc_http1_held_output_exceeded(t *testing.T) {
+	var ctx context.Context
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	}).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.MatchedBy(isStartSignal)).Return(nil)
+	// the function never reads its input, while answering with more than can be held back
+	invokeClient.On("Send", mock.MatchedBy(isDataSignal)).Run(func(mock.Arguments) {
+		<-ctx.Done()
+	}).Return(status.Error(codes.Canceled, "context canceled"))
+	invokeClient.On("Recv").Return(outputSignal(strings.Repeat("x", 1<<20), "text/plain"), nil)
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some input"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+	assert.Equal(t, fmt.Sprintf("output exceeds %d bytes before the request body was sent, which HTTP/2 clients can "+
+		"stream\n", maxHeldOutputBytes), responseRecorder.Body.String())
+}
+
+// streamingEchoServer answers each input data frame with an output frame of the same payload, as it goes.
+type streamingEchoServer struct{}
+
+func (streamingEchoServer) Invoke(stream rpc.Riff_InvokeServer) error {
+	for {
+		inputSignal, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if data := inputSignal.GetData(); data != nil {
+			if err := stream.Send(outputSignal(string(data.Payload), "text/plain")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func Test_invokeGrpc_http1_input_error_before_output(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("early output", "text/plain"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	body, bodyWriter := io.Pipe()
+	request, _ := http.NewRequest("POST", "/", body)
+	responseRecorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		p.invokeGrpc(responseRecorder, request)
+		close(done)
+	}()
+	_, _ = bodyWriter.Write([]byte("some "))
+	_ = bodyWriter.CloseWithError(errors.New("connection reset"))
+	<-done
+
+	// the output is held back until the body has been read, which failed
+	assert.Equal(t, http.StatusInternalServerError, responseRecorder.Code)
+	assert.Equal(t, "connection reset\n", responseRecorder.Body.String())
+}
+
+func Test_invokeGrpc_http2_input_error_once_started(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(outputSignal("early output", "text/plain"))
+	p := &proxy{riffClient: riffClient, streaming: true}
+
+	body, bodyWriter := io.Pipe()
+	writer := &notifyingWriter{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		request, _ := http.NewRequest("POST", "/", body)
+		request.ProtoMajor = 2
+		p.invokeGrpc(writer, request)
+		close(done)
+	}()
+	<-writer.written
+	_ = bodyWriter.CloseWithError(errors.New("connection reset"))
+	<-done
+
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, "early output", writer.Body.String())
+	assert.Equal(t, "connection reset", writer.Result().Trailer.Get("X-Riff-Error"))
+}
+
+// notifyingWriter signals the first write to the response body.
+type notifyingWriter struct {
+	*httptest.ResponseRecorder
+	written chan struct{}
+	once    sync.Once
+}
+
+func (w *notifyingWriter) Write(b []byte) (int, error) {
+	defer w.once.Do(func() { close(w.written) })
+	return w.ResponseRecorder.Write(b)
+}
+
 func inputSignals(calls []mock.Call) []*rpc.InputSignal {
 	var inputSignals []*rpc.InputSignal
 	for _, call := range calls {
@@ -136,27 +666,71 @@ func inputSignals(calls []mock.Call) []*rpc.InputSignal {
 	return inputSignals
 }
 
+func Test_shutdown_twice(t *testing.T) {
+	p, _ := NewProxy(":0", ":0", WithWarmup(time.Minute), WithConnectionReaper(time.Minute))
+
+	assert.NotPanics(t, func() {
+		assert.NoError(t, p.Shutdown(context.Background()))
+		assert.NoError(t, p.Shutdown(context.Background()))
+	})
+}
+
 func mockRiffClient() (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
 	return mockRiffClientWithResponse("", "")
 }
 
 func mockRiffClientWithResponse(outputBody string, contentType string) (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
+	return mockRiffClientWithFrames(outputSignal(outputBody, contentType))
+}
+
+// mockRiffClientWithFrames returns a client whose invocation outputs the given signals, in order.
+func mockRiffClientWithFrames(outputSignals ...*rpc.OutputSignal) (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
 	riffClient := &mocks.RiffClient{}
 	invokeClient := &mocks.Riff_InvokeClient{}
-	riffClient.On("Invoke", context.Background()).Return(invokeClient, nil)
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
 	invokeClient.On("Send", mock.Anything).Return(nil)
 	invokeClient.On("CloseSend").Return(nil)
-	invokeClient.On("Recv").Return(outputSignal(outputBody, contentType), nil).Once()
+	for _, signal := range outputSignals {
+		invokeClient.On("Recv").Return(signal, nil).Once()
+	}
 	invokeClient.On("Recv").Return(nil, io.EOF)
 	return riffClient, invokeClient
 }
 
+// mockRiffClientWithRepeatedResponse returns a client that can be invoked the given number of times, each
+// invocation responding with the same output.
+func mockRiffClientWithRepeatedResponse(times int, outputBody string, contentType string) *mocks.RiffClient {
+	riffClient := &mocks.RiffClient{}
+	for i := 0; i < times; i++ {
+		_, invokeClient := mockRiffClientWithResponse(outputBody, contentType)
+		riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil).Once()
+	}
+	return riffClient
+}
+
+// mockRiffClientUntilCancelled returns a client whose invocation produces no output until cancelled.
+func mockRiffClientUntilCancelled() (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
+	var ctx context.Context
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	}).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) {
+		<-ctx.Done()
+	}).Return(nil, status.Error(codes.Canceled, "context canceled"))
+	return riffClient, invokeClient
+}
+
 func mockRiffClientWithError(code codes.Code, msg string) (*mocks.RiffClient, *mocks.Riff_InvokeClient) {
 	riffClient := &mocks.RiffClient{}
 	invokeClient := &mocks.Riff_InvokeClient{}
-	riffClient.On("Invoke", context.Background()).Return(invokeClient, nil)
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
 	invokeClient.On("Send", mock.MatchedBy(isStartSignal)).Return(nil)
 	invokeClient.On("Send", mock.MatchedBy(isDataSignal)).Return(status.Error(code, msg))
+	invokeClient.On("Recv").Return(nil, status.Error(code, msg))
 	return riffClient, invokeClient
 }
 
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithRateLimit limits each client to rate requests per second, allowing bursts of up to burst requests.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(p *proxy) {
+		if rate > 0 {
+			if burst < 1 {
+				burst = int(math.Ceil(rate))
+			}
+			p.limiter = newRateLimiter(rate, burst, time.Now)
+		}
+	}
+}
+
+// WithClientIPHeader identifies clients by the given header (e.g. X-Forwarded-For) rather than by their remote
+// address, but only for requests coming from one of the trusted proxies.
+func WithClientIPHeader(header string, trustedProxies []*net.IPNet) Option {
+	return func(p *proxy) {
+		p.clientIPHeader = http.CanonicalHeaderKey(header)
+		p.trustedProxies = trustedProxies
+	}
+}
+
+func (p *proxy) limitRate(next http.Handler) http.Handler {
+	if p.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if wait := p.limiter.take(p.clientIP(request)); wait > 0 {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			p.writeError(writer, request, httpErrorf(http.StatusTooManyRequests, "rate limit exceeded"))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// clientIP returns the address of the client at the origin of the request. The configured client IP header is only
+// honored when the request comes from a trusted proxy, in which case the right-most address not belonging to a
+// trusted proxy is used.
+func (p *proxy) clientIP(request *http.Request) string {
+	remote := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if p.clientIPHeader == "" || !p.isTrustedProxy(remote) {
+		return remote
+	}
+	hops := strings.Split(strings.Join(request.Header[p.clientIPHeader], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		remote = hop
+		if !p.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return remote
+}
+
+func (p *proxy) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter maintains a token bucket per client, forgetting the least recently seen clients once full.
+type rateLimiter struct {
+	rate     float64 // tokens per second
+	burst    float64
+	now      func() time.Time
+	capacity int
+
+	mutex   sync.Mutex
+	order   *list.List // of *bucket, most recently seen first
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is the number of clients tracked at once. The least recently seen ones are likely to have refilled their
+// bucket, which makes forgetting them mostly harmless.
+const maxBuckets = 10000
+
+func newRateLimiter(rate float64, burst int, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		now:      now,
+		capacity: maxBuckets,
+		order:    list.New(),
+		buckets:  make(map[string]*list.Element),
+	}
+}
+
+// take consumes a token for the given client, returning zero on success or how long to wait for the next token.
+func (l *rateLimiter) take(client string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	var b *bucket
+	if element, ok := l.buckets[client]; ok {
+		l.order.MoveToFront(element)
+		b = element.Value.(*bucket)
+	} else {
+		if len(l.buckets) >= l.capacity {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).client)
+		}
+		b = &bucket{client: client, tokens: l.burst, last: now}
+		l.buckets[client] = l.order.PushFront(b)
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_rateLimit_rejects_beyond_burst(t *testing.T) {
+	p := &proxy{riffClient: mockRiffClientWithRepeatedResponse(2, "ok", "text/plain")}
+	WithRateLimit(1, 2)(p)
+	handler := p.handler()
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+		request.RemoteAddr = "10.0.0.1:1234"
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, request)
+		codes = append(codes, responseRecorder.Code)
+		if responseRecorder.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "1", responseRecorder.Header().Get("Retry-After"))
+		}
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func Test_rateLimit_per_client(t *testing.T) {
+	limiter := newRateLimiter(1, 1, time.Now)
+
+	assert.Zero(t, limiter.take("10.0.0.1"))
+	assert.NotZero(t, limiter.take("10.0.0.1"))
+	assert.Zero(t, limiter.take("10.0.0.2"))
+}
+
+func Test_rateLimit_refills(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(2, 1, func() time.Time { return now })
+
+	assert.Zero(t, limiter.take("client"))
+	assert.Equal(t, 500*time.Millisecond, limiter.take("client"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Zero(t, limiter.take("client"))
+}
+
+func Test_rateLimit_forgets_least_recently_seen(t *testing.T) {
+	limiter := newRateLimiter(1, 1, time.Now)
+	limiter.capacity = 2
+
+	assert.Zero(t, limiter.take("10.0.0.1"))
+	assert.Zero(t, limiter.take("10.0.0.2"))
+	assert.NotZero(t, limiter.take("10.0.0.1"))
+	assert.Zero(t, limiter.take("10.0.0.3"))
+
+	assert.Len(t, limiter.buckets, 2)
+	assert.NotZero(t, limiter.take("10.0.0.1"))
+	// forgotten, hence starting over with a full bucket
+	assert.Zero(t, limiter.take("10.0.0.2"))
+}
+
+func Test_clientIP_untrusted_proxy(t *testing.T) {
+	p := &proxy{}
+	WithClientIPHeader("x-forwarded-for", nil)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	assert.Equal(t, "10.0.0.1", p.clientIP(request))
+}
+
+func Test_clientIP_trusted_proxy(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	p := &proxy{}
+	WithClientIPHeader("x-forwarded-for", []*net.IPNet{network})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2")
+
+	assert.Equal(t, "1.2.3.4", p.clientIP(request))
+}
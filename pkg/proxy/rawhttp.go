@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+)
+
+// rawHTTPContentType is the media type of an http message in HTTP/1.1 wire format.
+const rawHTTPContentType = "message/http"
+
+// WithRawHTTP hands the whole http request (method, path, headers and body) to the function as a single frame in
+// HTTP/1.1 wire format, and expects the output frame to be a whole http response in the same format.
+func WithRawHTTP() Option {
+	return func(p *proxy) {
+		p.rawHTTP = true
+	}
+}
+
+// rawInputFrame serializes the request in HTTP/1.1 wire format. The body is always delimited by a Content-Length.
+func rawInputFrame(request *http.Request, argIndex int32) (*rpc.InputFrame, error) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	raw := *request
+	raw.Header = request.Header.Clone()
+	raw.Header.Del("Transfer-Encoding")
+	raw.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	raw.TransferEncoding = nil
+	raw.ContentLength = int64(len(body))
+	raw.Body = ioutil.NopCloser(bytes.NewReader(body))
+	dump, err := httputil.DumpRequest(&raw, true)
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.InputFrame{
+		ContentType: rawHTTPContentType,
+		ArgIndex:    argIndex,
+		Payload:     dump,
+	}, nil
+}
+
+// writeRaw expects exactly one output frame, holding an http response in HTTP/1.1 wire format, and writes it back.
+func (p *proxy) writeRaw(writer http.ResponseWriter, client rpc.Riff_InvokeClient, request *http.Request,
+	route *route) error {
+	outputSignal, err := client.Recv()
+	if err != nil {
+		return err
+	}
+	if _, err := client.Recv(); err != io.EOF {
+		return errors.New("expected EOF")
+	}
+	frame, err := dataFrame(outputSignal)
+	if err != nil {
+		return err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(frame.Payload)), request)
+	if err != nil {
+		return httpErrorf(http.StatusBadGateway, "invalid raw http response: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return httpErrorf(http.StatusBadGateway, "invalid raw http response: %v", err)
+	}
+	if p.exceedsOutputLimit(route, int64(len(body))) {
+		return p.outputLimitError(route)
+	}
+
+	for h, v := range response.Header {
+		writer.Header()[h] = v
+	}
+	// the body has been decoded already
+	writer.Header().Del("transfer-encoding")
+	writer.Header().Set("content-length", strconv.Itoa(len(body)))
+	writer.WriteHeader(response.StatusCode)
+	_, err = writer.Write(body)
+	return err
+}
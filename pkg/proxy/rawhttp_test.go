@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_rawHTTP_request_serialization(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("HTTP/1.1 200 OK\r\n\r\n", "message/http")
+	p := &proxy{riffClient: riffClient}
+	WithRawHTTP()(p)
+
+	request, _ := http.NewRequest("POST", "/?q=1", strings.NewReader("some body"))
+	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("X-Custom-Header", "header-value")
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	inputSignals := inputSignals(invokeClient.Calls)
+	assert.Equal(t, []string{"message/http"}, inputSignals[0].GetStart().ExpectedContentTypes)
+	dataFrame := inputSignals[1].GetData()
+	assert.Equal(t, "message/http", dataFrame.ContentType)
+
+	forwarded, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(dataFrame.Payload)))
+	assert.NoError(t, err)
+	assert.Equal(t, "POST", forwarded.Method)
+	assert.Equal(t, "/?q=1", forwarded.URL.String())
+	assert.Equal(t, "header-value", forwarded.Header.Get("X-Custom-Header"))
+	body, _ := ioutil.ReadAll(forwarded.Body)
+	assert.Equal(t, "some body", string(body))
+}
+
+func Test_rawHTTP_response_parsing(t *testing.T) {
+	rawResponse := "HTTP/1.1 201 Created\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Location: /things/1\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"b\r\n{\"id\": \"1\"}\r\n0\r\n\r\n"
+	riffClient, _ := mockRiffClientWithResponse(rawResponse, "message/http")
+	p := &proxy{riffClient: riffClient}
+	WithRawHTTP()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusCreated, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "/things/1", responseRecorder.Header().Get("Location"))
+	assert.Equal(t, "11", responseRecorder.Header().Get("Content-Length"))
+	assert.Empty(t, responseRecorder.Header().Get("Transfer-Encoding"))
+	assert.Equal(t, `{"id": "1"}`, responseRecorder.Body.String())
+}
+
+func Test_rawHTTP_invalid_response(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("not http", "message/http")
+	p := &proxy{riffClient: riffClient}
+	WithRawHTTP()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+// statusHeader lets functions set the status of the response from the headers of an output frame.
+const statusHeader = "X-Riff-Status"
+
+// maxHeaderReadAhead bounds the number of output frames held back before committing a streamed response.
+const maxHeaderReadAhead = 8
+
+// WithHeaderReadAhead holds back up to the given number of output frames of streamed responses before committing the
+// response status and headers, merging the headers of those frames. This lets functions emit leading metadata frames,
+// typically with an empty payload, that set headers or the status of the response. The number of frames is capped to
+// a small limit, to bound the amount of buffered output.
+func WithHeaderReadAhead(frames int) Option {
+	return func(p *proxy) {
+		if frames > maxHeaderReadAhead {
+			frames = maxHeaderReadAhead
+		}
+		p.readAheadFrames = frames
+	}
+}
+
+// headerReadAhead returns the number of output frames to read before committing a streamed response.
+func (p *proxy) headerReadAhead() int {
+	if p.readAheadFrames < 1 {
+		return 1
+	}
+	return p.readAheadFrames
+}
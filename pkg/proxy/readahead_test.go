@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_read_ahead_metadata_frame(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		metadataSignal(map[string]string{"X-Riff-Status": "201", "Location": "/orders/1"}),
+		outputSignal("one,", "text/plain"),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithHeaderReadAhead(2)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusCreated, responseRecorder.Code)
+	assert.Equal(t, "/orders/1", responseRecorder.Header().Get("Location"))
+	assert.Equal(t, "text/plain", responseRecorder.Header().Get("Content-Type"))
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Status"))
+	assert.Equal(t, "one,two", responseRecorder.Body.String())
+}
+
+func Test_read_ahead_stream_shorter(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		metadataSignal(map[string]string{"X-Riff-Status": "202"}),
+		outputSignal("one", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithHeaderReadAhead(4)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusAccepted, responseRecorder.Code)
+	assert.Equal(t, "one", responseRecorder.Body.String())
+}
+
+func Test_read_ahead_error_before_commit(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Return(outputSignal("one", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Unavailable, "shutting down"))
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithHeaderReadAhead(2)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Equal(t, "shutting down\n", responseRecorder.Body.String())
+}
+
+func Test_read_ahead_disabled(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		metadataSignal(map[string]string{"X-Riff-Status": "201"}),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "one,two", responseRecorder.Body.String())
+}
+
+func Test_read_ahead_capped(t *testing.T) {
+	p := &proxy{}
+	WithHeaderReadAhead(1000)(p)
+
+	assert.Equal(t, maxHeaderReadAhead, p.headerReadAhead())
+}
+
+func Test_output_status_buffered(t *testing.T) {
+	signal := outputSignal("not here", "text/plain")
+	signal.GetData().Headers = map[string]string{"x-riff-status": "404"}
+	riffClient, _ := mockRiffClientWithFrames(signal)
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotFound, responseRecorder.Code)
+	assert.Equal(t, "not here", responseRecorder.Body.String())
+	assert.Equal(t, "8", responseRecorder.Header().Get("Content-Length"))
+}
+
+func Test_output_status_invalid(t *testing.T) {
+	signal := outputSignal("some response", "text/plain")
+	signal.GetData().Headers = map[string]string{"X-Riff-Status": "ok"}
+	riffClient, _ := mockRiffClientWithFrames(signal)
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadGateway, responseRecorder.Code)
+	assert.Equal(t, "invalid X-Riff-Status header \"ok\"\n", responseRecorder.Body.String())
+}
+
+// metadataSignal returns an output signal with no payload, only headers.
+func metadataSignal(headers map[string]string) *rpc.OutputSignal {
+	return &rpc.OutputSignal{
+		Frame: &rpc.OutputSignal_Data{
+			Data: &rpc.OutputFrame{Headers: headers},
+		},
+	}
+}
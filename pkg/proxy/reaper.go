@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"sync"
+	"time"
+)
+
+// reasons for a backend connection to be reaped
+const (
+	reapIdle      = "idle"
+	reapUnhealthy = "unhealthy"
+)
+
+// WithConnectionReaper closes the connections to route backends that went unused, or stayed unhealthy, for longer
+// than maxIdle, so that stale connections don't accumulate. Connections are checked at that interval, and dialed again
+// on next use. Connections with invocations in flight are left alone.
+func WithConnectionReaper(maxIdle time.Duration) Option {
+	return func(p *proxy) {
+		if maxIdle > 0 {
+			p.reaperMaxIdle = maxIdle
+			p.reaperStop = make(chan struct{})
+		}
+	}
+}
+
+// pooledConn is a client of a route backend whose connection may be reaped, to be dialed again on next use.
+type pooledConn struct {
+	target string
+	dial   func(target string) (*grpc.ClientConn, error)
+
+	lock     sync.Mutex
+	conn     *grpc.ClientConn
+	inFlight int
+	lastUsed time.Time
+	// unhealthySince is when the connection was first seen failing, if it still is
+	unhealthySince time.Time
+}
+
+func newPooledConn(target string, dial func(string) (*grpc.ClientConn, error), conn *grpc.ClientConn) *pooledConn {
+	return &pooledConn{target: target, dial: dial, conn: conn, lastUsed: time.Now()}
+}
+
+// Invoke starts an invocation, dialing the backend first if the connection was reaped. The invocation is accounted
+// for until its context ends.
+func (c *pooledConn) Invoke(ctx context.Context, opts ...grpc.CallOption) (rpc.Riff_InvokeClient, error) {
+	c.lock.Lock()
+	if c.conn == nil {
+		conn, err := c.dial(c.target)
+		if err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+		c.conn = conn
+	}
+	client := rpc.NewRiffClient(c.conn)
+	c.inFlight++
+	c.lock.Unlock()
+
+	stream, err := client.Invoke(ctx, opts...)
+	if err != nil {
+		c.done()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		c.done()
+	}()
+	return stream, nil
+}
+
+func (c *pooledConn) done() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.inFlight--
+	c.lastUsed = time.Now()
+}
+
+// reap closes the connection if it has been idle, or unhealthy, for maxIdle, returning the reason why.
+func (c *pooledConn) reap(now time.Time, maxIdle time.Duration) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil || c.inFlight > 0 {
+		return ""
+	}
+	if c.conn.GetState() != connectivity.TransientFailure {
+		c.unhealthySince = time.Time{}
+	} else if c.unhealthySince.IsZero() {
+		c.unhealthySince = now
+	}
+	var reason string
+	switch {
+	case !c.unhealthySince.IsZero() && now.Sub(c.unhealthySince) >= maxIdle:
+		reason = reapUnhealthy
+	case now.Sub(c.lastUsed) >= maxIdle:
+		reason = reapIdle
+	default:
+		return ""
+	}
+	_ = c.conn.Close()
+	c.conn = nil
+	c.unhealthySince = time.Time{}
+	return reason
+}
+
+// reapConnections closes the route backend connections that are idle or unhealthy.
+func (p *proxy) reapConnections(now time.Time) {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+	for _, client := range p.clients {
+		if pooled, ok := client.(*pooledConn); ok {
+			if reason := pooled.reap(now, p.reaperMaxIdle); reason != "" {
+				p.metrics.connectionReaped(reason)
+			}
+		}
+	}
+}
+
+// reaperLoop reaps connections at the configured interval, until stop is closed.
+func (p *proxy) reaperLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.reaperMaxIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			p.reapConnections(now)
+		}
+	}
+}
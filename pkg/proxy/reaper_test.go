@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// okServer answers every invocation with an ok output frame.
+type okServer struct{}
+
+func (okServer) Invoke(stream rpc.Riff_InvokeServer) error {
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return stream.Send(outputSignal("ok", "text/plain"))
+}
+
+func startOKServer(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	rpc.RegisterRiffServer(server, okServer{})
+	go server.Serve(listener)
+	return listener.Addr().String(), server.Stop
+}
+
+// invokeOK performs a whole invocation through client.
+func invokeOK(t *testing.T, client rpc.RiffClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Invoke(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, stream.CloseSend())
+	output, err := stream.Recv()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ok", string(output.GetData().Payload))
+	}
+}
+
+// settled waits for the invocations through a pooled connection to be accounted as done, once their context ended.
+func settled(t *testing.T, pooled *pooledConn) {
+	assert.Eventually(t, func() bool {
+		pooled.lock.Lock()
+		defer pooled.lock.Unlock()
+		return pooled.inFlight == 0
+	}, time.Second, time.Millisecond)
+}
+
+func Test_connection_reaper_idle(t *testing.T) {
+	target, stop := startOKServer(t)
+	defer stop()
+	p := &proxy{}
+	WithConnectionReaper(time.Minute)(p)
+	WithMetrics("/metrics")(p)
+	WithRoutes([]Route{{Prefix: "/fn", Target: target}})(p)
+	assert.NoError(t, p.dialRoutes(p.routes))
+	pooled := p.clients[target].(*pooledConn)
+	invokeOK(t, pooled)
+	settled(t, pooled)
+
+	p.reapConnections(time.Now().Add(30 * time.Second))
+	assert.NotNil(t, pooled.conn, "recently used connection should be kept")
+
+	conn := pooled.conn
+	p.reapConnections(time.Now().Add(time.Minute))
+	assert.Nil(t, pooled.conn)
+	assert.Equal(t, connectivity.Shutdown, conn.GetState())
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.reapedConns.WithLabelValues("idle")))
+
+	// dialed again on next use
+	invokeOK(t, pooled)
+	assert.NotNil(t, pooled.conn)
+}
+
+func Test_connection_reaper_in_flight(t *testing.T) {
+	target, stop := startOKServer(t)
+	defer stop()
+	pooled := newPooledConn(target, (&proxy{}).dial, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := pooled.Invoke(ctx)
+	assert.NoError(t, err)
+
+	assert.Empty(t, pooled.reap(time.Now().Add(time.Hour), time.Minute))
+	assert.NotNil(t, pooled.conn)
+
+	cancel()
+	settled(t, pooled)
+	assert.Equal(t, reapIdle, pooled.reap(time.Now().Add(time.Hour), time.Minute))
+}
+
+func Test_connection_reaper_unhealthy(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	_ = listener.Close()
+	conn, err := (&proxy{}).dial(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for state := conn.GetState(); state != connectivity.TransientFailure; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			t.Fatal("connection not failing")
+		}
+	}
+	pooled := newPooledConn(target, (&proxy{}).dial, conn)
+
+	now := time.Now()
+	assert.Empty(t, pooled.reap(now, time.Minute))
+	assert.Equal(t, reapUnhealthy, pooled.reap(now.Add(time.Minute), time.Minute))
+	assert.Nil(t, pooled.conn)
+}
+
+func Test_connection_reaper_disabled_by_default(t *testing.T) {
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn", Target: "localhost:0"}})(p)
+	assert.NoError(t, p.dialRoutes(p.routes))
+
+	_, pooled := p.clients["localhost:0"].(*pooledConn)
+	assert.False(t, pooled)
+}
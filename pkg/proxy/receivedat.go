@@ -0,0 +1,45 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// receivedAtHeader is the input frame header telling when the adapter received the request, in RFC 3339 format.
+const receivedAtHeader = "X-Riff-Received-At"
+
+// WithReceivedAtHeader sets an X-Riff-Received-At header on the input frames of each request, telling when the adapter
+// received it, in RFC 3339 format with nanoseconds and in UTC, so that functions can measure their latency from the
+// edge. A header of the same name set by the client is replaced.
+func WithReceivedAtHeader() Option {
+	return func(p *proxy) {
+		p.receivedAtHeader = true
+	}
+}
+
+func (p *proxy) stampRequests(next http.Handler) http.Handler {
+	if !p.receivedAtHeader {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		receivedAt := time.Now().UTC().Format(time.RFC3339Nano)
+		ctx := ContextWithFrameHeader(request.Context(), receivedAtHeader, receivedAt)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
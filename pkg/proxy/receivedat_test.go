@@ -0,0 +1,57 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_received_at_header(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithReceivedAtHeader()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Riff-Received-At", "2000-01-01T00:00:00Z")
+	before := time.Now()
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+	after := time.Now()
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	value := inputSignals(invokeClient.Calls)[1].GetData().Headers["X-Riff-Received-At"]
+	receivedAt, err := time.Parse(time.RFC3339, value)
+	assert.NoError(t, err)
+	assert.False(t, receivedAt.Before(before), "the header set by the client should be replaced")
+	assert.False(t, receivedAt.After(after))
+	assert.True(t, strings.HasSuffix(value, "Z"))
+}
+
+func Test_received_at_header_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.NotContains(t, inputSignals(invokeClient.Calls)[1].GetData().Headers, "X-Riff-Received-At")
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"time"
+)
+
+// reloadable holds the settings that may change while serving, see Reload.
+type reloadable struct {
+	// maxInputBytes, when positive, limits the size of request bodies
+	maxInputBytes int64
+	// maxOutputBytes, when positive, limits the size of response bodies
+	maxOutputBytes int64
+	// maxInputFrames, when positive, limits the number of data frames sent per request
+	maxInputFrames int
+
+	// longPollWait, when positive, enables long polling with GET requests, for up to that long
+	longPollWait time.Duration
+	// invocationTimeout, when positive, limits how long invocations last
+	invocationTimeout time.Duration
+
+	// overrideMethods are the methods clients may tunnel through POST requests
+	overrideMethods []string
+	// rejectedContentTypes are the request media types rejected upfront
+	rejectedContentTypes []string
+	// acceptedContentTypes are the request content types advertised in answer to OPTIONS requests
+	acceptedContentTypes []string
+
+	// routes send requests to other backends by path, longest prefix first
+	routes []*route
+}
+
+// Reload replaces the settings that may change while serving with the ones set by the given options, all at once,
+// for the requests starting from then on. Those are the size limits, long polling, the invocation timeout, method
+// overrides, rejected and accepted content types, and routes, set by WithMaxInputBytes, WithMaxOutputBytes,
+// WithMaxInputFrames, WithLongPolling, WithInvocationTimeout, WithMethodOverride, WithRejectedContentTypes,
+// WithAcceptedContentTypes and WithRoutes. Settings not set by the options are disabled, other options are ignored.
+//
+// Connections to the backends of routes that went away are kept open, as requests in flight may still use them.
+func (p *proxy) Reload(options ...Option) error {
+	next := &proxy{}
+	for _, option := range options {
+		option(next)
+	}
+	if err := p.dialRoutes(next.routes); err != nil {
+		return err
+	}
+	p.reloaded.Store(&next.reloadable)
+	return nil
+}
+
+// current returns the reloadable settings in effect, the ones set by options until reloaded.
+func (p *proxy) current() *reloadable {
+	if settings, ok := p.reloaded.Load().(*reloadable); ok {
+		return settings
+	}
+	return &p.reloadable
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_reload_input_limit(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(1, "some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithMaxInputBytes(4)(p)
+	handler := p.handler()
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, responseRecorder.Code)
+
+	assert.NoError(t, p.Reload(WithMaxInputBytes(1024)))
+
+	request, _ = http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "some response", responseRecorder.Body.String())
+}
+
+func Test_reload_enables_disabled_settings(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	handler := p.handler()
+
+	assert.NoError(t, p.Reload(WithRejectedContentTypes([]string{"image/*"})))
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("content-type", "image/png")
+	responseRecorder := httptest.NewRecorder()
+	handler.ServeHTTP(responseRecorder, request)
+	assert.Equal(t, http.StatusUnsupportedMediaType, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke")
+}
+
+func Test_reload_resets_settings_not_given(t *testing.T) {
+	p := &proxy{}
+	WithMethodOverride([]string{"PUT"})(p)
+	WithLongPolling(time.Minute)(p)
+	WithAcceptedContentTypes([]string{"application/json"})(p)
+
+	assert.NoError(t, p.Reload(WithMaxOutputBytes(10)))
+
+	settings := p.current()
+	assert.Empty(t, settings.overrideMethods)
+	assert.Zero(t, settings.longPollWait)
+	assert.Empty(t, settings.acceptedContentTypes)
+	assert.Equal(t, int64(10), settings.maxOutputBytes)
+	// the settings set by options are left alone
+	assert.Equal(t, []string{"PUT"}, p.overrideMethods)
+}
+
+func Test_reload_routes(t *testing.T) {
+	clientA, _ := mockRiffClientWithResponse("from a", "text/plain")
+	clientB, _ := mockRiffClientWithResponse("from b", "text/plain")
+	p := &proxy{clients: map[string]rpc.RiffClient{"a:8081": clientA, "b:8081": clientB}}
+	WithRoutes([]Route{{Prefix: "/fn", Target: "a:8081"}})(p)
+	assert.NoError(t, p.dialRoutes(p.routes))
+
+	assert.NoError(t, p.Reload(WithRoutes([]Route{
+		{Prefix: "/fn", Target: "b:8081"},
+		{Prefix: "/new", Target: "localhost:0"},
+	})))
+
+	request, _ := http.NewRequest("POST", "/fn", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+	assert.Equal(t, "from b", responseRecorder.Body.String())
+	assert.NotNil(t, p.resolve("/new").backends[0].client)
+	assert.Len(t, p.clients, 3)
+	// the routes set by options are left alone
+	assert.Equal(t, clientA, p.routes[0].backends[0].client)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"strconv"
+	"time"
+)
+
+// WithOutputReordering holds up to size output frames numbered ahead of the next expected one, as told by their
+// X-Riff-Sequence header, so that frames a backend emits slightly out of order are written in order. The numbering
+// starts with the first numbered frame received. When the frame expected is still missing after the wait, if positive,
+// or once size frames are held, the frames held are written anyway and the missing ones reported as a gap. This trades
+// latency for ordering, and only applies to streamed responses.
+func WithOutputReordering(size int, wait time.Duration) Option {
+	return func(p *proxy) {
+		p.reorderSize = size
+		p.reorderWait = wait
+	}
+}
+
+// reorderingClient receives output frames in the order of their sequence numbers, holding those received ahead of
+// the next expected one. Frames that are not numbered, or numbered behind, are passed through for outputSequence to
+// verify.
+type reorderingClient struct {
+	rpc.Riff_InvokeClient
+	size int
+	wait time.Duration
+
+	started bool
+	next    int64
+	held    map[int64]*rpc.OutputSignal
+	// deadline is when to stop waiting for the next frame while frames are held
+	deadline time.Time
+	// received, when non nil, delivers the signal being received in the background
+	received chan receivedSignal
+	// err ends the output once the frames held are released
+	err error
+}
+
+func newReorderingClient(client rpc.Riff_InvokeClient, size int, wait time.Duration) *reorderingClient {
+	return &reorderingClient{
+		Riff_InvokeClient: client,
+		size:              size,
+		wait:              wait,
+		held:              make(map[int64]*rpc.OutputSignal, size),
+	}
+}
+
+func (c *reorderingClient) Recv() (*rpc.OutputSignal, error) {
+	for {
+		if outputSignal, ok := c.held[c.next]; ok {
+			delete(c.held, c.next)
+			c.next++
+			return outputSignal, nil
+		}
+		if len(c.held) > 0 && (c.err != nil || len(c.held) >= c.size) {
+			return c.release(), nil
+		}
+		if c.err != nil {
+			return nil, c.err
+		}
+		signal, ok := c.receive()
+		if !ok {
+			return c.release(), nil
+		}
+		if signal.err != nil {
+			c.err = signal.err
+			continue
+		}
+		n, numbered := sequenceNumber(signal.outputSignal)
+		if !numbered {
+			return signal.outputSignal, nil
+		}
+		if !c.started {
+			c.started, c.next = true, n
+		}
+		if n < c.next {
+			return signal.outputSignal, nil
+		}
+		if len(c.held) == 0 && n > c.next {
+			c.deadline = time.Now().Add(c.wait)
+		}
+		c.held[n] = signal.outputSignal
+	}
+}
+
+// receive returns the next signal from the backend, or false when frames are held and the wait is over. The signal
+// keeps being received in the background until the next call.
+func (c *reorderingClient) receive() (receivedSignal, bool) {
+	if c.received == nil {
+		received := make(chan receivedSignal, 1)
+		go func() {
+			outputSignal, err := c.Riff_InvokeClient.Recv()
+			received <- receivedSignal{outputSignal: outputSignal, err: err}
+		}()
+		c.received = received
+	}
+	var timeout <-chan time.Time
+	if len(c.held) > 0 && c.wait > 0 {
+		timer := time.NewTimer(time.Until(c.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case signal := <-c.received:
+		c.received = nil
+		return signal, true
+	case <-timeout:
+		return receivedSignal{}, false
+	}
+}
+
+// release gives up waiting for the frames missing before the lowest numbered frame held, which is returned.
+func (c *reorderingClient) release() *rpc.OutputSignal {
+	var lowest int64
+	first := true
+	for n := range c.held {
+		if first || n < lowest {
+			lowest, first = n, false
+		}
+	}
+	outputSignal := c.held[lowest]
+	delete(c.held, lowest)
+	c.next = lowest + 1
+	c.deadline = time.Now().Add(c.wait)
+	return outputSignal
+}
+
+// sequenceNumber returns the number of an output frame, if it has a valid one.
+func sequenceNumber(outputSignal *rpc.OutputSignal) (int64, bool) {
+	_, value := frameHeader(outputSignal.GetData().GetHeaders(), sequenceHeader)
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
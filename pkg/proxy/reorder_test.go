@@ -0,0 +1,148 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_output_reordering_in_order(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		sequencedOutputSignal("one,", "1"),
+		sequencedOutputSignal("three,", "3"),
+		sequencedOutputSignal("four,", "4"),
+		sequencedOutputSignal("two,", "2"),
+		outputSignal("unnumbered,", "text/plain"),
+		sequencedOutputSignal("six", "6"),
+		sequencedOutputSignal("five,", "5"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithOutputReordering(4, time.Second)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "one,two,three,four,unnumbered,five,six", responseRecorder.Body.String())
+	assert.Empty(t, response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_output_reordering_buffer_full(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		sequencedOutputSignal("one,", "1"),
+		sequencedOutputSignal("three,", "3"),
+		sequencedOutputSignal("four,", "4"),
+		sequencedOutputSignal("two,", "2"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithOutputReordering(2, time.Second)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "output frames 2 to 2 missing", response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_output_reordering_bounded_wait(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	invokeClient.On("Recv").Return(sequencedOutputSignal("one,", "1"), nil).Once()
+	invokeClient.On("Recv").Return(sequencedOutputSignal("three,", "3"), nil).Once()
+	invokeClient.On("Recv").Return(sequencedOutputSignal("two,", "2"), nil).After(500 * time.Millisecond).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithOutputReordering(4, 20*time.Millisecond)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	start := time.Now()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "output frames 2 to 2 missing", response.Trailer.Get("X-Riff-Error"))
+}
+
+func Test_output_reordering_end_of_stream(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		sequencedOutputSignal("one,", "1"),
+		sequencedOutputSignal("three", "3"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithOutputReordering(4, time.Second)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	start := time.Now()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "output frames 2 to 2 missing", responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
+
+func Test_reorderingClient_negative_numbers(t *testing.T) {
+	invokeClient := &mocks.Riff_InvokeClient{}
+	for _, n := range []string{"-2", "0", "-1"} {
+		invokeClient.On("Recv").Return(sequencedOutputSignal(n, n), nil).Once()
+	}
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	client := newReorderingClient(invokeClient, 4, 0)
+
+	var received []string
+	for {
+		outputSignal, err := client.Recv()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		received = append(received, string(outputSignal.GetData().Payload))
+	}
+	assert.Equal(t, []string{"-2", "-1", "0"}, received)
+}
+
+func Test_sequenceNumber(t *testing.T) {
+	n, ok := sequenceNumber(sequencedOutputSignal("", "42"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), n)
+	_, ok = sequenceNumber(sequencedOutputSignal("", "x"))
+	assert.False(t, ok)
+	_, ok = sequenceNumber(&rpc.OutputSignal{})
+	assert.False(t, ok)
+}
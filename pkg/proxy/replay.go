@@ -0,0 +1,125 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	nonceHeader = "X-Riff-Nonce"
+
+	// defaultNonceCacheSize bounds the memory used to remember nonces. When full of nonces still within the replay
+	// window, requests are turned away until the oldest one falls out of it, as forgetting it would allow its replay.
+	defaultNonceCacheSize = 10000
+)
+
+// WithReplayProtection requires every request to carry a unique X-Riff-Nonce header, rejecting any nonce already
+// seen within the given window.
+func WithReplayProtection(window time.Duration) Option {
+	return func(p *proxy) {
+		if window > 0 {
+			p.nonces = newNonceCache(window, defaultNonceCacheSize)
+		}
+	}
+}
+
+func (p *proxy) rejectReplays(next http.Handler) http.Handler {
+	if p.nonces == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		nonce := request.Header.Get(nonceHeader)
+		if nonce == "" {
+			p.writeError(writer, request, httpErrorf(http.StatusBadRequest, "missing %s header", nonceHeader))
+			return
+		}
+		seen, wait := p.nonces.seen(nonce, time.Now())
+		if seen {
+			p.writeError(writer, request, httpErrorf(http.StatusConflict, "nonce already used"))
+			return
+		} else if wait > 0 {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			p.writeError(writer, request,
+				httpErrorf(http.StatusServiceUnavailable, "too many nonces within the replay window"))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// nonceCache remembers nonces for a time window, refusing new ones once full rather than forgetting any before its
+// window ends.
+type nonceCache struct {
+	window   time.Duration
+	capacity int
+
+	mutex   sync.Mutex
+	order   *list.List // of *nonceEntry, most recently seen first
+	entries map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce string
+	at    time.Time
+}
+
+func newNonceCache(window time.Duration, capacity int) *nonceCache {
+	return &nonceCache{
+		window:   window,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element, capacity),
+	}
+}
+
+// seen records the nonce as used at the given time, reporting whether it was already used within the window. When
+// full, the nonce isn't recorded and seen returns how long to wait for the oldest nonce to fall out of the window.
+func (c *nonceCache) seen(nonce string, now time.Time) (bool, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(now)
+	if _, ok := c.entries[nonce]; ok {
+		return true, 0
+	} else if len(c.entries) >= c.capacity {
+		return false, c.order.Back().Value.(*nonceEntry).at.Add(c.window).Sub(now)
+	}
+	c.entries[nonce] = c.order.PushFront(&nonceEntry{nonce: nonce, at: now})
+	return false, 0
+}
+
+// expire drops the entries that fell out of the window. As entries are ordered by time, it stops at the first
+// entry still within the window.
+func (c *nonceCache) expire(now time.Time) {
+	for element := c.order.Back(); element != nil; element = c.order.Back() {
+		if now.Sub(element.Value.(*nonceEntry).at) < c.window {
+			return
+		}
+		c.remove(element)
+	}
+}
+
+func (c *nonceCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*nonceEntry).nonce)
+}
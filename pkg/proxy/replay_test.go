@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_replay_fresh_nonce(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithReplayProtection(time.Minute)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("X-Riff-Nonce", "abc")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+}
+
+func Test_replay_repeated_nonce(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithReplayProtection(time.Minute)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("X-Riff-Nonce", "abc")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	replay, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	replay.Header.Set("X-Riff-Nonce", "abc")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, replay)
+
+	assert.Equal(t, http.StatusConflict, responseRecorder.Code)
+	riffClient.AssertNumberOfCalls(t, "Invoke", 1)
+}
+
+func Test_replay_missing_nonce(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithReplayProtection(time.Minute)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_nonceCache_window(t *testing.T) {
+	cache := newNonceCache(time.Minute, 10)
+	now := time.Now()
+
+	seen, _ := cache.seen("abc", now)
+	assert.False(t, seen)
+	seen, _ = cache.seen("abc", now.Add(30*time.Second))
+	assert.True(t, seen)
+	seen, _ = cache.seen("abc", now.Add(2*time.Minute))
+	assert.False(t, seen)
+}
+
+func Test_nonceCache_full(t *testing.T) {
+	cache := newNonceCache(time.Minute, 2)
+	now := time.Now()
+
+	cache.seen("a", now)
+	cache.seen("b", now.Add(10*time.Second))
+	seen, wait := cache.seen("c", now.Add(20*time.Second))
+	assert.False(t, seen)
+	assert.Equal(t, 40*time.Second, wait)
+
+	seen, _ = cache.seen("a", now.Add(30*time.Second))
+	assert.True(t, seen, "nonces within the window must not be forgotten")
+
+	seen, wait = cache.seen("c", now.Add(time.Minute))
+	assert.False(t, seen)
+	assert.Zero(t, wait)
+}
+
+func Test_replay_nonces_full(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(2, "ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithReplayProtection(time.Minute)(p)
+	p.nonces.capacity = 1
+
+	post := func(nonce string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		request.Header.Set("X-Riff-Nonce", nonce)
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	assert.Equal(t, http.StatusOK, post("first").Code)
+	full := post("second")
+	assert.Equal(t, http.StatusServiceUnavailable, full.Code)
+	assert.Equal(t, "60", full.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusConflict, post("first").Code)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+const (
+	// requestIDHeader identifies a request, in logs as well as in error responses
+	requestIDHeader = "X-Request-Id"
+	// maxRequestIDLength is the length above which request ids set by clients are replaced
+	maxRequestIDLength = 128
+)
+
+// WithRequestIDs identifies each request with the X-Request-Id header, keeping the one set by the client (or an
+// ingress in front of the adapter) if any, generating one otherwise. The id is passed to the function, returned with
+// the response and included in error responses, errors being logged along with it.
+func WithRequestIDs(logger *log.Logger) Option {
+	return func(p *proxy) {
+		p.errorLogger = logger
+	}
+}
+
+func (p *proxy) identifyRequests(next http.Handler) http.Handler {
+	if p.errorLogger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			request.Header.Set(requestIDHeader, id)
+		}
+		writer.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// requestID returns the id of a request, if requests are identified.
+func (p *proxy) requestID(request *http.Request) string {
+	if p.errorLogger == nil {
+		return ""
+	}
+	return request.Header.Get(requestIDHeader)
+}
+
+// logError records an error reported to the client, along with the id of the request.
+func (p *proxy) logError(request *http.Request, page errorPage) {
+	if p.errorLogger == nil {
+		return
+	}
+	p.errorLogger.Printf("request %s: %s %s failed with %d: %s", page.RequestID, request.Method, request.URL.Path,
+		page.Status, page.Message)
+}
+
+// validRequestID tells whether an id set by the client can be used as is, which is when it is made of printable
+// ascii characters only and not too long.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
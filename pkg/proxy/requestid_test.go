@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_request_id_in_error_response(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "shutting down")
+	var logs bytes.Buffer
+	p := &proxy{riffClient: riffClient}
+	WithRequestIDs(log.New(&logs, "", 0))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	id := responseRecorder.Header().Get("X-Request-Id")
+	assert.Len(t, id, 32)
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Equal(t, "shutting down\nrequest id: "+id+"\n", responseRecorder.Body.String())
+	assert.Equal(t, "request "+id+": POST / failed with 503: shutting down\n", logs.String())
+}
+
+func Test_request_id_from_client(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithRequestIDs(log.New(&bytes.Buffer{}, "", 0))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Request-Id", "abc-123")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "abc-123", responseRecorder.Header().Get("X-Request-Id"))
+	assert.Equal(t, "abc-123", inputSignals(invokeClient.Calls)[1].GetData().Headers["X-Request-Id"])
+}
+
+func Test_request_id_invalid_replaced(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("some response", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithRequestIDs(log.New(&bytes.Buffer{}, "", 0))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Request-Id", strings.Repeat("x", 200))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Len(t, responseRecorder.Header().Get("X-Request-Id"), 32)
+}
+
+func Test_request_id_in_error_template(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "shutting down")
+	p := &proxy{riffClient: riffClient}
+	WithRequestIDs(log.New(&bytes.Buffer{}, "", 0))(p)
+	WithErrorTemplate(template.Must(template.New("error").Parse("<p>{{.Message}} ({{.RequestID}})</p>")))(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Accept", "text/html")
+	request.Header.Set("X-Request-Id", "abc-123")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, "<p>shutting down (abc-123)</p>", responseRecorder.Body.String())
+}
+
+func Test_request_id_disabled(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "shutting down")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("X-Request-Id"))
+	assert.Equal(t, "shutting down\n", responseRecorder.Body.String())
+}
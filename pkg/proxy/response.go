@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// responseRecorder remembers the status sent to the client, so that errors are only reported while it is still
+// possible to do so. It also counts the body bytes written, streamed or not.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	// started, when set, is reported in a X-Riff-Total-Duration header as the time elapsed until the response started
+	started time.Time
+	// timing, when non nil, is reported in a Server-Timing header when the response starts
+	timing *serverTiming
+	// event, when non nil, is the CloudEvent successful responses reply to
+	event *cloudEvent
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.start(status)
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.start(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// flushable tells whether what is written to the response can be flushed to the client as it goes, which is not the
+// case behind some middlewares wrapping the writer.
+func flushable(writer http.ResponseWriter) bool {
+	for {
+		wrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		writer = wrapper.Unwrap()
+	}
+	_, ok := writer.(http.Flusher)
+	return ok
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.start(http.StatusOK)
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the writer being recorded.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) start(status int) {
+	r.status = status
+	if !r.started.IsZero() {
+		r.Header().Set(totalDurationHeader, formatMillis(time.Since(r.started)))
+	}
+	if r.timing != nil {
+		r.Header().Set(serverTimingHeader, r.timing.header())
+	}
+	if r.event != nil && status < 300 {
+		r.event.reply(r.Header())
+	}
+}
+
+// responseWriter writes output frames to a response. The status and headers are only sent once the response is
+// committed, taken from the frames held until then, a X-Riff-Status header overriding the status. Frames written
+// afterwards go straight to the body, flushed to the client when streaming.
+type responseWriter struct {
+	writer http.ResponseWriter
+	// flusher, when non nil, flushes what has been written as soon as the response is committed and after each frame
+	flusher http.Flusher
+	// readAhead is the number of frames held before committing the response, the first one committing it by default
+	readAhead int
+	// exactLength sets the Content-Length of the response to the length of the frames held when committed, rather
+	// than leaving it unknown
+	exactLength bool
+	// lineBuffered, when non nil, tells whether to write the body line by line, given the response content type
+	lineBuffered func(contentType string) bool
+	// splitSize, when positive, is the size of the pieces larger payloads are written in, each one being flushed
+	splitSize int
+
+	pending   []*rpc.OutputFrame
+	committed bool
+	// out is where payloads are written once committed, lines holding partial lines when line buffering
+	out   io.Writer
+	lines *lineWriter
+}
+
+// write holds a frame until enough are read ahead to commit the response, or writes it to the body once committed.
+func (w *responseWriter) write(frame *rpc.OutputFrame) error {
+	if !w.committed {
+		if w.pending = append(w.pending, frame); len(w.pending) >= w.readAhead {
+			return w.commit()
+		}
+		return nil
+	}
+	if err := w.writePayload(frame.Payload); err != nil {
+		return err
+	}
+	w.flush()
+	return nil
+}
+
+// commit sends the status and headers taken from the frames held, followed by their payloads.
+func (w *responseWriter) commit() error {
+	status, err := writeOutputHeaders(w.writer, w.pending...)
+	if err != nil {
+		return err
+	}
+	if w.exactLength {
+		var length int
+		for _, frame := range w.pending {
+			length += len(frame.Payload)
+		}
+		w.writer.Header().Set("content-length", strconv.Itoa(length))
+	} else {
+		w.writer.Header().Del("content-length")
+	}
+	w.writer.WriteHeader(status)
+	w.committed = true
+	w.out = w.writer
+	if w.lineBuffered != nil && w.lineBuffered(w.writer.Header().Get("content-type")) {
+		w.lines = &lineWriter{writer: w.writer}
+		w.out = w.lines
+	}
+	for _, frame := range w.pending {
+		if err := w.writePayload(frame.Payload); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	w.flush()
+	return nil
+}
+
+func (w *responseWriter) flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
+
+// close ends the response once all frames have been written, committing it if frames are still held.
+func (w *responseWriter) close() error {
+	if !w.committed && len(w.pending) > 0 {
+		if err := w.commit(); err != nil {
+			return err
+		}
+	}
+	if w.lines != nil {
+		return w.lines.flush()
+	}
+	return nil
+}
+
+// cut reports an error in a trailer once the response has been committed, keeping what has been written so far.
+// Before that, the error is left for the caller to report with a proper status.
+func (w *responseWriter) cut(err error) error {
+	if w.committed {
+		if w.lines != nil {
+			_ = w.lines.flush()
+		}
+		setErrorTrailer(w.writer, err)
+	}
+	return err
+}
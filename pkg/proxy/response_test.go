@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func outputFrame(payload string, headers map[string]string) *rpc.OutputFrame {
+	return &rpc.OutputFrame{Payload: []byte(payload), ContentType: "text/plain", Headers: headers}
+}
+
+func Test_responseWriter_commits_on_first_frame(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder, exactLength: true}
+
+	err := response.write(outputFrame("created", map[string]string{"X-Riff-Status": "201", "X-Custom": "value"}))
+
+	assert.NoError(t, err)
+	assert.True(t, response.committed)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "created", recorder.Body.String())
+	assert.Equal(t, "7", recorder.Header().Get("Content-Length"))
+	assert.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "value", recorder.Header().Get("X-Custom"))
+	assert.Empty(t, recorder.Header().Get("X-Riff-Status"))
+}
+
+func Test_responseWriter_read_ahead(t *testing.T) {
+	recorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	response := &responseWriter{writer: recorder, flusher: recorder, readAhead: 2}
+
+	assert.NoError(t, response.write(outputFrame("one,", nil)))
+	assert.False(t, response.committed)
+	assert.False(t, recorder.Flushed)
+	assert.Empty(t, recorder.Body.String())
+
+	assert.NoError(t, response.write(outputFrame("two,", map[string]string{"X-Riff-Status": "202"})))
+	assert.True(t, response.committed)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Content-Length"))
+
+	assert.NoError(t, response.write(outputFrame("three", map[string]string{"X-Riff-Status": "500"})))
+	assert.NoError(t, response.close())
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "one,two,three", recorder.Body.String())
+	assert.Equal(t, []string{"one,two,", "three"}, recorder.flushes)
+}
+
+func Test_responseWriter_close_commits_held_frames(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder, readAhead: 10, exactLength: true}
+
+	assert.NoError(t, response.write(outputFrame("one,", nil)))
+	assert.NoError(t, response.write(outputFrame("two", nil)))
+	assert.False(t, response.committed)
+	assert.NoError(t, response.close())
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "one,two", recorder.Body.String())
+	assert.Equal(t, "7", recorder.Header().Get("Content-Length"))
+}
+
+func Test_responseWriter_close_without_frames(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder}
+
+	assert.NoError(t, response.close())
+	assert.False(t, response.committed)
+	assert.False(t, recorder.Flushed)
+}
+
+func Test_responseWriter_invalid_status(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder}
+
+	err := response.write(outputFrame("oops", map[string]string{"X-Riff-Status": "999"}))
+
+	assert.Equal(t, http.StatusBadGateway, newErrorPage(err).Status)
+	assert.False(t, response.committed)
+	assert.Empty(t, recorder.Body.String())
+}
+
+func Test_responseWriter_cut(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder, readAhead: 2}
+	failure := errors.New("function crashed")
+
+	assert.NoError(t, response.write(outputFrame("one,", nil)))
+	assert.Equal(t, failure, response.cut(failure))
+	assert.Empty(t, recorder.Header().Get(http.TrailerPrefix+errorTrailer))
+
+	assert.NoError(t, response.write(outputFrame("two,", nil)))
+	assert.Equal(t, failure, response.cut(failure))
+	assert.Equal(t, "function crashed", recorder.Header().Get(http.TrailerPrefix+errorTrailer))
+}
+
+func Test_responseWriter_line_buffered(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	response := &responseWriter{writer: recorder, lineBuffered: func(string) bool { return true }}
+
+	assert.NoError(t, response.write(outputFrame("first li", nil)))
+	assert.NoError(t, response.write(outputFrame("ne\nsecond", nil)))
+	assert.Equal(t, "first line\n", recorder.Body.String())
+
+	assert.Equal(t, errors.New("gone"), response.cut(errors.New("gone")))
+	assert.Equal(t, "first line\nsecond", recorder.Body.String())
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route proxies the requests under a path prefix to a specific backend, rather than to the invoker started by the
+// adapter.
+type Route struct {
+	// Prefix is the path served by the route, along with any path below it
+	Prefix string `yaml:"prefix"`
+	// Target is the gRPC address of the backend
+	Target string `yaml:"target"`
+	// Backends split the traffic of the route by weight, instead of a single Target
+	Backends []Backend `yaml:"backends"`
+	// InputNames are the names of the function input streams, defaults to "in", or to the names InputTypes map to
+	InputNames []string `yaml:"inputNames"`
+	// OutputNames are the names of the function output streams, defaults to "out"
+	OutputNames []string `yaml:"outputNames"`
+	// InputTypes map request media types to the name of the input stream their body is sent to, for functions
+	// taking different content types on different inputs. Media types may use a wildcard subtype, such as text/*
+	InputTypes map[string]string `yaml:"inputTypes"`
+	// InvocationTimeout and ConnectTimeout, when set, override the timeouts of the adapter for the route, e.g. 30s
+	InvocationTimeout time.Duration `yaml:"invocationTimeout"`
+	ConnectTimeout    time.Duration `yaml:"connectTimeout"`
+	// MaxInputBytes and MaxOutputBytes, when set, override the body size limits of the adapter for the route
+	MaxInputBytes  int64 `yaml:"maxInputBytes"`
+	MaxOutputBytes int64 `yaml:"maxOutputBytes"`
+}
+
+// Backend is one of the gRPC backends serving a route.
+type Backend struct {
+	// Target is the gRPC address of the backend
+	Target string `yaml:"target"`
+	// Weight is the share of the route traffic sent to the backend, relative to the other backends
+	Weight int `yaml:"weight"`
+}
+
+// outputHeader lets clients select the output streams of the function they want, among those of the route.
+const outputHeader = "X-Riff-Output"
+
+// backendHeader is the response header telling which backend served a route split across several backends.
+const backendHeader = "X-Riff-Backend"
+
+// route is a Route resolved to clients.
+type route struct {
+	Route
+	backends []*backend
+	// totalWeight is the sum of the backend weights
+	totalWeight int
+	// ring assigns sessions to backends
+	ring *hashRing
+}
+
+// backend is a Backend resolved to a client.
+type backend struct {
+	Backend
+	client rpc.RiffClient
+}
+
+func newRoute(r Route) *route {
+	resolved := &route{Route: r}
+	if len(r.InputTypes) > 0 {
+		resolved.InputTypes = make(map[string]string, len(r.InputTypes))
+		for mediaType, name := range r.InputTypes {
+			resolved.InputTypes[strings.ToLower(mediaType)] = name
+		}
+	}
+	if r.Target != "" {
+		resolved.backends = []*backend{{Backend: Backend{Target: r.Target, Weight: 1}}}
+	}
+	for _, b := range r.Backends {
+		resolved.backends = append(resolved.backends, &backend{Backend: b})
+	}
+	for _, b := range resolved.backends {
+		if b.Weight < 0 {
+			b.Weight = 0
+		}
+		resolved.totalWeight += b.Weight
+	}
+	if resolved.totalWeight == 0 {
+		// routes not loaded from a file aren't validated, split the traffic evenly rather than not at all
+		for _, b := range resolved.backends {
+			b.Weight = 1
+		}
+		resolved.totalWeight = len(resolved.backends)
+	}
+	if len(resolved.backends) > 1 {
+		resolved.ring = newHashRing(resolved.backends)
+	}
+	return resolved
+}
+
+// LoadRoutes reads a YAML (or JSON) file holding a list of routes.
+func LoadRoutes(path string) ([]Route, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []Route
+	if err := yaml.UnmarshalStrict(content, &routes); err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %v", path, err)
+	}
+	for i, r := range routes {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return nil, fmt.Errorf("invalid routes file %s: route #%d prefix %q must start with /", path, i, r.Prefix)
+		}
+		if (r.Target == "") == (len(r.Backends) == 0) {
+			return nil, fmt.Errorf("invalid routes file %s: route #%d must have either a target or backends", path, i)
+		}
+		total := 0
+		for _, b := range r.Backends {
+			if b.Target == "" || b.Weight < 0 {
+				return nil, fmt.Errorf("invalid routes file %s: route #%d has an invalid backend", path, i)
+			}
+			total += b.Weight
+		}
+		if len(r.Backends) > 0 && total == 0 {
+			return nil, fmt.Errorf("invalid routes file %s: route #%d backends all have a zero weight", path, i)
+		}
+		if r.InvocationTimeout < 0 || r.ConnectTimeout < 0 || r.MaxInputBytes < 0 || r.MaxOutputBytes < 0 {
+			return nil, fmt.Errorf("invalid routes file %s: route #%d has a negative timeout or limit", path, i)
+		}
+		if len(r.InputNames) > 0 {
+			for mediaType, name := range r.InputTypes {
+				if !contains(r.InputNames, name) {
+					return nil, fmt.Errorf("invalid routes file %s: route #%d maps %s to unknown input %q", path, i, mediaType, name)
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+// WithRoutes proxies requests to the backend of the route with the longest matching prefix. Requests not matching
+// any route go to the invoker started by the adapter, as usual. Routes may override the timeouts and body size limits
+// of the adapter, which apply otherwise.
+func WithRoutes(routes []Route) Option {
+	return func(p *proxy) {
+		p.routes = nil
+		for _, r := range routes {
+			p.routes = append(p.routes, newRoute(r))
+		}
+		sort.SliceStable(p.routes, func(i, j int) bool {
+			return len(p.routes[i].Prefix) > len(p.routes[j].Prefix)
+		})
+	}
+}
+
+// WithInputTypes sends request bodies to the input stream of the function mapped to their media type, for requests
+// served by the invoker started by the adapter. The input names are the mapped ones, in alphabetical order.
+func WithInputTypes(mapping map[string]string) Option {
+	return func(p *proxy) {
+		p.inputTypes = make(map[string]string, len(mapping))
+		for mediaType, name := range mapping {
+			p.inputTypes[strings.ToLower(mediaType)] = name
+		}
+	}
+}
+
+// dialRoutes connects to the backend of each route, re-using the connections to the targets already dialed.
+// Connections are established lazily, so that a backend being down doesn't prevent serving the other routes.
+func (p *proxy) dialRoutes(routes []*route) error {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[string]rpc.RiffClient)
+	}
+	for _, r := range routes {
+		for _, b := range r.backends {
+			if _, ok := p.clients[b.Target]; !ok {
+				conn, err := p.dial(b.Target)
+				if err != nil {
+					return fmt.Errorf("route %s: %v", r.Prefix, err)
+				}
+				if p.reaperMaxIdle > 0 {
+					p.clients[b.Target] = newPooledConn(b.Target, p.dial, conn)
+				} else {
+					p.clients[b.Target] = rpc.NewRiffClient(conn)
+				}
+			}
+			b.client = p.clients[b.Target]
+		}
+	}
+	return nil
+}
+
+// dial connects to a route backend. Connections are established lazily.
+func (p *proxy) dial(target string) (*grpc.ClientConn, error) {
+	return grpc.Dial(target, p.dialOptions()...)
+}
+
+// TrailingSlash tells how to handle request paths ending with a slash.
+type TrailingSlash string
+
+const (
+	// TrailingSlashAccept serves paths with a trailing slash like the same path without it
+	TrailingSlashAccept TrailingSlash = "accept"
+	// TrailingSlashRedirect redirects paths with a trailing slash to the same path without it
+	TrailingSlashRedirect TrailingSlash = "redirect"
+	// TrailingSlashReject doesn't serve paths with a trailing slash
+	TrailingSlashReject TrailingSlash = "reject"
+)
+
+// WithTrailingSlash sets how request paths ending with a slash are handled, such paths being accepted by default.
+// The root path is never considered to have a trailing slash.
+func WithTrailingSlash(policy TrailingSlash) Option {
+	return func(p *proxy) {
+		p.trailingSlash = policy
+	}
+}
+
+// redirectTrailingSlash handles a request path ending with a slash according to the configured policy, reporting
+// whether the response has been written already.
+func (p *proxy) redirectTrailingSlash(writer http.ResponseWriter, request *http.Request) bool {
+	path := request.URL.Path
+	if len(path) < 2 || !strings.HasSuffix(path, "/") {
+		return false
+	}
+	switch p.trailingSlash {
+	case TrailingSlashRedirect:
+		location := *request.URL
+		location.Path, location.RawPath = strings.TrimSuffix(path, "/"), ""
+		// 308 rather than 301 so that clients keep POSTing
+		http.Redirect(writer, request, location.RequestURI(), http.StatusPermanentRedirect)
+		return true
+	case TrailingSlashReject:
+		writer.Header().Set(grpcCodeHeader, grpcCodeNames[codes.Unimplemented])
+		writer.WriteHeader(http.StatusNotImplemented)
+		return true
+	default:
+		return false
+	}
+}
+
+// resolve finds the route serving a request path, if any. A trailing slash is ignored, and an empty path is the
+// root path.
+func (p *proxy) resolve(path string) *route {
+	if path == "" {
+		path = "/"
+	} else if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	for _, r := range p.current().routes {
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		if path == r.Prefix || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return r
+		}
+	}
+	if path == "/" {
+		return &route{
+			Route:       Route{Prefix: "/", Target: p.grpcAddress, InputTypes: p.inputTypes},
+			backends:    []*backend{{Backend: Backend{Target: p.grpcAddress, Weight: 1}, client: p.riffClient}},
+			totalWeight: 1,
+		}
+	}
+	return nil
+}
+
+// pick selects the backend serving a request of the given session, at random according to the backend weights
+// when there is no session.
+func (r *route) pick(session string) *backend {
+	if len(r.backends) == 1 {
+		return r.backends[0]
+	} else if session != "" {
+		return r.ring.lookup(session)
+	}
+	n := rand.Intn(r.totalWeight)
+	for _, b := range r.backends {
+		if n < b.Weight {
+			return b
+		}
+		n -= b.Weight
+	}
+	return r.backends[len(r.backends)-1]
+}
+
+// inputNames returns the names of the function input streams, defaulting to the names input types are mapped to.
+func (r *route) inputNames() []string {
+	if len(r.InputNames) > 0 {
+		return r.InputNames
+	} else if len(r.InputTypes) > 0 {
+		var names []string
+		for _, name := range r.InputTypes {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	return []string{"in"}
+}
+
+// inputIndex finds the input stream a request body of the given content type is sent to, which is the first one
+// unless input types are mapped. Media types not mapped to any input are rejected with a 415.
+func (r *route) inputIndex(contentType string) (int32, error) {
+	if len(r.InputTypes) == 0 {
+		return 0, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	name, ok := r.InputTypes[mediaType]
+	if !ok {
+		for pattern, n := range r.InputTypes {
+			if strings.HasSuffix(pattern, "/*") && matchesMediaType(mediaType, pattern) {
+				name, ok = n, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return 0, httpErrorf(http.StatusUnsupportedMediaType, "no input for content type %s", contentType)
+	}
+	for i, n := range r.inputNames() {
+		if n == name {
+			return int32(i), nil
+		}
+	}
+	return 0, httpErrorf(http.StatusInternalServerError, "unknown input %q", name)
+}
+
+func (r *route) outputNames() []string {
+	if len(r.OutputNames) == 0 {
+		return []string{"out"}
+	}
+	return r.OutputNames
+}
+
+// selectOutputs returns the output names requested by a client with a comma separated list of names, all the
+// outputs of the route when the list is empty. Names that are not outputs of the route are rejected with a 400.
+func (r *route) selectOutputs(selection string) ([]string, error) {
+	outputNames := r.outputNames()
+	if strings.TrimSpace(selection) == "" {
+		return outputNames, nil
+	}
+	var selected []string
+	for _, name := range strings.Split(selection, ",") {
+		name = strings.TrimSpace(name)
+		if !contains(outputNames, name) {
+			return nil, httpErrorf(http.StatusBadRequest, "unknown output %q, must be one of %s", name,
+				strings.Join(outputNames, ", "))
+		}
+		if !contains(selected, name) {
+			selected = append(selected, name)
+		}
+	}
+	return selected, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_routes_two_backends(t *testing.T) {
+	clientA, invokeClientA := mockRiffClientWithResponse("from a", "text/plain")
+	clientB, invokeClientB := mockRiffClientWithResponse("from b", "text/plain")
+	p := &proxy{}
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081"},
+		{Prefix: "/fn/b", Target: "b:8081", InputNames: []string{"numbers"}, OutputNames: []string{"squares"}},
+	})(p)
+	p.routes[0].backends[0].client = clientA
+	p.routes[1].backends[0].client = clientB
+
+	requestA, _ := http.NewRequest("POST", "/fn/a", strings.NewReader(""))
+	responseA := httptest.NewRecorder()
+	p.invokeGrpc(responseA, requestA)
+	requestB, _ := http.NewRequest("POST", "/fn/b", strings.NewReader(""))
+	responseB := httptest.NewRecorder()
+	p.invokeGrpc(responseB, requestB)
+
+	assert.Equal(t, "from a", responseA.Body.String())
+	assert.Equal(t, "from b", responseB.Body.String())
+	startA := inputSignals(invokeClientA.Calls)[0].GetStart()
+	assert.Equal(t, []string{"in"}, startA.InputNames)
+	assert.Equal(t, []string{"out"}, startA.OutputNames)
+	startB := inputSignals(invokeClientB.Calls)[0].GetStart()
+	assert.Equal(t, []string{"numbers"}, startB.InputNames)
+	assert.Equal(t, []string{"squares"}, startB.OutputNames)
+}
+
+func Test_routes_longest_prefix(t *testing.T) {
+	p := &proxy{}
+	WithRoutes([]Route{
+		{Prefix: "/fn", Target: "fn:8081"},
+		{Prefix: "/fn/a", Target: "a:8081"},
+	})(p)
+
+	assert.Equal(t, "a:8081", p.resolve("/fn/a/b").Target)
+	assert.Equal(t, "fn:8081", p.resolve("/fn/ab").Target)
+	assert.Equal(t, "fn:8081", p.resolve("/fn").Target)
+	assert.Nil(t, p.resolve("/other"))
+}
+
+func Test_routes_unmatched(t *testing.T) {
+	clientA, _ := mockRiffClient()
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn/a", Target: "a:8081"}})(p)
+	p.routes[0].backends[0].client = clientA
+
+	request, _ := http.NewRequest("POST", "/fn/c", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	clientA.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_LoadRoutes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "routes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	_ = ioutil.WriteFile(path, []byte(`
+- prefix: /fn/a
+  target: a:8081
+- prefix: /fn/b
+  target: b:8081
+  inputNames: [numbers]
+`), 0644)
+
+	routes, err := LoadRoutes(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Route{
+		{Prefix: "/fn/a", Target: "a:8081"},
+		{Prefix: "/fn/b", Target: "b:8081", InputNames: []string{"numbers"}},
+	}, routes)
+}
+
+func Test_LoadRoutes_overrides(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "routes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	_ = ioutil.WriteFile(path, []byte(`
+- prefix: /fn/a
+  target: a:8081
+  invocationTimeout: 30s
+  connectTimeout: 500ms
+  maxInputBytes: 1024
+  maxOutputBytes: 2048
+`), 0644)
+
+	routes, err := LoadRoutes(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Route{{Prefix: "/fn/a", Target: "a:8081", InvocationTimeout: 30 * time.Second,
+		ConnectTimeout: 500 * time.Millisecond, MaxInputBytes: 1024, MaxOutputBytes: 2048}}, routes)
+}
+
+func Test_LoadRoutes_negative_override(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "routes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	_ = ioutil.WriteFile(path, []byte(`
+- prefix: /fn/a
+  target: a:8081
+  invocationTimeout: -1s
+`), 0644)
+
+	_, err := LoadRoutes(path)
+
+	assert.EqualError(t, err, "invalid routes file "+path+": route #0 has a negative timeout or limit")
+}
+
+func Test_LoadRoutes_invalid(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "routes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+	_ = ioutil.WriteFile(path, []byte(`[{"prefix": "fn/a", "target": "a:8081"}]`), 0644)
+
+	_, err := LoadRoutes(path)
+
+	assert.Error(t, err)
+}
+
+func Test_LoadRoutes_unknown_input_type_name(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "routes")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	_ = ioutil.WriteFile(path, []byte(`
+- prefix: /fn/a
+  target: a:8081
+  inputNames: [json-in]
+  inputTypes:
+    application/xml: xml-in
+`), 0644)
+
+	_, err := LoadRoutes(path)
+
+	assert.EqualError(t, err, "invalid routes file "+path+": route #0 maps application/xml to unknown input \"xml-in\"")
+}
+
+func Test_routes_input_types(t *testing.T) {
+	_, jsonInvokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	_, xmlInvokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	client := &mocks.RiffClient{}
+	client.On("Invoke", mock.Anything).Return(jsonInvokeClient, nil).Once()
+	client.On("Invoke", mock.Anything).Return(xmlInvokeClient, nil).Once()
+	p := &proxy{}
+	WithRoutes([]Route{{
+		Prefix:     "/fn",
+		Target:     "fn:8081",
+		InputTypes: map[string]string{"application/json": "json-in", "application/XML": "xml-in"},
+	}})(p)
+	p.routes[0].backends[0].client = client
+
+	for _, contentType := range []string{"application/json", "application/xml; charset=utf-8"} {
+		request, _ := http.NewRequest("POST", "/fn", strings.NewReader("some body"))
+		request.Header.Set("Content-Type", contentType)
+		responseRecorder := httptest.NewRecorder()
+		p.invokeGrpc(responseRecorder, request)
+		assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	}
+
+	jsonSignals := inputSignals(jsonInvokeClient.Calls)
+	assert.Equal(t, []string{"json-in", "xml-in"}, jsonSignals[0].GetStart().InputNames)
+	assert.Equal(t, int32(0), jsonSignals[1].GetData().ArgIndex)
+	xmlSignals := inputSignals(xmlInvokeClient.Calls)
+	assert.Equal(t, []string{"json-in", "xml-in"}, xmlSignals[0].GetStart().InputNames)
+	assert.Equal(t, int32(1), xmlSignals[1].GetData().ArgIndex)
+}
+
+func Test_routes_input_types_explicit_names(t *testing.T) {
+	route := newRoute(Route{
+		InputNames: []string{"xml-in", "text-in", "json-in"},
+		InputTypes: map[string]string{"application/json": "json-in", "text/*": "text-in"},
+	})
+
+	index, err := route.inputIndex("application/json")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), index)
+	index, err = route.inputIndex("text/csv")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), index)
+}
+
+func Test_routes_input_types_unmapped(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithInputTypes(map[string]string{"application/json": "json-in"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Content-Type", "text/plain")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, responseRecorder.Code)
+	assert.Equal(t, "no input for content type text/plain\n", responseRecorder.Body.String())
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_routes_weighted_split(t *testing.T) {
+	r := newRoute(Route{Prefix: "/fn", Backends: []Backend{
+		{Target: "v1:8081", Weight: 90},
+		{Target: "v2:8081", Weight: 10},
+		{Target: "v3:8081", Weight: 0},
+	}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.pick("").Target]++
+	}
+
+	assert.InDelta(t, 9000, counts["v1:8081"], 300)
+	assert.InDelta(t, 1000, counts["v2:8081"], 300)
+	assert.Zero(t, counts["v3:8081"])
+}
+
+func Test_routes_zero_weights_split_evenly(t *testing.T) {
+	r := newRoute(Route{Prefix: "/fn", Backends: []Backend{
+		{Target: "v1:8081"},
+		{Target: "v2:8081", Weight: -1},
+	}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.pick("").Target]++
+	}
+
+	assert.InDelta(t, 5000, counts["v1:8081"], 300)
+	assert.InDelta(t, 5000, counts["v2:8081"], 300)
+	assert.NotNil(t, r.pick("some session"))
+}
+
+func Test_routes_backend_header(t *testing.T) {
+	clientV1, _ := mockRiffClientWithResponse("from v1", "text/plain")
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn", Backends: []Backend{
+		{Target: "v1:8081", Weight: 1},
+		{Target: "v2:8081", Weight: 0},
+	}}})(p)
+	WithMetrics("/metrics")(p)
+	p.routes[0].backends[0].client = clientV1
+
+	request, _ := http.NewRequest("POST", "/fn", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "from v1", responseRecorder.Body.String())
+	assert.Equal(t, "v1:8081", responseRecorder.Header().Get("X-Riff-Backend"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.invocations.WithLabelValues("v1:8081")))
+}
+
+func Test_trailing_slash_accept(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(3, "ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	for _, path := range []string{"/", "", "//"} {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+		request.URL.Path = path
+		responseRecorder := httptest.NewRecorder()
+		p.invokeGrpc(responseRecorder, request)
+
+		assert.Equal(t, http.StatusOK, responseRecorder.Code, "path %q", path)
+	}
+}
+
+func Test_trailing_slash_accept_route(t *testing.T) {
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn/a", Target: "a:8081"}})(p)
+	WithTrailingSlash(TrailingSlashAccept)(p)
+
+	assert.Equal(t, "a:8081", p.resolve("/fn/a/").Target)
+}
+
+func Test_trailing_slash_redirect(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithRoutes([]Route{{Prefix: "/fn/a", Target: "a:8081"}})(p)
+	WithTrailingSlash(TrailingSlashRedirect)(p)
+
+	request, _ := http.NewRequest("POST", "/fn/a/?x=1", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusPermanentRedirect, responseRecorder.Code)
+	assert.Equal(t, "/fn/a?x=1", responseRecorder.Header().Get("Location"))
+
+	request, _ = http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder = httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code, "the root path has no trailing slash")
+}
+
+func Test_trailing_slash_reject(t *testing.T) {
+	clientA, _ := mockRiffClient()
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn/a", Target: "a:8081"}})(p)
+	WithTrailingSlash(TrailingSlashReject)(p)
+	p.routes[0].backends[0].client = clientA
+
+	request, _ := http.NewRequest("POST", "/fn/a/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, responseRecorder.Code)
+	clientA.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_routes_output_selection(t *testing.T) {
+	client, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{}
+	WithRoutes([]Route{{Prefix: "/fn", Target: "fn:8081", OutputNames: []string{"out1", "out2", "out3"}}})(p)
+	p.routes[0].backends[0].client = client
+
+	request, _ := http.NewRequest("POST", "/fn", strings.NewReader("some body"))
+	request.Header.Set("X-Riff-Output", "out3, out2")
+	request.Header.Set("Accept", "text/plain")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"out3", "out2"}, startFrame.OutputNames)
+	assert.Equal(t, []string{"text/plain", "text/plain"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_routes_output_selection_unknown(t *testing.T) {
+	client, _ := mockRiffClient()
+	p := &proxy{riffClient: client}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("X-Riff-Output", "out2")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Equal(t, "unknown output \"out2\", must be one of out\n", responseRecorder.Body.String())
+	client.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_routes_invocation_timeout_override(t *testing.T) {
+	slowClient, _ := mockRiffClientUntilCancelled()
+	otherClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{}
+	WithInvocationTimeout(time.Minute)(p)
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081", InvocationTimeout: 20 * time.Millisecond},
+		{Prefix: "/fn/b", Target: "b:8081"},
+	})(p)
+	p.routes[0].backends[0].client = slowClient
+	p.routes[1].backends[0].client = otherClient
+
+	slowRequest, _ := http.NewRequest("POST", "/fn/a", strings.NewReader(""))
+	slowResponse := httptest.NewRecorder()
+	start := time.Now()
+	p.invokeGrpc(slowResponse, slowRequest)
+	otherRequest, _ := http.NewRequest("POST", "/fn/b", strings.NewReader(""))
+	otherResponse := httptest.NewRecorder()
+	p.invokeGrpc(otherResponse, otherRequest)
+
+	assert.Equal(t, http.StatusGatewayTimeout, slowResponse.Code)
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Equal(t, http.StatusOK, otherResponse.Code)
+	deadline, ok := otherClient.Calls[0].Arguments.Get(0).(context.Context).Deadline()
+	assert.True(t, ok)
+	assert.True(t, time.Until(deadline) > 30*time.Second, "the route should keep the timeout of the adapter")
+}
+
+func Test_routes_input_limit_override(t *testing.T) {
+	clientA, _ := mockRiffClient()
+	clientB, _ := mockRiffClient()
+	p := &proxy{}
+	WithMaxInputBytes(1024)(p)
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081", MaxInputBytes: 4},
+		{Prefix: "/fn/b", Target: "b:8081"},
+	})(p)
+	p.routes[0].backends[0].client = clientA
+	p.routes[1].backends[0].client = clientB
+
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, strings.NewReader(body))
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send("POST", "/fn/a", "hello").Code)
+	assert.Equal(t, http.StatusOK, send("POST", "/fn/b", "hello").Code)
+	assert.Equal(t, "4", send("OPTIONS", "/fn/a", "").Header().Get("X-Riff-Max-Input-Bytes"))
+	assert.Equal(t, "1024", send("OPTIONS", "/fn/b", "").Header().Get("X-Riff-Max-Input-Bytes"))
+	clientA.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_routes_output_limit_override(t *testing.T) {
+	clientA, _ := mockRiffClientWithResponse("from a", "text/plain")
+	clientB, _ := mockRiffClientWithResponse("from b", "text/plain")
+	p := &proxy{}
+	WithRoutes([]Route{
+		{Prefix: "/fn/a", Target: "a:8081", MaxOutputBytes: 4},
+		{Prefix: "/fn/b", Target: "b:8081"},
+	})(p)
+	p.routes[0].backends[0].client = clientA
+	p.routes[1].backends[0].client = clientB
+
+	requestA, _ := http.NewRequest("POST", "/fn/a", strings.NewReader(""))
+	responseA := httptest.NewRecorder()
+	p.invokeGrpc(responseA, requestA)
+	requestB, _ := http.NewRequest("POST", "/fn/b", strings.NewReader(""))
+	responseB := httptest.NewRecorder()
+	p.invokeGrpc(responseB, requestB)
+
+	assert.Equal(t, http.StatusBadGateway, responseA.Code)
+	assert.Equal(t, http.StatusOK, responseB.Code)
+	assert.Equal(t, "from b", responseB.Body.String())
+}
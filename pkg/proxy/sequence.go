@@ -0,0 +1,66 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"net/http"
+	"strconv"
+)
+
+// sequenceHeader is the output frame header numbering the frames of a streamed output. The protocol doesn't number
+// frames itself, functions may do so to have the adapter detect frames lost or delivered out of order.
+const sequenceHeader = "X-Riff-Sequence"
+
+// reasons for an output sequence to be broken
+const (
+	sequenceGap        = "gap"
+	sequenceOutOfOrder = "out-of-order"
+)
+
+// outputSequence verifies the numbering of the frames of an output. Frames without a sequence header are not
+// verified, the numbering is expected to start with the first frame having one.
+type outputSequence struct {
+	started bool
+	next    int64
+}
+
+// verify checks the sequence number of the next output frame, if any, removing it from the frame headers.
+func (s *outputSequence) verify(frame *rpc.OutputFrame, m *metrics) error {
+	key, value := frameHeader(frame.Headers, sequenceHeader)
+	if key == "" {
+		return nil
+	}
+	delete(frame.Headers, key)
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return httpErrorf(http.StatusBadGateway, "invalid %s output header %q", sequenceHeader, value)
+	}
+	if !s.started {
+		s.started, s.next = true, n
+	}
+	switch {
+	case n < s.next:
+		m.sequenceBroken(sequenceOutOfOrder)
+		return httpErrorf(http.StatusBadGateway, "output frame %d out of order, expected frame %d", n, s.next)
+	case n > s.next:
+		m.sequenceBroken(sequenceGap)
+		return httpErrorf(http.StatusBadGateway, "output frames %d to %d missing", s.next, n-1)
+	}
+	s.next++
+	return nil
+}
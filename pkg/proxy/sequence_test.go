@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_sequence_in_order(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		sequencedOutputSignal("one,", "1"),
+		sequencedOutputSignal("two", "2"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithMetrics("/metrics")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, "one,two", responseRecorder.Body.String())
+	assert.Empty(t, response.Header.Get("X-Riff-Sequence"))
+	assert.Empty(t, response.Trailer.Get("X-Riff-Error"))
+	assert.Equal(t, float64(2), testutil.ToFloat64(p.metrics.outputFrames))
+}
+
+func Test_sequence_gap(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		sequencedOutputSignal("one,", "1"),
+		sequencedOutputSignal("three,", "3"),
+		sequencedOutputSignal("two", "2"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithStreaming()(p)
+	WithMetrics("/metrics")(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	response := responseRecorder.Result()
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "output frames 2 to 2 missing", response.Trailer.Get("X-Riff-Error"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(p.metrics.sequenceErrors.WithLabelValues("gap")))
+}
+
+func Test_outputSequence_verify(t *testing.T) {
+	var sequence outputSequence
+
+	assert.NoError(t, sequence.verify(&rpc.OutputFrame{}, nil), "frames without sequence should not be verified")
+	assert.NoError(t, sequence.verify(sequencedOutputSignal("", "5").GetData(), nil))
+	assert.NoError(t, sequence.verify(sequencedOutputSignal("", "6").GetData(), nil))
+	assert.EqualError(t, sequence.verify(sequencedOutputSignal("", "6").GetData(), nil),
+		"output frame 6 out of order, expected frame 7")
+	assert.EqualError(t, sequence.verify(sequencedOutputSignal("", "9").GetData(), nil),
+		"output frames 7 to 8 missing")
+	assert.EqualError(t, sequence.verify(sequencedOutputSignal("", "x").GetData(), nil),
+		`invalid X-Riff-Sequence output header "x"`)
+}
+
+func sequencedOutputSignal(outputBody string, sequence string) *rpc.OutputSignal {
+	signal := outputSignal(outputBody, "text/plain")
+	signal.GetData().Headers = map[string]string{"X-Riff-Sequence": sequence}
+	return signal
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serverTimingHeader = "Server-Timing"
+
+// The phases of an invocation reported in the Server-Timing header, in order.
+const (
+	// dialPhase ends once the stream to the backend is open
+	dialPhase = "dial"
+	// sendPhase ends once the whole input has been sent
+	sendPhase = "send"
+	// firstBytePhase ends when the first output frame is received
+	firstBytePhase = "first-byte"
+	// totalPhase ends when the response starts
+	totalPhase = "total"
+)
+
+// WithServerTiming adds a Server-Timing header to responses, telling how long after the start of the invocation the
+// stream to the backend was open (dial), the input was sent (send), the first output frame was received (first-byte)
+// and the response started (total), in milliseconds. Phases not over by the time the response starts, such as
+// sending the input of streamed responses, are left out.
+func WithServerTiming() Option {
+	return func(p *proxy) {
+		p.serverTiming = true
+	}
+}
+
+// serverTiming records when the phases of an invocation ended.
+type serverTiming struct {
+	started time.Time
+	lock    sync.Mutex
+	ended   map[string]time.Duration
+}
+
+func newServerTiming() *serverTiming {
+	return &serverTiming{started: time.Now(), ended: make(map[string]time.Duration)}
+}
+
+// end records the end of a phase, the first time only.
+func (t *serverTiming) end(phase string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.ended[phase]; !ok {
+		t.ended[phase] = time.Since(t.started)
+	}
+}
+
+// header formats the phases ended so far as a Server-Timing header value, ending the total phase.
+func (t *serverTiming) header() string {
+	t.end(totalPhase)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var metrics []string
+	for _, phase := range []string{dialPhase, sendPhase, firstBytePhase, totalPhase} {
+		if d, ok := t.ended[phase]; ok {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%s", phase, formatMillis(d)))
+		}
+	}
+	return strings.Join(metrics, ", ")
+}
+
+type serverTimingKey struct{}
+
+// withServerTiming returns a context carrying the timing of the invocation.
+func withServerTiming(ctx context.Context, timing *serverTiming) context.Context {
+	return context.WithValue(ctx, serverTimingKey{}, timing)
+}
+
+// serverTimingFrom returns the timing of the invocation carried by ctx, nil if server timing is disabled.
+func serverTimingFrom(ctx context.Context) *serverTiming {
+	timing, _ := ctx.Value(serverTimingKey{}).(*serverTiming)
+	return timing
+}
+
+// timedClient ends the send and first-byte phases of an invocation as its input is sent and its output received.
+type timedClient struct {
+	rpc.Riff_InvokeClient
+	timing *serverTiming
+}
+
+func (c *timedClient) CloseSend() error {
+	err := c.Riff_InvokeClient.CloseSend()
+	if err == nil {
+		c.timing.end(sendPhase)
+	}
+	return err
+}
+
+func (c *timedClient) Recv() (*rpc.OutputSignal, error) {
+	outputSignal, err := c.Riff_InvokeClient.Recv()
+	if err == nil {
+		c.timing.end(firstBytePhase)
+	}
+	return outputSignal, err
+}
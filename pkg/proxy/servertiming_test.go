@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var serverTimingFormat = regexp.MustCompile(
+	`^dial;dur=[0-9.]+, send;dur=[0-9.]+, first-byte;dur=[0-9.]+, total;dur=[0-9.]+$`)
+
+func Test_server_timing(t *testing.T) {
+	// the output only comes once the whole input has been received, as is typical of non streaming functions
+	inputSent := make(chan struct{})
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Run(func(mock.Arguments) { close(inputSent) }).Return(nil)
+	invokeClient.On("Recv").Run(func(mock.Arguments) { <-inputSent }).Return(outputSignal("ok", "text/plain"), nil).Once()
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	p := &proxy{riffClient: riffClient}
+	WithServerTiming()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Regexp(t, serverTimingFormat, responseRecorder.Header().Get("Server-Timing"))
+}
+
+func Test_server_timing_error(t *testing.T) {
+	riffClient, _ := mockRiffClientWithError(codes.Unavailable, "backend down")
+	p := &proxy{riffClient: riffClient}
+	WithServerTiming()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Regexp(t, `^dial;dur=[0-9.]+, total;dur=[0-9.]+$`, responseRecorder.Header().Get("Server-Timing"))
+}
+
+func Test_server_timing_disabled_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("Server-Timing"))
+}
+
+func Test_serverTiming_header(t *testing.T) {
+	timing := &serverTiming{started: time.Now(), ended: map[string]time.Duration{
+		firstBytePhase: 3 * time.Millisecond,
+		dialPhase:      time.Millisecond,
+	}}
+	timing.end(firstBytePhase)
+
+	header := timing.header()
+
+	assert.Regexp(t, `^dial;dur=1\.000, first-byte;dur=3\.000, total;dur=[0-9.]+$`, header)
+}
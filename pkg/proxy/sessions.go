@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// pointsPerWeight is the number of points each unit of backend weight places on a route hash ring.
+const pointsPerWeight = 100
+
+// WithStickySessions sends the requests of a same session to the same backend of a route split across several
+// backends. Sessions are identified by the value of the given request header or, failing that, cookie. Requests
+// without a session are spread by weight as usual.
+func WithStickySessions(header string, cookie string) Option {
+	return func(p *proxy) {
+		p.sessionHeader = header
+		p.sessionCookie = cookie
+	}
+}
+
+// sessionKey returns the session a request belongs to, if any.
+func (p *proxy) sessionKey(request *http.Request) string {
+	if p.sessionHeader != "" {
+		if key := request.Header.Get(p.sessionHeader); key != "" {
+			return key
+		}
+	}
+	if p.sessionCookie != "" {
+		if cookie, err := request.Cookie(p.sessionCookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// hashRing maps keys to backends by consistent hashing, so that few sessions move when backends change.
+type hashRing struct {
+	points   []uint32
+	backends []*backend // parallel to points
+}
+
+func newHashRing(backends []*backend) *hashRing {
+	ring := &hashRing{}
+	type point struct {
+		hash    uint32
+		backend *backend
+	}
+	var points []point
+	for _, b := range backends {
+		for i := 0; i < b.Weight*pointsPerWeight; i++ {
+			points = append(points, point{hash: hashKey(b.Target + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	for _, pt := range points {
+		ring.points = append(ring.points, pt.hash)
+		ring.backends = append(ring.backends, pt.backend)
+	}
+	return ring
+}
+
+// lookup returns the backend owning the first point following the hash of the key on the ring.
+func (r *hashRing) lookup(key string) *backend {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.backends[i]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+var splitRoute = Route{Prefix: "/fn", Backends: []Backend{
+	{Target: "a:8081", Weight: 1},
+	{Target: "b:8081", Weight: 1},
+	{Target: "c:8081", Weight: 1},
+}}
+
+func Test_sessions_same_key_same_backend(t *testing.T) {
+	r := newRoute(splitRoute)
+
+	first := r.pick("session-1")
+	for i := 0; i < 100; i++ {
+		assert.Same(t, first, r.pick("session-1"))
+	}
+}
+
+func Test_sessions_different_keys_spread(t *testing.T) {
+	r := newRoute(splitRoute)
+
+	targets := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		targets[r.pick(fmt.Sprintf("session-%d", i)).Target] = true
+	}
+
+	assert.Len(t, targets, 3)
+}
+
+func Test_sessions_zero_weight_never_picked(t *testing.T) {
+	r := newRoute(Route{Prefix: "/fn", Backends: []Backend{
+		{Target: "a:8081", Weight: 1},
+		{Target: "b:8081", Weight: 0},
+	}})
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "a:8081", r.pick(fmt.Sprintf("session-%d", i)).Target)
+	}
+}
+
+func Test_sessionKey(t *testing.T) {
+	p := &proxy{}
+	WithStickySessions("X-Session-Id", "session")(p)
+
+	request, _ := http.NewRequest("POST", "/fn", nil)
+	assert.Equal(t, "", p.sessionKey(request))
+
+	request.AddCookie(&http.Cookie{Name: "session", Value: "from-cookie"})
+	assert.Equal(t, "from-cookie", p.sessionKey(request))
+
+	request.Header.Set("X-Session-Id", "from-header")
+	assert.Equal(t, "from-header", p.sessionKey(request))
+}
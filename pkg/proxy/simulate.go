@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// simulatePath is where saved requests are replayed through the proxy, when request simulation and the admin endpoints
+// are enabled.
+const simulatePath = "/debug/simulate"
+
+// WithRequestSimulation exposes a debug endpoint replaying requests through the proxy, for operators to reproduce
+// issues in-cluster. A POST to /debug/simulate takes a JSON request spec, with the method (POST by default), path (/ by
+// default), headers and body of the request, and answers with the status, headers, trailers and body of the response
+// the proxy gave, along with the time it took. As replayed requests skip whatever sits in front of the proxy, the
+// endpoint is only exposed along with the admin endpoints, requiring the same bearer token.
+func WithRequestSimulation() Option {
+	return func(p *proxy) {
+		p.requestSimulation = true
+	}
+}
+
+// simulatedRequest is the spec of a request replayed through the proxy.
+type simulatedRequest struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// simulatedResponse is what the proxy answered to a replayed request.
+type simulatedResponse struct {
+	Status         int         `json:"status"`
+	Headers        http.Header `json:"headers"`
+	Trailers       http.Header `json:"trailers,omitempty"`
+	Body           string      `json:"body"`
+	DurationMillis float64     `json:"durationMillis"`
+}
+
+func (p *proxy) simulate(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.isAdmin(request) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var spec simulatedRequest
+	if err := json.NewDecoder(request.Body).Decode(&spec); err != nil {
+		p.writeError(writer, request, httpErrorf(http.StatusBadRequest, "invalid request spec: %v", err))
+		return
+	}
+	if spec.Method == "" {
+		spec.Method = http.MethodPost
+	}
+	if spec.Path == "" {
+		spec.Path = "/"
+	}
+	simulated, err := http.NewRequest(spec.Method, spec.Path, strings.NewReader(spec.Body))
+	if err != nil {
+		p.writeError(writer, request, httpErrorf(http.StatusBadRequest, "invalid request spec: %v", err))
+		return
+	}
+	simulated = simulated.WithContext(request.Context())
+	simulated.RemoteAddr = request.RemoteAddr
+	for h, v := range spec.Headers {
+		simulated.Header[http.CanonicalHeaderKey(h)] = v
+	}
+	if host := simulated.Header.Get("Host"); host != "" {
+		simulated.Host = host
+		simulated.Header.Del("Host")
+	}
+
+	recorder := &simulationRecorder{header: http.Header{}}
+	started := time.Now()
+	p.handler().ServeHTTP(recorder, simulated)
+	elapsed := time.Since(started)
+
+	writer.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(writer).Encode(recorder.response(elapsed))
+}
+
+// simulationRecorder captures the response to a replayed request. It flushes so that streamed responses are handled
+// as they would be for a client.
+type simulationRecorder struct {
+	header http.Header
+	status int
+	sent   http.Header
+	body   bytes.Buffer
+}
+
+func (r *simulationRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *simulationRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.sent = r.header.Clone()
+	}
+}
+
+func (r *simulationRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *simulationRecorder) Flush() {
+	r.WriteHeader(http.StatusOK)
+}
+
+// response returns what was captured, trailers being the headers set with the http.TrailerPrefix once the response
+// was sent.
+func (r *simulationRecorder) response(elapsed time.Duration) *simulatedResponse {
+	r.WriteHeader(http.StatusOK)
+	response := &simulatedResponse{
+		Status:         r.status,
+		Headers:        r.sent,
+		Body:           r.body.String(),
+		DurationMillis: float64(elapsed) / float64(time.Millisecond),
+	}
+	for h, v := range r.header {
+		if strings.HasPrefix(h, http.TrailerPrefix) {
+			if response.Trailers == nil {
+				response.Trailers = http.Header{}
+			}
+			response.Trailers[strings.TrimPrefix(h, http.TrailerPrefix)] = v
+		}
+	}
+	return response
+}
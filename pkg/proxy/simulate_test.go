@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_simulate_replays_request(t *testing.T) {
+	signal := outputSignal("pong", "text/plain")
+	signal.GetData().Headers = map[string]string{"X-Riff-Status": "201", "X-Custom": "value"}
+	riffClient, invokeClient := mockRiffClientWithFrames(signal)
+	p := &proxy{riffClient: riffClient}
+	WithAdmin("secret")(p)
+	WithRequestSimulation()(p)
+
+	spec := `{"method": "POST", "path": "/", "headers": {"Content-Type": ["text/plain"], "X-Debug": ["yes"]}, ` +
+		`"body": "ping"}`
+	request, _ := http.NewRequest("POST", "/debug/simulate", strings.NewReader(spec))
+	request.Header.Set("Authorization", "Bearer secret")
+	responseRecorder := httptest.NewRecorder()
+	p.mux().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "application/json", responseRecorder.Header().Get("Content-Type"))
+	var response simulatedResponse
+	assert.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusCreated, response.Status)
+	assert.Equal(t, "pong", response.Body)
+	assert.Equal(t, "value", response.Headers.Get("X-Custom"))
+	assert.Equal(t, "text/plain", response.Headers.Get("Content-Type"))
+	assert.True(t, response.DurationMillis >= 0)
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Equal(t, "ping", string(signals[1].GetData().Payload))
+	assert.Equal(t, "text/plain", signals[1].GetData().ContentType)
+	assert.Equal(t, "yes", signals[1].GetData().Headers["X-Debug"])
+}
+
+func Test_simulate_reports_trailers(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "application/json"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithContentTypeChanges(ContentTypeChangesReject)(p)
+	WithAdmin("secret")(p)
+	WithRequestSimulation()(p)
+
+	request, _ := http.NewRequest("POST", "/debug/simulate", strings.NewReader(`{"body": "ping"}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	responseRecorder := httptest.NewRecorder()
+	p.mux().ServeHTTP(responseRecorder, request)
+
+	var response simulatedResponse
+	assert.NoError(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusOK, response.Status)
+	assert.Equal(t, "one", response.Body)
+	assert.Contains(t, response.Trailers.Get("X-Riff-Error"), "output content type changed")
+}
+
+func Test_simulate_invalid_spec(t *testing.T) {
+	p := &proxy{}
+	WithAdmin("secret")(p)
+	WithRequestSimulation()(p)
+
+	request, _ := http.NewRequest("POST", "/debug/simulate", strings.NewReader(`{"body": `))
+	request.Header.Set("Authorization", "Bearer secret")
+	responseRecorder := httptest.NewRecorder()
+	p.mux().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+}
+
+func Test_simulate_requires_post(t *testing.T) {
+	p := &proxy{}
+	WithAdmin("secret")(p)
+	WithRequestSimulation()(p)
+
+	responseRecorder := serve(p.mux(), "GET", "/debug/simulate", "secret")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Code)
+	assert.Equal(t, "POST", responseRecorder.Header().Get("Allow"))
+}
+
+func Test_simulate_disabled_by_default(t *testing.T) {
+	p := &proxy{}
+
+	assert.Equal(t, http.StatusNotImplemented, serve(p.mux(), "POST", "/debug/simulate", "").Code)
+}
+
+func Test_simulate_requires_admin_token(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithAdmin("secret")(p)
+	WithRequestSimulation()(p)
+
+	for _, token := range []string{"", "wrong"} {
+		responseRecorder := serve(p.mux(), "POST", "/debug/simulate", token)
+
+		assert.Equal(t, http.StatusUnauthorized, responseRecorder.Code)
+		assert.Equal(t, "Bearer", responseRecorder.Header().Get("WWW-Authenticate"))
+	}
+	riffClient.AssertNotCalled(t, "Invoke")
+}
+
+func Test_simulate_disabled_without_admin_token(t *testing.T) {
+	p := &proxy{}
+	WithRequestSimulation()(p)
+
+	assert.Equal(t, http.StatusNotImplemented, serve(p.mux(), "POST", "/debug/simulate", "").Code)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// sniffLength is the number of bytes looked at to tell whether a request body looks like JSON.
+const sniffLength = 64
+
+// WithJSONSniffing sets the content type of POST requests not declaring any to application/json, when their body
+// looks like JSON (starts with { or [, ignoring whitespace).
+func WithJSONSniffing() Option {
+	return func(p *proxy) {
+		p.sniffJSON = true
+	}
+}
+
+func (p *proxy) defaultJSONContentType(next http.Handler) http.Handler {
+	if !p.sniffJSON {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// peeking at the body of a request expecting a 100 Continue would tell the client to send it right away
+		if request.Method != http.MethodPost || request.Header.Get("content-type") != "" || expectsContinue(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		reader := bufio.NewReaderSize(request.Body, sniffLength)
+		prefix, _ := reader.Peek(sniffLength)
+		if prefix = bytes.TrimLeft(prefix, " \t\r\n"); len(prefix) > 0 && (prefix[0] == '{' || prefix[0] == '[') {
+			request.Header.Set("content-type", "application/json")
+		}
+		request.Body = readCloser{Reader: reader, Closer: request.Body}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// readCloser reads from a reader wrapping a body, while closing the body itself.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
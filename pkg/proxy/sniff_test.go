@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_sniff_json_object(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONSniffing()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(` {"name": "riff"}`))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "application/json", dataFrame.ContentType)
+	assert.Equal(t, ` {"name": "riff"}`, string(dataFrame.Payload))
+}
+
+func Test_sniff_json_array(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONSniffing()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`[1, 2, 3]`))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "application/json", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_sniff_not_json(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONSniffing()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`hello {}`))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+	assert.Equal(t, "application/octet-stream", dataFrame.ContentType)
+	assert.Equal(t, `hello {}`, string(dataFrame.Payload))
+}
+
+func Test_sniff_declared_content_type(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONSniffing()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	request.Header.Set("Content-Type", "text/plain")
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "text/plain", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_sniff_disabled_by_default(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	p.handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, "application/octet-stream", inputSignals(invokeClient.Calls)[1].GetData().ContentType)
+}
+
+func Test_sniff_validated(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONSniffing()(p)
+	WithJSONValidation()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": `))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventStreamContentType is the media type of server-sent events.
+const eventStreamContentType = "text/event-stream"
+
+// lastEventIDHeader is sent by clients reconnecting to an event stream, telling the id of the last event they got.
+// Like other request headers, it is passed to the function, for it to resume from there.
+const lastEventIDHeader = "Last-Event-ID"
+
+// eventHeader is the output frame header naming the server-sent event a frame becomes, see WithSSEEventNames.
+const eventHeader = "X-Riff-Event"
+
+// keepaliveComment is written to idle event streams. Lines starting with a colon are comments, ignored by clients.
+const keepaliveComment = ":keepalive\n\n"
+
+// WithSSEOutput writes the output frames as server-sent events, streamed as they arrive, to clients accepting
+// text/event-stream. Each frame becomes an event, the lines of its payload being the data lines of the event. Events
+// are given incrementing ids, following the Last-Event-ID of reconnecting clients.
+func WithSSEOutput() Option {
+	return func(p *proxy) {
+		p.sseOutput = true
+	}
+}
+
+// WithSSEHeartbeat writes a :keepalive comment to event streams that stayed idle for the given interval, so that
+// intermediaries and clients don't time them out. A heartbeat due before the function's first frame commits the
+// response with a 200 status. When untilData is set, heartbeats stop once the first frame is received, otherwise they
+// are interleaved with events for as long as the stream lasts.
+func WithSSEHeartbeat(interval time.Duration, untilData bool) Option {
+	return func(p *proxy) {
+		p.sseHeartbeat = interval
+		p.sseHeartbeatUntilData = untilData
+	}
+}
+
+// SSEEventNames tells where the names of server-sent events come from, so that clients may listen to each type of
+// event separately. Events are unnamed message events by default.
+type SSEEventNames string
+
+const (
+	// SSEEventNamesHeader names events after the X-Riff-Event header of output frames, frames without one becoming
+	// unnamed events
+	SSEEventNamesHeader SSEEventNames = "header"
+	// SSEEventNamesContentType names events after the media type of output frames, such as application/json
+	SSEEventNamesContentType SSEEventNames = "content-type"
+)
+
+// WithSSEEventNames sets where the names of server-sent events come from.
+func WithSSEEventNames(source SSEEventNames) Option {
+	return func(p *proxy) {
+		p.sseEventNames = source
+	}
+}
+
+// sseOutputRequested tells whether the output should be written as server-sent events.
+func (p *proxy) sseOutputRequested(request *http.Request) bool {
+	return p.sseOutput && !p.rawHTTP && accepts(request, eventStreamContentType)
+}
+
+// firstEventID returns the id of the first event of a stream, following the numeric Last-Event-ID of a reconnecting
+// client, if any.
+func firstEventID(request *http.Request) uint64 {
+	if id, err := strconv.ParseUint(strings.TrimSpace(request.Header.Get(lastEventIDHeader)), 10, 64); err == nil {
+		return id + 1
+	}
+	return 1
+}
+
+// eventName returns the name of the event an output frame becomes, if any, removing the X-Riff-Event header from the
+// frame when events are named after it.
+func (p *proxy) eventName(frame *rpc.OutputFrame) (string, error) {
+	var name string
+	switch p.sseEventNames {
+	case SSEEventNamesHeader:
+		var key string
+		if key, name = frameHeader(frame.Headers, eventHeader); key != "" {
+			delete(frame.Headers, key)
+		}
+	case SSEEventNamesContentType:
+		name, _, _ = mime.ParseMediaType(frame.ContentType)
+	}
+	if strings.ContainsAny(name, "\r\n") {
+		return "", httpErrorf(http.StatusBadGateway, "invalid event name %q", name)
+	}
+	return name, nil
+}
+
+// sseEvent turns an output frame into a server-sent event with the given id, with a data line for each line of the
+// payload. The event is named after the frame as configured, unnamed events being message events.
+func (p *proxy) sseEvent(frame *rpc.OutputFrame, id uint64) error {
+	name, err := p.eventName(frame)
+	if err != nil {
+		return err
+	}
+	payload := bytes.Replace(frame.Payload, []byte("\r\n"), []byte("\n"), -1)
+	var event bytes.Buffer
+	event.WriteString("id: ")
+	event.WriteString(strconv.FormatUint(id, 10))
+	event.WriteByte('\n')
+	if name != "" {
+		event.WriteString("event: ")
+		event.WriteString(name)
+		event.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(bytes.Replace(line, []byte("\r"), nil, -1))
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	frame.ContentType = eventStreamContentType
+	frame.Payload = event.Bytes()
+	return nil
+}
+
+// heartbeatClient receives output frames, writing a keepalive comment to the response each time none is received for
+// the interval. Frames are received in the background while waiting, so that the response is only ever written from
+// the receiving goroutine.
+type heartbeatClient struct {
+	rpc.Riff_InvokeClient
+	response  *responseWriter
+	interval  time.Duration
+	untilData bool
+	received  bool
+}
+
+type receivedSignal struct {
+	outputSignal *rpc.OutputSignal
+	err          error
+}
+
+func (c *heartbeatClient) Recv() (*rpc.OutputSignal, error) {
+	if c.untilData && c.received {
+		return c.Riff_InvokeClient.Recv()
+	}
+	signals := make(chan receivedSignal, 1)
+	go func() {
+		outputSignal, err := c.Riff_InvokeClient.Recv()
+		signals <- receivedSignal{outputSignal: outputSignal, err: err}
+	}()
+	timer := time.NewTimer(c.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case signal := <-signals:
+			c.received = c.received || signal.err == nil
+			return signal.outputSignal, signal.err
+		case <-timer.C:
+			if err := c.beat(); err != nil {
+				return nil, err
+			}
+			timer.Reset(c.interval)
+		}
+	}
+}
+
+// beat writes a keepalive comment, committing the response first if need be.
+func (c *heartbeatClient) beat() error {
+	if !c.response.committed {
+		if len(c.response.pending) == 0 {
+			c.response.writer.Header().Set("Content-Type", eventStreamContentType)
+		}
+		if err := c.response.commit(); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(c.response.writer, keepaliveComment); err != nil {
+		return err
+	}
+	c.response.flush()
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockRiffClientWithDelayedFrames returns a client whose output frames are each received after the given delay.
+func mockRiffClientWithDelayedFrames(delay time.Duration, outputSignals ...*rpc.OutputSignal) *mocks.RiffClient {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	riffClient.On("Invoke", mock.Anything).Return(invokeClient, nil)
+	invokeClient.On("Send", mock.Anything).Return(nil)
+	invokeClient.On("CloseSend").Return(nil)
+	for _, signal := range outputSignals {
+		invokeClient.On("Recv").Return(signal, nil).After(delay).Once()
+	}
+	invokeClient.On("Recv").Return(nil, io.EOF)
+	return riffClient
+}
+
+func Test_sse_output_one_event_per_frame(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		outputSignal("two\r\nlines", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "text/event-stream", responseRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, "id: 1\ndata: one\n\nid: 2\ndata: two\ndata: lines\n\n", responseRecorder.Body.String())
+	assert.True(t, responseRecorder.Flushed)
+	startFrame := inputSignals(invokeClient.Calls)[0].GetStart()
+	assert.Equal(t, []string{"text/plain, application/json"}, startFrame.ExpectedContentTypes)
+}
+
+func Test_sse_output_disabled_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("one", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "one", responseRecorder.Body.String())
+}
+
+func Test_sse_heartbeat_during_quiet_period(t *testing.T) {
+	riffClient := mockRiffClientWithDelayedFrames(50*time.Millisecond,
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithSSEHeartbeat(10*time.Millisecond, false)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := &flushesRecorder{ResponseRecorder: httptest.NewRecorder()}
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "text/event-stream", responseRecorder.Header().Get("Content-Type"))
+	// heartbeats start before the first event, committing the response, and go on between events
+	body := responseRecorder.Body.String()
+	assert.True(t, strings.HasPrefix(body, ":keepalive\n\n"), body)
+	one, two := strings.Index(body, "id: 1\ndata: one\n\n"), strings.Index(body, "id: 2\ndata: two\n\n")
+	if assert.True(t, one > 0 && two > one, body) {
+		assert.Contains(t, body[one:two], ":keepalive\n\n")
+	}
+	assert.Contains(t, responseRecorder.flushes, ":keepalive\n\n")
+}
+
+func Test_sse_heartbeat_until_data(t *testing.T) {
+	riffClient := mockRiffClientWithDelayedFrames(50*time.Millisecond,
+		outputSignal("one", "text/plain"),
+		outputSignal("two", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithSSEHeartbeat(10*time.Millisecond, true)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	body := responseRecorder.Body.String()
+	one := strings.Index(body, "id: 1\ndata: one\n\n")
+	if assert.True(t, one > 0, body) {
+		assert.Contains(t, body[:one], ":keepalive\n\n")
+		assert.Equal(t, "id: 1\ndata: one\n\nid: 2\ndata: two\n\n", body[one:])
+	}
+}
+
+func Test_sse_heartbeat_not_due(t *testing.T) {
+	riffClient := mockRiffClientWithDelayedFrames(30*time.Millisecond,
+		outputSignal("one", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithSSEHeartbeat(time.Second, false)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "id: 1\ndata: one\n\n", responseRecorder.Body.String())
+}
+
+func Test_sse_resumes_after_last_event_id(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(
+		outputSignal("forty-two", "text/plain"),
+		outputSignal("forty-three", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Last-Event-ID", "41")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "id: 42\ndata: forty-two\n\nid: 43\ndata: forty-three\n\n", responseRecorder.Body.String())
+	assert.Equal(t, "41", inputSignals(invokeClient.Calls)[1].GetData().Headers["Last-Event-Id"])
+}
+
+func Test_sse_non_numeric_last_event_id(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithFrames(outputSignal("one", "text/plain"))
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Last-Event-ID", "cursor-abc")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "id: 1\ndata: one\n\n", responseRecorder.Body.String())
+	assert.Equal(t, "cursor-abc", inputSignals(invokeClient.Calls)[1].GetData().Headers["Last-Event-Id"])
+}
+
+func Test_sse_event_names(t *testing.T) {
+	for _, test := range []struct {
+		source   SSEEventNames
+		expected string
+	}{
+		{
+			source:   "",
+			expected: "id: 1\ndata: created\n\nid: 2\ndata: {}\n\nid: 3\ndata: plain\n\n",
+		},
+		{
+			source: SSEEventNamesHeader,
+			expected: "id: 1\nevent: order-created\ndata: created\n\n" +
+				"id: 2\nevent: order-shipped\ndata: {}\n\n" +
+				"id: 3\ndata: plain\n\n",
+		},
+		{
+			source: SSEEventNamesContentType,
+			expected: "id: 1\nevent: text/plain\ndata: created\n\n" +
+				"id: 2\nevent: application/json\ndata: {}\n\n" +
+				"id: 3\nevent: text/plain\ndata: plain\n\n",
+		},
+	} {
+		t.Run(string(test.source), func(t *testing.T) {
+			riffClient, _ := mockRiffClientWithFrames(
+				&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: &rpc.OutputFrame{
+					Payload:     []byte("created"),
+					ContentType: "text/plain",
+					Headers:     map[string]string{"x-riff-event": "order-created"},
+				}}},
+				&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: &rpc.OutputFrame{
+					Payload:     []byte("{}"),
+					ContentType: "application/json; charset=utf-8",
+					Headers:     map[string]string{"X-Riff-Event": "order-shipped"},
+				}}},
+				outputSignal("plain", "text/plain"),
+			)
+			p := &proxy{riffClient: riffClient}
+			WithSSEOutput()(p)
+			WithSSEEventNames(test.source)(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+			request.Header.Set("Accept", "text/event-stream")
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, test.expected, responseRecorder.Body.String())
+		})
+	}
+}
+
+func Test_sse_event_names_header_not_copied(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: &rpc.OutputFrame{
+			Payload:     []byte("created"),
+			ContentType: "text/plain",
+			Headers:     map[string]string{"X-Riff-Event": "order-created"},
+		}}},
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithSSEEventNames(SSEEventNamesHeader)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Empty(t, responseRecorder.Header().Get("X-Riff-Event"))
+}
+
+func Test_sse_event_names_invalid(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one", "text/plain"),
+		&rpc.OutputSignal{Frame: &rpc.OutputSignal_Data{Data: &rpc.OutputFrame{
+			Payload:     []byte("two"),
+			ContentType: "text/plain",
+			Headers:     map[string]string{"X-Riff-Event": "injected\ndata: forged"},
+		}}},
+	)
+	p := &proxy{riffClient: riffClient}
+	WithSSEOutput()(p)
+	WithSSEEventNames(SSEEventNamesHeader)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "text/event-stream")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "id: 1\ndata: one\n\n", responseRecorder.Body.String())
+	assert.Equal(t, `invalid event name "injected\ndata: forged"`, responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
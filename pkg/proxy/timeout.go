@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// WithInvocationTimeout gives up on invocations lasting longer than timeout, answering with a 504 when the response
+// hasn't started yet. The deadline is sent along with the call, as its grpc-timeout, so that the backend stops
+// working on the invocation at the same time. Asynchronous invocations are given as long to complete in the
+// background.
+func WithInvocationTimeout(timeout time.Duration) Option {
+	return func(p *proxy) {
+		p.invocationTimeout = timeout
+	}
+}
+
+// WithConnectTimeout gives up on invocations the backend didn't accept within timeout, that is opening the stream and
+// sending the start frame, answering with a 503. Unlike the invocation timeout, it doesn't bound how long the function
+// may take once the invocation has been accepted.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(p *proxy) {
+		p.connectTimeout = timeout
+	}
+}
+
+// connectContext returns a context of ctx cancelled when the connect timeout of the route, if any, expires. Once the
+// invocation has been accepted, connected tells whether it was in time, as the context has been cancelled otherwise.
+func (p *proxy) connectContext(ctx context.Context, route *route) (context.Context, func() error) {
+	timeout := p.connectTimeout
+	if route.ConnectTimeout > 0 {
+		timeout = route.ConnectTimeout
+	}
+	if timeout <= 0 {
+		return ctx, func() error { return nil }
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	return ctx, func() error {
+		if !timer.Stop() {
+			return status.Errorf(codes.Unavailable, "backend didn't accept the invocation within %s", timeout)
+		}
+		return nil
+	}
+}
+
+// invocationContext returns a context of ctx ending with the invocation timeout of the route, if any.
+func (p *proxy) invocationContext(ctx context.Context, route *route) (context.Context, context.CancelFunc) {
+	timeout := p.current().invocationTimeout
+	if route.InvocationTimeout > 0 {
+		timeout = route.InvocationTimeout
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"github.com/projectriff/streaming-http-adapter/pkg/proxy/mocks"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadlineServer records the deadline the invocations it answers were received with.
+type deadlineServer struct {
+	deadlines chan time.Time
+}
+
+func (s *deadlineServer) Invoke(stream rpc.Riff_InvokeServer) error {
+	deadline, _ := stream.Context().Deadline()
+	s.deadlines <- deadline
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return stream.Send(outputSignal("ok", "text/plain"))
+}
+
+func Test_invocation_timeout_sent_to_backend(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	backend := &deadlineServer{deadlines: make(chan time.Time, 1)}
+	rpc.RegisterRiffServer(server, backend)
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &proxy{riffClient: rpc.NewRiffClient(conn)}
+	WithInvocationTimeout(5 * time.Second)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	sent := time.Now()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	// the backend derives its deadline from the grpc-timeout of the call
+	deadline := <-backend.deadlines
+	assert.WithinDuration(t, sent.Add(5*time.Second), deadline, time.Second)
+}
+
+func Test_invocation_timeout_exceeded(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithInvocationTimeout(10 * time.Millisecond)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusGatewayTimeout, responseRecorder.Code)
+	assert.Equal(t, "invocation timed out\n", responseRecorder.Body.String())
+}
+
+func Test_invocation_timeout_none(t *testing.T) {
+	var ctx context.Context
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	riffClient.ExpectedCalls[0].Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	})
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+}
+
+func Test_invocation_timeout_async(t *testing.T) {
+	riffClient, _, release, completed := mockRiffClientReleased()
+	var ctx context.Context
+	riffClient.ExpectedCalls[0].Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	})
+	p := &proxy{riffClient: riffClient}
+	WithAsync(http.StatusAccepted)(p)
+	WithInvocationTimeout(time.Minute)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusAccepted, responseRecorder.Code)
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	close(release)
+	<-completed
+}
+
+func Test_connect_timeout_exceeded(t *testing.T) {
+	riffClient := &mocks.RiffClient{}
+	invokeClient := &mocks.Riff_InvokeClient{}
+	var ctx context.Context
+	riffClient.On("Invoke", mock.Anything).Run(func(args mock.Arguments) {
+		ctx = args.Get(0).(context.Context)
+	}).Return(invokeClient, nil)
+	// the start frame never gets through, until the invocation is given up
+	invokeClient.On("Send", mock.Anything).Run(func(mock.Arguments) {
+		<-ctx.Done()
+	}).Return(io.EOF)
+	invokeClient.On("Recv").Return(nil, status.Error(codes.Canceled, "context canceled"))
+	p := &proxy{riffClient: riffClient}
+	WithConnectTimeout(10 * time.Millisecond)(p)
+	WithInvocationTimeout(time.Minute)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, responseRecorder.Code)
+	assert.Equal(t, "backend didn't accept the invocation within 10ms\n", responseRecorder.Body.String())
+}
+
+func Test_connect_timeout_not_bounding_invocation(t *testing.T) {
+	riffClient, _ := mockRiffClientUntilCancelled()
+	p := &proxy{riffClient: riffClient}
+	WithConnectTimeout(time.Minute)(p)
+	WithInvocationTimeout(50 * time.Millisecond)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusGatewayTimeout, responseRecorder.Code)
+	assert.Equal(t, "invocation timed out\n", responseRecorder.Body.String())
+}
+
+func Test_connect_timeout_slow_function(t *testing.T) {
+	riffClient := mockRiffClientWithDelayedFrames(50*time.Millisecond, outputSignal("ok", "text/plain"))
+	p := &proxy{riffClient: riffClient}
+	WithConnectTimeout(10 * time.Millisecond)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+}
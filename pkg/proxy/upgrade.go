@@ -0,0 +1,43 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net/http"
+)
+
+// WithUpgradeRejection rejects requests asking to switch protocols with an Upgrade header, such as WebSocket
+// handshakes, with the given status, typically 501 or 426. Functions only deal with plain request/response exchanges,
+// and such requests would otherwise be invoked as if the Upgrade header wasn't there.
+func WithUpgradeRejection(status int) Option {
+	return func(p *proxy) {
+		p.upgradeStatus = status
+	}
+}
+
+func (p *proxy) rejectUpgrades(next http.Handler) http.Handler {
+	if p.upgradeStatus == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if upgrade := request.Header.Get("upgrade"); upgrade != "" {
+			p.writeError(writer, request, httpErrorf(p.upgradeStatus, "upgrade to %q not supported", upgrade))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
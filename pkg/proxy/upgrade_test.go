@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_upgrade_rejected(t *testing.T) {
+	for _, status := range []int{http.StatusNotImplemented, http.StatusUpgradeRequired} {
+		riffClient, _ := mockRiffClient()
+		p := &proxy{riffClient: riffClient}
+		WithUpgradeRejection(status)(p)
+
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, status, responseRecorder.Code)
+		assert.Contains(t, responseRecorder.Body.String(), `upgrade to "websocket" not supported`)
+		riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+	}
+}
+
+func Test_upgrade_rejection_plain_requests(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithUpgradeRejection(http.StatusUpgradeRequired)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+}
+
+func Test_upgrade_ignored_by_default(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("hello"))
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"github.com/projectriff/streaming-http-adapter/pkg/rpc"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// InvalidUTF8 tells how text outputs that are not valid UTF-8 are handled.
+type InvalidUTF8 string
+
+const (
+	// InvalidUTF8Reject rejects buffered outputs with a 502, and cuts streamed outputs short with an X-Riff-Error
+	// trailer
+	InvalidUTF8Reject InvalidUTF8 = "reject"
+	// InvalidUTF8Replace replaces each run of invalid bytes with the U+FFFD replacement character
+	InvalidUTF8Replace InvalidUTF8 = "replace"
+)
+
+// replacementCharacter stands for invalid bytes, as browsers do.
+var replacementCharacter = []byte(string(utf8.RuneError))
+
+// WithUTF8Validation checks that text outputs are valid UTF-8 before writing them, handling invalid bytes as told by
+// the policy. Outputs are text when of a text/* media type, JSON, XML or JavaScript, unless declaring a charset other
+// than UTF-8.
+func WithUTF8Validation(policy InvalidUTF8) Option {
+	return func(p *proxy) {
+		p.invalidUTF8 = policy
+	}
+}
+
+// utf8Text tells whether a content type is text expected to be encoded as UTF-8.
+func utf8Text(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	charset, ok := params["charset"]
+	if ok && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"), isJSON(contentType), mediaType == ndjsonContentType:
+		return true
+	case mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"), mediaType == "application/javascript":
+		return true
+	}
+	return false
+}
+
+// utf8Validator validates the text of an output frame after frame, a nil validator validating nothing. Unless frames
+// are whole, a frame may end with the first bytes of a character completed by the next frame, which are held until
+// then.
+type utf8Validator struct {
+	policy InvalidUTF8
+	whole  bool
+	// contentType is the one of the last frame telling it
+	contentType string
+	partial     []byte
+}
+
+// newUTF8Validator returns the validator of an output, if enabled. Whole frames are text of their own, such as lines
+// of newline delimited JSON, rather than parts of a longer text.
+func (p *proxy) newUTF8Validator(whole bool) *utf8Validator {
+	if p.invalidUTF8 == "" {
+		return nil
+	}
+	return &utf8Validator{policy: p.invalidUTF8, whole: whole}
+}
+
+// validate checks the payload of a frame, replacing invalid bytes or returning an error as configured.
+func (v *utf8Validator) validate(frame *rpc.OutputFrame) error {
+	if v == nil {
+		return nil
+	}
+	if frame.ContentType != "" {
+		v.contentType = frame.ContentType
+	}
+	if !utf8Text(v.contentType) {
+		return nil
+	}
+	payload := append(v.partial, frame.Payload...)
+	v.partial = nil
+	if n := incompleteSuffix(payload); n > 0 && !v.whole {
+		v.partial = append([]byte(nil), payload[len(payload)-n:]...)
+		payload = payload[:len(payload)-n]
+	}
+	frame.Payload = payload
+	if utf8.Valid(payload) {
+		return nil
+	}
+	if v.policy == InvalidUTF8Replace {
+		frame.Payload = bytes.ToValidUTF8(payload, replacementCharacter)
+		return nil
+	}
+	return invalidUTF8Error()
+}
+
+// end checks that the last frame didn't leave a character incomplete, returning what replaces it if need be.
+func (v *utf8Validator) end() ([]byte, error) {
+	if v == nil || len(v.partial) == 0 {
+		return nil, nil
+	}
+	if v.policy == InvalidUTF8Replace {
+		return replacementCharacter, nil
+	}
+	return nil, invalidUTF8Error()
+}
+
+func invalidUTF8Error() error {
+	return httpErrorf(http.StatusBadGateway, "output is not valid UTF-8")
+}
+
+// incompleteSuffix returns the number of bytes at the end of a payload starting a character without completing it.
+func incompleteSuffix(payload []byte) int {
+	for n := 1; n < utf8.UTFMax && n <= len(payload); n++ {
+		if utf8.RuneStart(payload[len(payload)-n]) {
+			if utf8.FullRune(payload[len(payload)-n:]) {
+				return 0
+			}
+			return n
+		}
+	}
+	return 0
+}
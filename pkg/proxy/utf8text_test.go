@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_utf8_validation_buffered(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		policy      InvalidUTF8
+		payload     string
+		contentType string
+		status      int
+		body        string
+	}{
+		{"valid", InvalidUTF8Reject, "café", "text/plain", http.StatusOK, "café"},
+		{"rejected", InvalidUTF8Reject, "caf\xe9", "text/plain; charset=utf-8", http.StatusBadGateway, ""},
+		{"replaced", InvalidUTF8Replace, "caf\xe9 \xff\xfeok", "application/json", http.StatusOK, "caf� �ok"},
+		{"incomplete", InvalidUTF8Replace, "caf\xc3", "text/plain", http.StatusOK, "caf�"},
+		{"binary", InvalidUTF8Reject, "\xff\xfe", "application/octet-stream", http.StatusOK, "\xff\xfe"},
+		{"other charset", InvalidUTF8Reject, "caf\xe9", "text/plain; charset=iso-8859-1", http.StatusOK, "caf\xe9"},
+		{"disabled", "", "caf\xe9", "text/plain", http.StatusOK, "caf\xe9"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			riffClient, _ := mockRiffClientWithResponse(test.payload, test.contentType)
+			p := &proxy{riffClient: riffClient}
+			WithUTF8Validation(test.policy)(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, test.status, responseRecorder.Code)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.body, responseRecorder.Body.String())
+			}
+		})
+	}
+}
+
+func Test_utf8_validation_streamed_split_character(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("caf\xc3", "text/plain"),
+		outputSignal("\xa9 \xe2\x82", ""),
+		outputSignal("\xac", ""),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithUTF8Validation(InvalidUTF8Reject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "café €", responseRecorder.Body.String())
+	assert.Empty(t, responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
+
+func Test_utf8_validation_streamed_rejected(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal("one,", "text/plain"),
+		outputSignal("tw\xff", "text/plain"),
+		outputSignal("three", "text/plain"),
+	)
+	p := &proxy{riffClient: riffClient, streaming: true}
+	WithUTF8Validation(InvalidUTF8Reject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "one,", responseRecorder.Body.String())
+	assert.Equal(t, "output is not valid UTF-8", responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+}
+
+func Test_utf8_validation_streamed_incomplete_end(t *testing.T) {
+	for _, test := range []struct {
+		policy  InvalidUTF8
+		body    string
+		trailer string
+	}{
+		{InvalidUTF8Reject, "caf", "output is not valid UTF-8"},
+		{InvalidUTF8Replace, "caf�", ""},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			riffClient, _ := mockRiffClientWithFrames(outputSignal("caf\xc3", "text/plain"))
+			p := &proxy{riffClient: riffClient, streaming: true}
+			WithUTF8Validation(test.policy)(p)
+
+			request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+			responseRecorder := httptest.NewRecorder()
+			p.invokeGrpc(responseRecorder, request)
+
+			assert.Equal(t, test.body, responseRecorder.Body.String())
+			assert.Equal(t, test.trailer, responseRecorder.Result().Trailer.Get("X-Riff-Error"))
+		})
+	}
+}
+
+func Test_utf8_validation_ndjson_whole_frames(t *testing.T) {
+	riffClient, _ := mockRiffClientWithFrames(
+		outputSignal(`"caf`+"\xc3", "application/json"),
+		outputSignal("\xa9\"", "application/json"),
+	)
+	p := &proxy{riffClient: riffClient}
+	WithNDJSONOutput(false)(p)
+	WithUTF8Validation(InvalidUTF8Replace)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	request.Header.Set("Accept", "application/x-ndjson")
+	responseRecorder := httptest.NewRecorder()
+	p.invokeGrpc(responseRecorder, request)
+
+	assert.Equal(t, "\"caf�\n�\"\n", responseRecorder.Body.String())
+}
+
+func Test_utf8Text(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"text/plain":                     true,
+		"text/html; charset=UTF-8":       true,
+		"application/json":               true,
+		"application/cloudevents+json":   true,
+		"application/x-ndjson":           true,
+		"application/xml":                true,
+		"image/svg+xml":                  true,
+		"application/javascript":         true,
+		"text/plain; charset=iso-8859-1": false,
+		"application/octet-stream":       false,
+		"image/png":                      false,
+		"":                               false,
+	} {
+		assert.Equal(t, expected, utf8Text(contentType), contentType)
+	}
+}
+
+func Test_incompleteSuffix(t *testing.T) {
+	assert.Equal(t, 0, incompleteSuffix(nil))
+	assert.Equal(t, 0, incompleteSuffix([]byte("café")))
+	assert.Equal(t, 1, incompleteSuffix([]byte("caf\xc3")))
+	assert.Equal(t, 2, incompleteSuffix([]byte("\xe2\x82")))
+	assert.Equal(t, 3, incompleteSuffix([]byte("\xf0\x9f\x98")))
+	assert.Equal(t, 0, incompleteSuffix([]byte("\xff")))
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// WithJSONValidation rejects requests declaring a JSON content type whose body is not well-formed JSON, with a 400
+// and without invoking the function.
+func WithJSONValidation() Option {
+	return func(p *proxy) {
+		p.validateJSON = true
+	}
+}
+
+func (p *proxy) rejectMalformedJSON(next http.Handler) http.Handler {
+	if !p.validateJSON {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost || !isJSON(request.Header.Get("content-type")) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// the body is buffered anyway when framed, read it now and hand it over
+		p.checkBody(writer, request, next, func(body []byte) error {
+			if !json.Valid(body) {
+				return httpErrorf(http.StatusBadRequest, "malformed JSON request body")
+			}
+			return nil
+		})
+	})
+}
+
+// WithRejectedContentTypes rejects requests of the given media types with a 415, without invoking the function.
+// Media types may use a wildcard subtype, such as multipart/*. Parameters such as charset are ignored.
+func WithRejectedContentTypes(mediaTypes []string) Option {
+	return func(p *proxy) {
+		p.rejectedContentTypes = nil
+		for _, t := range mediaTypes {
+			p.rejectedContentTypes = append(p.rejectedContentTypes, strings.ToLower(t))
+		}
+	}
+}
+
+func (p *proxy) rejectContentTypes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(request.Header.Get("content-type"))
+		for _, rejected := range p.current().rejectedContentTypes {
+			if matchesMediaType(mediaType, rejected) {
+				p.writeError(writer, request,
+					httpErrorf(http.StatusUnsupportedMediaType, "content type %s not supported", mediaType))
+				return
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// matchesMediaType tells whether a media type is the given one, or has the type of a type/* pattern.
+func matchesMediaType(mediaType string, pattern string) bool {
+	if mediaType == "" {
+		return false
+	} else if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return mediaType == pattern
+}
+
+// DuplicateContentTypes tells how to handle requests carrying several Content-Type headers, input frames having a
+// single content type.
+type DuplicateContentTypes string
+
+const (
+	// DuplicateContentTypesFirst keeps the first Content-Type header, dropping the others
+	DuplicateContentTypesFirst DuplicateContentTypes = "first"
+	// DuplicateContentTypesReject rejects the request with a 400
+	DuplicateContentTypesReject DuplicateContentTypes = "reject"
+)
+
+// WithDuplicateContentTypes sets how requests carrying several Content-Type headers are handled, the first one being
+// kept by default.
+func WithDuplicateContentTypes(policy DuplicateContentTypes) Option {
+	return func(p *proxy) {
+		p.duplicateContentTypes = policy
+	}
+}
+
+// checkDuplicateContentTypes applies the configured policy to requests carrying several Content-Type headers, so that
+// the rest of the chain, and the function, only ever see one.
+func (p *proxy) checkDuplicateContentTypes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if values := request.Header["Content-Type"]; len(values) > 1 {
+			if p.duplicateContentTypes == DuplicateContentTypesReject {
+				p.writeError(writer, request,
+					httpErrorf(http.StatusBadRequest, "%d Content-Type headers, expected one", len(values)))
+				return
+			}
+			request.Header["Content-Type"] = values[:1]
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// Validator checks a request body before it is handed to the function. The returned error details why the body is
+// invalid and is reported to the client.
+type Validator func(body []byte) error
+
+// WithValidator registers a validator for request bodies of the given media type (parameters such as charset are
+// ignored when matching). Requests failing validation are rejected with a 422, without invoking the function.
+func WithValidator(mediaType string, validator Validator) Option {
+	return func(p *proxy) {
+		if p.validators == nil {
+			p.validators = make(map[string]Validator)
+		}
+		p.validators[strings.ToLower(mediaType)] = validator
+	}
+}
+
+func (p *proxy) validateBodies(next http.Handler) http.Handler {
+	if len(p.validators) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(request.Header.Get("content-type"))
+		validator, ok := p.validators[mediaType]
+		if request.Method != http.MethodPost || !ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		p.checkBody(writer, request, next, func(body []byte) error {
+			if err := validator(body); err != nil {
+				return httpErrorf(http.StatusUnprocessableEntity, "invalid request body: %v", err)
+			}
+			return nil
+		})
+	})
+}
+
+// isJSON tells whether a content type is application/json or a structured syntax suffixed +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
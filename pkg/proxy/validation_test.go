@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_validateJSON_valid(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithJSONValidation()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": "riff"}`))
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, `{"name": "riff"}`, string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_validateJSON_malformed(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithJSONValidation()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": `))
+	request.Header.Set("Content-Type", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_validateJSON_other_content_type(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithJSONValidation()(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": `))
+	request.Header.Set("Content-Type", "text/plain")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
+
+func Test_validator_rejects(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithValidator("application/json", func(body []byte) error {
+		return errors.New(`missing required property "name"`)
+	})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{}`))
+	request.Header.Set("Content-Type", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, responseRecorder.Code)
+	assert.Equal(t, "invalid request body: missing required property \"name\"\n", responseRecorder.Body.String())
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_validator_accepts(t *testing.T) {
+	riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	var validated string
+	WithValidator("application/json", func(body []byte) error {
+		validated = string(body)
+		return nil
+	})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": "riff"}`))
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, `{"name": "riff"}`, validated)
+	assert.Equal(t, `{"name": "riff"}`, string(inputSignals(invokeClient.Calls)[1].GetData().Payload))
+}
+
+func Test_rejected_content_type(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithRejectedContentTypes([]string{"Multipart/Form-Data", "image/*"})(p)
+
+	for _, contentType := range []string{"multipart/form-data; boundary=xyz", "image/png"} {
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		request.Header.Set("Content-Type", contentType)
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, responseRecorder.Code, contentType)
+	}
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_rejected_content_type_other_passes(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithRejectedContentTypes([]string{"multipart/form-data"})(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Content-Type", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+	assert.Equal(t, "ok", responseRecorder.Body.String())
+}
+
+func Test_duplicate_content_types_first(t *testing.T) {
+	for _, policy := range []DuplicateContentTypes{"", DuplicateContentTypesFirst} {
+		riffClient, invokeClient := mockRiffClientWithResponse("ok", "text/plain")
+		p := &proxy{riffClient: riffClient}
+		WithDuplicateContentTypes(policy)(p)
+
+		request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+		request.Header.Add("Content-Type", "text/plain")
+		request.Header.Add("Content-Type", "application/json")
+		responseRecorder := httptest.NewRecorder()
+		p.handler().ServeHTTP(responseRecorder, request)
+
+		assert.Equal(t, http.StatusOK, responseRecorder.Code, policy)
+		dataFrame := inputSignals(invokeClient.Calls)[1].GetData()
+		assert.Equal(t, "text/plain", dataFrame.ContentType, policy)
+		assert.Equal(t, "text/plain", dataFrame.Headers["Content-Type"], policy)
+		assert.Equal(t, []string{"text/plain"}, request.Header["Content-Type"], policy)
+	}
+}
+
+func Test_duplicate_content_types_reject(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithDuplicateContentTypes(DuplicateContentTypesReject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Add("Content-Type", "text/plain")
+	request.Header.Add("Content-Type", "application/json")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	assert.Contains(t, responseRecorder.Body.String(), "2 Content-Type headers, expected one")
+	riffClient.AssertNotCalled(t, "Invoke", mock.Anything)
+}
+
+func Test_duplicate_content_types_single_passes(t *testing.T) {
+	riffClient, _ := mockRiffClientWithResponse("ok", "text/plain")
+	p := &proxy{riffClient: riffClient}
+	WithDuplicateContentTypes(DuplicateContentTypesReject)(p)
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader("some body"))
+	request.Header.Set("Content-Type", "text/plain")
+	responseRecorder := httptest.NewRecorder()
+	p.handler().ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+}
+
+func Test_matchesMediaType(t *testing.T) {
+	assert.True(t, matchesMediaType("image/png", "image/*"))
+	assert.False(t, matchesMediaType("imagery/png", "image/*"))
+	assert.True(t, matchesMediaType("text/csv", "text/csv"))
+	assert.False(t, matchesMediaType("", "*/*"))
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// WithWarmup starts and immediately closes an invocation of the function without any input at the given interval,
+// unless requests have been served in the meantime. This keeps the connection to the invoker, as well as the
+// function, warm between sparse requests.
+func WithWarmup(interval time.Duration) Option {
+	return func(p *proxy) {
+		if interval > 0 {
+			p.warmupInterval = interval
+			p.warmupStop = make(chan struct{})
+		}
+	}
+}
+
+// activity accounts for a request being served, returning a function to call once done.
+func (p *proxy) activity() func() {
+	atomic.AddInt32(&p.inFlight, 1)
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+	return func() {
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+		atomic.AddInt32(&p.inFlight, -1)
+	}
+}
+
+// idle tells whether no request has been served for at least the warmup interval.
+func (p *proxy) idle(now time.Time) bool {
+	last := time.Unix(0, atomic.LoadInt64(&p.lastActivity))
+	return atomic.LoadInt32(&p.inFlight) == 0 && now.Sub(last) >= p.warmupInterval
+}
+
+// warmupLoop warms the invoker up at the configured interval while idle, until stop is closed.
+func (p *proxy) warmupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.warmupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if !p.idle(now) {
+				continue
+			}
+			if err := p.warmup(); err != nil {
+				log.Printf("warmup failed: %v", err)
+			}
+		}
+	}
+}
+
+// warmup performs a start/close handshake with the invoker, discarding any output.
+func (p *proxy) warmup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.warmupInterval)
+	defer cancel()
+	route := p.resolve("/")
+	request, _ := http.NewRequest(http.MethodPost, "/", nil)
+	client, err := p.open(ctx, request, route, route.backends[0])
+	if err != nil {
+		return err
+	}
+	if err := client.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		if _, err := client.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 the original author or authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_warmup_at_interval(t *testing.T) {
+	riffClient := mockRiffClientWithRepeatedResponse(100, "", "")
+	p := &proxy{riffClient: riffClient}
+	WithWarmup(20 * time.Millisecond)(p)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.warmupLoop(p.warmupStop)
+		close(stopped)
+	}()
+	time.Sleep(110 * time.Millisecond)
+	close(p.warmupStop)
+	<-stopped
+
+	warmups := len(riffClient.Calls)
+	assert.True(t, warmups >= 2 && warmups <= 5, "expected about 5 warmups, got %d", warmups)
+}
+
+func Test_warmup_handshake(t *testing.T) {
+	riffClient, invokeClient := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithWarmup(time.Second)(p)
+
+	assert.NoError(t, p.warmup())
+
+	signals := inputSignals(invokeClient.Calls)
+	assert.Len(t, signals, 1)
+	assert.NotNil(t, signals[0].GetStart())
+	invokeClient.AssertCalled(t, "CloseSend")
+}
+
+func Test_warmup_skipped_while_serving(t *testing.T) {
+	riffClient, _ := mockRiffClient()
+	p := &proxy{riffClient: riffClient}
+	WithWarmup(time.Minute)(p)
+	now := time.Now()
+
+	assert.True(t, p.idle(now))
+	done := p.activity()
+	assert.False(t, p.idle(now.Add(time.Hour)), "a request is in flight")
+	done()
+	assert.False(t, p.idle(time.Now()), "a request was just served")
+	assert.True(t, p.idle(time.Now().Add(time.Minute)))
+
+	request, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	p.invokeGrpc(httptest.NewRecorder(), request)
+	assert.False(t, p.idle(time.Now()))
+}